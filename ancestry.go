@@ -0,0 +1,228 @@
+package main
+
+import (
+	"container/list"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	ANCESTRY_DEPTH         = 8
+	ANCESTRY_MAX_PROCESSES = 32768
+	CLONE_THREAD           = 0x10000 // clone flag of new threads, they share the process of their parent
+)
+
+// Ancestor is a parent, grandparent, ... of the process of an event
+type Ancestor struct {
+	Pid  int    `json:"pid"`
+	Exe  string `json:"exe,omitempty"`
+	Comm string `json:"comm,omitempty"`
+	Auid string `json:"auid,omitempty"`
+}
+
+type processEntry struct {
+	Ancestor
+	ppid int
+}
+
+// processTable tracks the processes of SYSCALL records to add the ancestry of the process to every event.
+// Processes are added by fork, vfork and clone, updated by any other syscall, execve included, and removed by exit.
+// Processes that were not seen yet, like the ones started before go-audit, are read from procfs
+type processTable struct {
+	mu        sync.Mutex
+	procRoot  string
+	depth     int // Maximum amount of ancestors per event
+	max       int // Maximum amount of tracked processes, the least recently seen are evicted first
+	processes map[int]*list.Element
+	lru       *list.List // Most recently seen first
+}
+
+func newProcessTable(procRoot string, depth, max int) *processTable {
+	return &processTable{
+		procRoot:  procRoot,
+		depth:     depth,
+		max:       max,
+		processes: make(map[int]*list.Element),
+		lru:       list.New(),
+	}
+}
+
+// Observe keeps the table up to date with every event, filtered ones included
+func (p *processTable) Observe(msg *AuditMessageGroup) {
+	var sc *AuditMessage
+	for _, m := range msg.Msgs {
+		if m.Type == 1300 {
+			sc = m
+			break
+		}
+	}
+	if sc == nil {
+		return
+	}
+
+	var e processEntry
+	var success, exit, a0 string
+	scanFields(sc.Data, func(key, value string, quote byte) {
+		switch key {
+		case "pid":
+			e.Pid, _ = strconv.Atoi(value)
+		case "ppid":
+			e.ppid, _ = strconv.Atoi(value)
+		case "exe":
+			e.Exe = decodeExecveValue(value, quote)
+		case "comm":
+			e.Comm = decodeExecveValue(value, quote)
+		case "auid":
+			e.Auid = value
+		case "success":
+			success = value
+		case "exit":
+			exit = value
+		case "a0":
+			a0 = value
+		}
+	})
+	if e.Pid == 0 {
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	switch msg.SyscallName {
+	case "exit", "exit_group":
+		// If only a thread exited the process is read from procfs again when it shows up next
+		p.remove(e.Pid)
+		return
+	}
+
+	p.set(&e)
+
+	if success != "yes" {
+		return
+	}
+
+	switch msg.SyscallName {
+	case "clone":
+		if flags, err := strconv.ParseUint(a0, 16, 64); err == nil && flags&CLONE_THREAD != 0 {
+			return
+		}
+	case "fork", "vfork", "clone3":
+	default:
+		return
+	}
+
+	// The child inherits everything from its parent until it calls execve
+	if child, err := strconv.Atoi(exit); err == nil && child > 0 {
+		p.set(&processEntry{Ancestor: Ancestor{Pid: child, Exe: e.Exe, Comm: e.Comm, Auid: e.Auid}, ppid: e.Pid})
+	}
+}
+
+// Enrich adds the ancestors of the process of the event, starting with its parent
+func (p *processTable) Enrich(msg *AuditMessageGroup) {
+	if msg.Ppid == 0 {
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var ancestry []*Ancestor
+	seen := make(map[int]bool, p.depth)
+	for pid := msg.Ppid; pid > 0 && len(ancestry) < p.depth && !seen[pid]; {
+		seen[pid] = true
+
+		e := p.get(pid)
+		if e == nil {
+			// The parent is gone, its pid is all there is
+			ancestry = append(ancestry, &Ancestor{Pid: pid})
+			break
+		}
+
+		a := e.Ancestor
+		ancestry = append(ancestry, &a)
+		pid = e.ppid
+	}
+
+	msg.Ancestry = ancestry
+}
+
+// Len returns the amount of tracked processes
+func (p *processTable) Len() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.lru.Len()
+}
+
+func (p *processTable) get(pid int) *processEntry {
+	if el, ok := p.processes[pid]; ok {
+		p.lru.MoveToFront(el)
+		return el.Value.(*processEntry)
+	}
+
+	e := p.readProc(pid)
+	if e != nil {
+		p.set(e)
+	}
+	return e
+}
+
+func (p *processTable) set(e *processEntry) {
+	if el, ok := p.processes[e.Pid]; ok {
+		el.Value = e
+		p.lru.MoveToFront(el)
+		return
+	}
+
+	p.processes[e.Pid] = p.lru.PushFront(e)
+	for p.lru.Len() > p.max {
+		oldest := p.lru.Back()
+		p.lru.Remove(oldest)
+		delete(p.processes, oldest.Value.(*processEntry).Pid)
+		processTableEvictedTotal.WithLabelValues(hostname).Inc()
+	}
+	processTableSize.WithLabelValues(hostname).Set(float64(p.lru.Len()))
+}
+
+func (p *processTable) remove(pid int) {
+	if el, ok := p.processes[pid]; ok {
+		p.lru.Remove(el)
+		delete(p.processes, pid)
+		processTableSize.WithLabelValues(hostname).Set(float64(p.lru.Len()))
+	}
+}
+
+// Reads a process from procfs, returns nil if it is gone
+func (p *processTable) readProc(pid int) *processEntry {
+	dir := filepath.Join(p.procRoot, strconv.Itoa(pid))
+
+	// `pid (comm) state ppid ...`, comm can contain spaces and parentheses
+	stat, err := ioutil.ReadFile(filepath.Join(dir, "stat"))
+	if err != nil {
+		return nil
+	}
+	s := string(stat)
+	open, end := strings.IndexByte(s, '('), strings.LastIndexByte(s, ')')
+	if open < 0 || end < open {
+		return nil
+	}
+	fields := strings.Fields(s[end+1:])
+	if len(fields) < 2 {
+		return nil
+	}
+
+	e := &processEntry{Ancestor: Ancestor{Pid: pid, Comm: s[open+1 : end]}}
+	e.ppid, _ = strconv.Atoi(fields[1])
+
+	// Kernel threads have no exe, other users' processes need CAP_SYS_PTRACE
+	e.Exe, _ = os.Readlink(filepath.Join(dir, "exe"))
+	if auid, err := ioutil.ReadFile(filepath.Join(dir, "loginuid")); err == nil {
+		e.Auid = strings.TrimSpace(string(auid))
+	}
+
+	return e
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProcessTable(t *testing.T) {
+	root := tempDir(t)
+	defer os.RemoveAll(root)
+
+	// sshd and systemd were running before go-audit
+	writeProc(t, root, 1, "1 (systemd) S 0 1 1", "/usr/lib/systemd/systemd", "4294967295")
+	writeProc(t, root, 800, "800 (sshd) S 1 800 800", "/usr/sbin/sshd", "4294967295")
+
+	p := newProcessTable(root, ANCESTRY_DEPTH, 100)
+	group := func(data string) *AuditMessageGroup {
+		amg := &AuditMessageGroup{UidMap: map[string]string{}, GidMap: map[string]string{}}
+		amg.AddMessage(&AuditMessage{Type: 1300, Data: data})
+		p.Observe(amg)
+		p.Enrich(amg)
+		return amg
+	}
+
+	// sshd forks a session, which runs bash, which forks and runs curl
+	group(`arch=c000003e syscall=56 success=yes exit=900 a0=1200011 ppid=1 pid=800 auid=4294967295 comm="sshd" exe="/usr/sbin/sshd"`)
+	group(`arch=c000003e syscall=59 success=yes exit=0 ppid=800 pid=900 auid=1000 comm="bash" exe="/usr/bin/bash"`)
+	group(`arch=c000003e syscall=57 success=yes exit=901 ppid=800 pid=900 auid=1000 comm="bash" exe="/usr/bin/bash"`)
+	amg := group(`arch=c000003e syscall=59 success=yes exit=0 ppid=900 pid=901 auid=1000 comm="curl" exe="/usr/bin/curl"`)
+
+	assert.Equal(t, []*Ancestor{
+		{Pid: 900, Exe: "/usr/bin/bash", Comm: "bash", Auid: "1000"},
+		{Pid: 800, Exe: "/usr/sbin/sshd", Comm: "sshd", Auid: "4294967295"},
+		{Pid: 1, Exe: "/usr/lib/systemd/systemd", Comm: "systemd", Auid: "4294967295"},
+	}, amg.Ancestry)
+	assert.Equal(t, 4, p.Len())
+
+	// Threads are not processes
+	group(`arch=c000003e syscall=56 success=yes exit=902 a0=3d0f00 ppid=800 pid=900 auid=1000 comm="bash" exe="/usr/bin/bash"`)
+	assert.Equal(t, 4, p.Len())
+
+	// Exits remove the process, its own event still has its ancestry
+	amg = group(`arch=c000003e syscall=231 success=yes exit=0 ppid=900 pid=901 auid=1000 comm="curl" exe="/usr/bin/curl"`)
+	assert.Len(t, amg.Ancestry, 3)
+	assert.Equal(t, 3, p.Len())
+
+	// A parent that is gone from the table and procfs only has its pid
+	amg = group(`arch=c000003e syscall=59 success=yes exit=0 ppid=700 pid=701 auid=1000 comm="sh" exe="/bin/sh"`)
+	assert.Equal(t, []*Ancestor{{Pid: 700}}, amg.Ancestry)
+}
+
+func TestProcessTableLimits(t *testing.T) {
+	root := tempDir(t)
+	defer os.RemoveAll(root)
+
+	p := newProcessTable(root, 2, 3)
+	for pid := 10; pid < 15; pid++ {
+		amg := &AuditMessageGroup{SyscallName: "execve", Msgs: []*AuditMessage{{
+			Type: 1300,
+			Data: "ppid=" + strconv.Itoa(pid-1) + " pid=" + strconv.Itoa(pid) + ` comm="sh"`,
+		}}}
+		p.Observe(amg)
+	}
+
+	// 10 and 11 are evicted
+	assert.Equal(t, 3, p.Len())
+
+	amg := &AuditMessageGroup{Ppid: 14}
+	p.Enrich(amg)
+	assert.Equal(t, []*Ancestor{{Pid: 14, Comm: "sh"}, {Pid: 13, Comm: "sh"}}, amg.Ancestry, "Ancestry should be bounded by the depth")
+
+	amg = &AuditMessageGroup{Ppid: 12}
+	p.Enrich(amg)
+	assert.Equal(t, []*Ancestor{{Pid: 12, Comm: "sh"}, {Pid: 11}}, amg.Ancestry)
+
+	// Loops from reused pids end
+	p.set(&processEntry{Ancestor: Ancestor{Pid: 20}, ppid: 21})
+	p.set(&processEntry{Ancestor: Ancestor{Pid: 21}, ppid: 20})
+	p.depth = 10
+	amg = &AuditMessageGroup{Ppid: 20}
+	p.Enrich(amg)
+	assert.Len(t, amg.Ancestry, 2)
+}
+
+func TestAuditMarshallerObserver(t *testing.T) {
+	root := tempDir(t)
+	defer os.RemoveAll(root)
+
+	filters, err := createFilters(&Config{Filters: []Filter{{Syscall: "fork", MessageType: 1300, Regex: "bash"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := NewAuditMarshaller([]*AuditWriter{NewAuditWriter(&noopWriter{}, 1)}, uint16(1300), uint16(1399), false, false, 0, FieldsModeOff, COMPLETE_AFTER, filters)
+	p := newProcessTable(root, ANCESTRY_DEPTH, 100)
+	m.SetEnrichers([]enricher{p})
+
+	// The filtered fork still tells the table about the child
+	m.Consume(&syscall.NetlinkMessage{
+		Header: syscall.NlMsghdr{Type: 1300},
+		Data:   []byte(`audit(10000001:1): arch=c000003e syscall=57 success=yes exit=901 ppid=800 pid=900 auid=1000 comm="bash" exe="/usr/bin/bash"`),
+	})
+	assert.Equal(t, 1, m.Flush())
+	assert.Equal(t, 2, p.Len())
+}
+
+func writeProc(t *testing.T, procRoot string, pid int, stat, exe, loginuid string) {
+	dir := filepath.Join(procRoot, strconv.Itoa(pid))
+	writeFile(t, filepath.Join(dir, "stat"), stat+"\n")
+	writeFile(t, filepath.Join(dir, "loginuid"), loginuid)
+	if err := os.Symlink(exe, filepath.Join(dir, "exe")); err != nil {
+		t.Fatal(err)
+	}
+}
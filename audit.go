@@ -6,15 +6,17 @@ import (
 	"flag"
 	"fmt"
 	"log/syslog"
+	"net"
 	"net/http"
 	"os"
-	"os/exec"
 	"os/signal"
 	"os/user"
+	"path/filepath"
 	"regexp"
 	"strconv"
 	"strings"
 	"syscall"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/sirupsen/logrus"
@@ -25,6 +27,15 @@ var (
 )
 
 func main() {
+	logrus.SetLevel(logrus.WarnLevel)
+	if ok, err := runCommand(os.Args[1:], os.Stdin, os.Stdout); ok {
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	flag.Parse()
 
 	logrus.SetLevel(logrus.InfoLevel)
@@ -43,17 +54,27 @@ func main() {
 		logrus.WithError(err).Fatal("failed to init metrics")
 	}
 
+	// Outputs outlive the receiving loop so they can be flushed on shutdown
 	ctx, cancel := context.WithCancel(context.Background())
+	outputCtx, outputCancel := context.WithCancel(context.Background())
 
-	// output needs to be created before anything that write to stdout
-	writer, err := createOutput(ctx, config)
+	// outputs need to be created before anything that write to stdout
+	writers, err := createOutput(outputCtx, config)
 	if err != nil {
-		logrus.WithError(err).Fatal("failed to create output")
+		logrus.WithError(err).Fatal("failed to create outputs")
 	}
 
-	if err := setRules(config, exe); err != nil {
+	rc, err := NewNetlinkRuleClient()
+	if err != nil {
+		logrus.WithError(err).Fatal("failed to create netlink rule client")
+	}
+	if err := setKernelStatus(config, rc); err != nil {
+		logrus.WithError(err).Fatal("failed to configure the kernel")
+	}
+	if err := setRules(config, rc); err != nil {
 		logrus.WithError(err).Fatal("failed to set rules")
 	}
+	rc.Close()
 
 	nlClient, err := NewNetlinkClient(config.SockerBuffer.Receive)
 	if err != nil {
@@ -63,28 +84,114 @@ func main() {
 	if err != nil {
 		logrus.WithError(err).Fatal("failed to create filters")
 	}
+	fieldsMode, err := validateFieldsMode(config.Parser.Fields)
+	if err != nil {
+		logrus.WithError(err).Fatal("failed to configure the parser")
+	}
+	if config.Events.CompleteAfter < COMPLETE_AFTER_MIN {
+		logrus.Fatalf("events complete_after must be at least %v, %v provided", COMPLETE_AFTER_MIN, config.Events.CompleteAfter)
+	}
+	if timezone, err = loadTimezone(config.Events.Timezone); err != nil {
+		logrus.WithError(err).Fatal("failed to configure the timezone")
+	}
+	if config.Identity.CacheSize < 1 {
+		logrus.Fatalf("identity cache_size must be at least 1, %d provided", config.Identity.CacheSize)
+	}
+	identities = newIdentityResolver(config.Identity.CacheSize, config.Identity.CacheTTL)
 	marshaller := NewAuditMarshaller(
-		writer,
+		writers,
 		uint16(config.Events.Min),
 		uint16(config.Events.Max),
 		config.MessageTracking.Enabled,
 		config.MessageTracking.LogOutOfOrder,
 		config.MessageTracking.MaxOutOfOrder,
+		fieldsMode,
+		config.Events.CompleteAfter,
 		filter,
 	)
 
-	logrus.Infof("started processing events in the range [%d, %d]", config.Events.Min, config.Events.Max)
+	enrichers, err := createEnrichers(config)
+	if err != nil {
+		logrus.WithError(err).Fatal("failed to create enrichers")
+	}
+	marshaller.SetEnrichers(enrichers)
+
+	samplers, err := createSamplers(config)
+	if err != nil {
+		logrus.WithError(err).Fatal("failed to create sampling rules")
+	}
+	marshaller.SetSamplers(samplers)
 
-	go loop(ctx, nlClient, marshaller)
+	logrus.Infof("started processing events in the range [%d, %d]", config.Events.Min, config.Events.Max)
 
 	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGTERM, syscall.SIGINT)
+
+	loopDone := make(chan struct{})
 	go func() {
-		signal.Notify(stop, syscall.SIGTERM, syscall.SIGINT)
-		defer signal.Stop(stop)
+		loop(ctx, nlClient, marshaller)
+		close(loopDone)
 	}()
+	go marshaller.FlushOnTimer(ctx)
+
+	if config.Kernel.StatusInterval > 0 {
+		statusClient, err := NewNetlinkRuleClient()
+		if err != nil {
+			logrus.WithError(err).Fatal("failed to create netlink status client")
+		}
+		go watchKernelStatus(ctx, statusClient, config.Kernel.StatusInterval)
+	}
 
-	<-stop
+	r := &reloader{
+		filename:     *configFile,
+		config:       config,
+		marshaller:   marshaller,
+		writers:      writers,
+		outputCancel: outputCancel,
+		kernelClient: func() (kernelClient, error) { return NewNetlinkRuleClient() },
+	}
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	for running := true; running; {
+		select {
+		case <-hup:
+			if err := r.reload(); err != nil {
+				logrus.WithError(err).Error("rejected the new configuration, keeping the running one")
+			} else {
+				logrus.Info("reloaded the configuration")
+			}
+		case <-stop:
+			running = false
+		}
+	}
+
+	signal.Stop(stop)
+	signal.Stop(hup)
+	shutdown(cancel, loopDone, marshaller, r.writers, r.config.Shutdown.Timeout)
+	r.outputCancel()
+	closeSpools(r.writers)
+}
+
+// shutdown stops receiving events, writes every pending message group and flushes the outputs
+func shutdown(cancel context.CancelFunc, loopDone <-chan struct{}, marshaller *AuditMarshaller, writers []*AuditWriter, timeout time.Duration) int {
+	logrus.Info("shutting down, no longer receiving events")
 	cancel()
+
+	// The pending groups and the queued messages share the timeout. The loop may be stuck writing to an output
+	// that blocks on failure, so the timeout starts before waiting for it
+	deadline := time.Now().Add(timeout)
+	t := stopOutputsAfter(writers, timeout)
+	defer t.Stop()
+	<-loopDone
+
+	groups := marshaller.Flush()
+	logrus.Infof("wrote %d pending message groups", groups)
+
+	dropped := flushOutputs(writers, deadline.Sub(time.Now()))
+	logrus.Infof("shutdown complete, %d events were dropped", dropped)
+	return dropped
 }
 
 func loop(ctx context.Context, nlClient *NetlinkClient, marshaller *AuditMarshaller) {
@@ -95,6 +202,10 @@ func loop(ctx context.Context, nlClient *NetlinkClient, marshaller *AuditMarshal
 			return
 		default:
 			msg, err := nlClient.Receive()
+			if err == syscall.EAGAIN {
+				// Nothing arrived within the receive timeout
+				continue
+			}
 			if err != nil {
 				logrus.WithError(err).Error("failed to receive a message")
 				continue
@@ -107,6 +218,51 @@ func loop(ctx context.Context, nlClient *NetlinkClient, marshaller *AuditMarshal
 	}
 }
 
+// watchKernelStatus periodically exports the kernel audit status and logs when the kernel drops events
+func watchKernelStatus(ctx context.Context, c *NetlinkClient, interval time.Duration) {
+	defer c.Close()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	lost := &lostEvents{}
+	for {
+		s, err := c.GetStatus()
+		if err != nil {
+			logrus.WithError(err).Error("failed to get the kernel audit status")
+		} else {
+			updateKernelMetrics(s)
+			if n := lost.update(s.Lost); n > 0 {
+				logrus.Errorf("kernel lost %d events, backlog %d of %d", n, s.Backlog, s.BacklogLimit)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// lostEvents follows the lost counter of the kernel from one status poll to the next
+type lostEvents struct {
+	last uint32
+	seen bool
+}
+
+// update returns how many events the kernel lost since the previous poll, the first poll only sets the baseline
+func (l *lostEvents) update(lost uint32) uint32 {
+	var n uint32
+	if l.seen && lost > l.last {
+		n = lost - l.last
+	}
+
+	l.last = lost
+	l.seen = true
+	return n
+}
+
 func initWebServer(addr string) error {
 	mux := http.NewServeMux()
 	mux.Handle("/metrics", prometheus.Handler())
@@ -121,83 +277,238 @@ func initWebServer(addr string) error {
 	return nil
 }
 
-func setRules(config *Config, e executor) error {
+// parseRules parses every configured rule, empty rules are kept as nil to preserve the rule numbers
+func parseRules(config *Config) ([]*ruleCommand, error) {
+	if len(config.Rules) == 0 {
+		return nil, errors.New("no audit rules found")
+	}
+
+	cmds := make([]*ruleCommand, len(config.Rules))
+	for i, v := range config.Rules {
+		// Skip rules with no content
+		if strings.TrimSpace(v) == "" {
+			continue
+		}
+
+		cmd, err := parseRule(v)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse rule #%d: %v", i+1, err)
+		}
+		cmds[i] = cmd
+	}
+
+	return cmds, nil
+}
+
+func setRules(config *Config, c RuleClient) error {
+	// Parse all rules before touching the kernel so a broken config does not leave us without rules
+	cmds, err := parseRules(config)
+	if err != nil {
+		return err
+	}
+
 	// Clear existing rules
-	if err := e("auditctl", "-D"); err != nil {
+	if err := c.DeleteAllRules(); err != nil {
 		return fmt.Errorf("failed to flush existing audit rules: %v", err)
 	}
 
 	logrus.Info("flushed existing audit rules")
 
 	// Add ours in
-	if rules := config.Rules; len(rules) != 0 {
-		for i, v := range rules {
-			// Skip rules with no content
-			if v == "" {
-				continue
-			}
+	for i, cmd := range cmds {
+		if cmd == nil {
+			continue
+		}
 
-			if err := e("auditctl", strings.Fields(v)...); err != nil {
-				return fmt.Errorf("failed to add rule #%d: %v", i+1, err)
-			}
+		if err := cmd.apply(c); err != nil {
+			return fmt.Errorf("failed to add rule #%d: %v", i+1, err)
+		}
+
+		logrus.Infof("added audit rule #%d", i+1)
+	}
+
+	return nil
+}
 
-			logrus.Infof("added audit rule #%d", i+1)
+// setKernelStatus applies the `kernel` config section and verifies the kernel took the values
+func setKernelStatus(config *Config, c StatusClient) error {
+	s := &AuditStatusPayload{}
+	k := config.Kernel
+
+	for _, v := range []struct {
+		name  string
+		value int
+		mask  uint32
+		field *uint32
+	}{
+		{"backlog_limit", k.BacklogLimit, AUDIT_STATUS_BACKLOG_LIMIT, &s.BacklogLimit},
+		{"rate_limit", k.RateLimit, AUDIT_STATUS_RATE_LIMIT, &s.RateLimit},
+		{"backlog_wait_time", k.BacklogWaitTime, AUDIT_STATUS_BACKLOG_WAIT_TIME, &s.BacklogWaitTime},
+	} {
+		// -1 leaves the kernel value untouched
+		if v.value == -1 {
+			continue
+		}
+		if v.value < -1 {
+			return fmt.Errorf("kernel %s must be at least 0, %d provided", v.name, v.value)
+		}
+		s.Mask |= v.mask
+		*v.field = uint32(v.value)
+	}
+
+	if k.Failure != "" {
+		switch k.Failure {
+		case "silent":
+			s.Failure = AUDIT_FAIL_SILENT
+		case "printk":
+			s.Failure = AUDIT_FAIL_PRINTK
+		case "panic":
+			s.Failure = AUDIT_FAIL_PANIC
+		default:
+			return fmt.Errorf("kernel failure must be one of `silent`, `printk` or `panic`, %s provided", k.Failure)
+		}
+		s.Mask |= AUDIT_STATUS_FAILURE
+	}
+
+	if s.Mask == 0 {
+		return nil
+	}
+
+	if err := c.SetStatus(s); err != nil {
+		return fmt.Errorf("failed to set the kernel audit status: %v", err)
+	}
+
+	got, err := c.GetStatus()
+	if err != nil {
+		return fmt.Errorf("failed to verify the kernel audit status: %v", err)
+	}
+
+	for _, v := range []struct {
+		name      string
+		mask      uint32
+		want, got uint32
+	}{
+		{"backlog_limit", AUDIT_STATUS_BACKLOG_LIMIT, s.BacklogLimit, got.BacklogLimit},
+		{"rate_limit", AUDIT_STATUS_RATE_LIMIT, s.RateLimit, got.RateLimit},
+		{"backlog_wait_time", AUDIT_STATUS_BACKLOG_WAIT_TIME, s.BacklogWaitTime, got.BacklogWaitTime},
+		{"failure", AUDIT_STATUS_FAILURE, s.Failure, got.Failure},
+	} {
+		if s.Mask&v.mask != 0 && v.want != v.got {
+			return fmt.Errorf("kernel %s is %d after setting it to %d", v.name, v.got, v.want)
 		}
-	} else {
-		return errors.New("no audit rules found")
 	}
 
+	logrus.Infof(
+		"configured kernel backlog_limit: %d, rate_limit: %d, backlog_wait_time: %d, failure: %d",
+		got.BacklogLimit, got.RateLimit, got.BacklogWaitTime, got.Failure,
+	)
+
 	return nil
 }
 
-func createOutput(ctx context.Context, config *Config) (*AuditWriter, error) {
-	var writer *AuditWriter
-	var err error
-	i := 0
+func createOutput(ctx context.Context, config *Config) ([]*AuditWriter, error) {
+	var writers []*AuditWriter
 
 	if config.Output.Syslog.Enabled {
-		i++
-		writer, err = createSyslogOutput(config)
+		writer, err := createSyslogOutput(config)
 		if err != nil {
 			return nil, err
 		}
+
+		if writers, err = addOutput(ctx, config, writers, writer, "syslog", config.Output.Syslog.OutputConfig); err != nil {
+			return nil, err
+		}
 	}
 
 	if config.Output.File.Enabled {
-		i++
-		writer, err = createFileOutput(config)
+		writer, err := createFileOutput(config)
 		if err != nil {
 			return nil, err
 		}
 
-		go handleLogRotation(config, writer)
+		if writers, err = addOutput(ctx, config, writers, writer, "file", config.Output.File.OutputConfig); err != nil {
+			return nil, err
+		}
+
+		go handleLogRotation(ctx, config, writer)
 	}
 
 	if config.Output.Stdout.Enabled {
-		i++
-		writer, err = createStdOutOutput(config)
+		writer, err := createStdOutOutput(config)
 		if err != nil {
 			return nil, err
 		}
+
+		if writers, err = addOutput(ctx, config, writers, writer, "stdout", config.Output.Stdout.OutputConfig); err != nil {
+			return nil, err
+		}
 	}
 
 	if config.Output.Kafka.Enabled {
-		i++
-		writer, err = createKafkaOutput(ctx, config)
+		writer, err := createKafkaOutput(ctx, config)
 		if err != nil {
 			return nil, err
 		}
-	}
 
-	if i > 1 {
-		return nil, errors.New("only one output can be enabled at a time")
+		if writers, err = addOutput(ctx, config, writers, writer, "kafka", config.Output.Kafka.OutputConfig); err != nil {
+			return nil, err
+		}
 	}
 
-	if writer == nil {
+	if len(writers) == 0 {
 		return nil, errors.New("no outputs were configured")
 	}
 
-	return writer, nil
+	return writers, nil
+}
+
+// addOutput names the writer after its output and applies the failure policy before adding it to the set.
+// Outputs that spool on failure get their own spool directory, messages left from a previous run are replayed.
+// Outputs that stopped spooling replay what is left in their spool as well
+func addOutput(ctx context.Context, config *Config, writers []*AuditWriter, writer *AuditWriter, name string, oc OutputConfig) ([]*AuditWriter, error) {
+	policy, err := validateFailurePolicy(name, oc.OnFailure)
+	if err != nil {
+		return nil, err
+	}
+
+	writer.name = name
+	writer.onFailure = policy
+
+	if oc.Backoff > 0 {
+		writer.backoffInitial = oc.Backoff
+	}
+	if oc.BackoffMax > 0 {
+		writer.backoffMax = oc.BackoffMax
+	}
+	if writer.backoffMax < writer.backoffInitial {
+		return nil, fmt.Errorf("output backoff_max for %s must be at least backoff %v, %v provided", name, writer.backoffInitial, writer.backoffMax)
+	}
+
+	if policy == FailurePolicySpool {
+		dir := filepath.Join(config.Spool.Directory, name)
+		if writer.spool, err = OpenSpool(dir, name, config.Spool.MaxSize, config.Spool.SegmentSize); err != nil {
+			return nil, err
+		}
+
+		if n := writer.spool.Len(); n > 0 {
+			logrus.Infof("replaying %d spooled messages for output %s", n, name)
+		}
+		go writer.replay(ctx)
+	} else if config.Spool.Directory != "" {
+		// Messages spooled while the output used the spool policy are still delivered
+		dir := filepath.Join(config.Spool.Directory, name)
+		if writer.spool, err = openLeftoverSpool(dir, name, config.Spool.MaxSize, config.Spool.SegmentSize); err != nil {
+			return nil, err
+		}
+
+		if writer.spool != nil {
+			logrus.Infof("replaying %d messages output %s spooled before it stopped spooling", writer.spool.Len(), name)
+			go writer.replay(ctx)
+		}
+	}
+	logrus.Infof("enabled output %s, on failure: %s", name, policy)
+
+	return append(writers, writer), nil
 }
 
 func createSyslogOutput(config *Config) (*AuditWriter, error) {
@@ -273,12 +584,20 @@ func createFileOutput(config *Config) (*AuditWriter, error) {
 	return NewAuditWriter(f, attempts), nil
 }
 
-func handleLogRotation(config *Config, writer *AuditWriter) {
+func handleLogRotation(ctx context.Context, config *Config, writer *AuditWriter) {
 	// Re-open our log file. This is triggered by a USR1 signal and is meant to be used upon log rotation
 	sigc := make(chan os.Signal, 1)
 	signal.Notify(sigc, syscall.SIGUSR1)
+	defer signal.Stop(sigc)
+
+	for {
+		// The output was replaced by a reload
+		select {
+		case <-ctx.Done():
+			return
+		case <-sigc:
+		}
 
-	for range sigc {
 		newWriter, err := createFileOutput(config)
 		if err != nil {
 			logrus.WithError(err).Fatal("error re-opening log file")
@@ -286,7 +605,6 @@ func handleLogRotation(config *Config, writer *AuditWriter) {
 
 		oldFile := writer.w.(*os.File)
 		writer.w = newWriter.w
-		writer.e = newWriter.e
 
 		err = oldFile.Close()
 		if err != nil {
@@ -319,6 +637,97 @@ func createKafkaOutput(ctx context.Context, config *Config) (*AuditWriter, error
 	return NewAuditWriter(kw, attempts), nil
 }
 
+func createEnrichers(config *Config) ([]enricher, error) {
+	var enrichers []enricher
+	ec := config.Enrichment
+
+	if ec.Enabled || ec.Ancestry.Enabled {
+		if _, err := os.Stat(ec.ProcRoot); err != nil {
+			return nil, fmt.Errorf("enrichment proc_root could not be used: %v", err)
+		}
+	}
+
+	if ec.Enabled {
+		if ec.CacheSize < 1 {
+			return nil, fmt.Errorf("enrichment cache_size must be at least 1, %d provided", ec.CacheSize)
+		}
+
+		enrichers = append(enrichers, newProcessEnricher(ec.ProcRoot, ec.ContainerMetadata, ec.CacheSize))
+		logrus.Infof("Enriching events with the container and systemd unit of their process from %s", ec.ProcRoot)
+	}
+
+	if ec.Ancestry.Enabled {
+		if ec.Ancestry.Depth < 1 {
+			return nil, fmt.Errorf("enrichment ancestry depth must be at least 1, %d provided", ec.Ancestry.Depth)
+		}
+		if ec.Ancestry.MaxProcesses < 1 {
+			return nil, fmt.Errorf("enrichment ancestry max_processes must be at least 1, %d provided", ec.Ancestry.MaxProcesses)
+		}
+
+		enrichers = append(enrichers, newProcessTable(ec.ProcRoot, ec.Ancestry.Depth, ec.Ancestry.MaxProcesses))
+		logrus.Infof("Enriching events with up to %d ancestors of their process", ec.Ancestry.Depth)
+	}
+
+	if ec.Sessions.Enabled {
+		if ec.Sessions.MaxSessions < 1 {
+			return nil, fmt.Errorf("enrichment sessions max_sessions must be at least 1, %d provided", ec.Sessions.MaxSessions)
+		}
+
+		enrichers = append(enrichers, newSessionTracker(ec.Sessions.MaxSessions))
+		logrus.Info("Enriching events with their login session")
+	}
+
+	return enrichers, nil
+}
+
+func createSamplers(config *Config) ([]*sampler, error) {
+	var samplers []*sampler
+
+	for i, r := range config.Sampling {
+		name := r.Name
+		if name == "" {
+			name = fmt.Sprintf("sampling-%d", i+1)
+		}
+
+		var expr *filterExpr
+		if r.Expression != "" {
+			var err error
+			if expr, err = compileFilterExpr(r.Expression); err != nil {
+				return nil, fmt.Errorf("`expression` in sampling rule %d could not be parsed: %v", i+1, err)
+			}
+		}
+
+		switch {
+		case r.Rate != 0 && r.Limit != 0:
+			return nil, fmt.Errorf("Sampling rule %d can only have one of the `rate` or `limit` entries", i+1)
+		case r.Rate < 0:
+			return nil, fmt.Errorf("Sampling rule %d rate must be at least 1, %d provided", i+1, r.Rate)
+		case r.Rate > 0:
+			if r.Key != "" || r.Burst != 0 {
+				return nil, fmt.Errorf("Sampling rule %d can only have a `key` or `burst` with a `limit`", i+1)
+			}
+			samplers = append(samplers, newRateSampler(name, expr, r.Rate))
+			logrus.Infof("Sampling rule %d keeps 1 in %d events matching `%s`", i+1, r.Rate, r.Expression)
+		case r.Limit < 0:
+			return nil, fmt.Errorf("Sampling rule %d limit must be greater than 0, %v provided", i+1, r.Limit)
+		case r.Limit > 0:
+			if r.Burst < 0 {
+				return nil, fmt.Errorf("Sampling rule %d burst must be at least 1, %d provided", i+1, r.Burst)
+			}
+			samplers = append(samplers, newLimitSampler(name, expr, r.Key, r.Limit, r.Burst))
+			if r.Key != "" {
+				logrus.Infof("Sampling rule %d keeps %v events per second and %s matching `%s`", i+1, r.Limit, r.Key, r.Expression)
+			} else {
+				logrus.Infof("Sampling rule %d keeps %v events per second matching `%s`", i+1, r.Limit, r.Expression)
+			}
+		default:
+			return nil, fmt.Errorf("Sampling rule %d is missing the `rate` or `limit` entry", i+1)
+		}
+	}
+
+	return samplers, nil
+}
+
 func createFilters(config *Config) ([]AuditFilter, error) {
 	var (
 		err     error
@@ -326,11 +735,36 @@ func createFilters(config *Config) ([]AuditFilter, error) {
 	)
 	fs := config.Filters
 	if fs == nil {
-		return filters
+		return filters, nil
 	}
 
 	for i, f := range fs {
-		var af AuditFilter
+		af := AuditFilter{index: i + 1}
+		if f.Expression != "" {
+			if f.Syscall != "" || f.MessageType != 0 || f.Regex != "" || f.CIDR != "" {
+				return nil, fmt.Errorf("Filter %d can not combine `expression` with `syscall`, `message_type`, `regex` or `cidr`", i+1)
+			}
+			if af.expr, err = compileFilterExpr(f.Expression); err != nil {
+				return nil, fmt.Errorf("`expression` in filter %d could not be parsed: %v", i+1, err)
+			}
+
+			switch f.Action {
+			case FilterActionInclude:
+				af.include = true
+			case FilterActionExclude, "":
+				f.Action = FilterActionExclude
+			default:
+				return nil, fmt.Errorf("Filter %d action must be one of `include` or `exclude`, %s provided", i+1, f.Action)
+			}
+
+			filters = append(filters, af)
+			logrus.Infof("Filter %d will %s events matching `%s`", i+1, f.Action, af.expr)
+			continue
+		}
+		if f.Action != "" {
+			return nil, fmt.Errorf("Filter %d can only have an `action` with an `expression`", i+1)
+		}
+
 		if f.MessageType != 0 {
 			af.messageType = uint16(f.MessageType)
 		}
@@ -339,12 +773,27 @@ func createFilters(config *Config) ([]AuditFilter, error) {
 				return nil, fmt.Errorf("`regex` in filter %d could not be parsed: %s", i+1, f.Regex)
 			}
 		}
-		if f.Syscall != 0 {
-			af.syscall = strconv.Itoa(f.Syscall)
+		if f.CIDR != "" {
+			if af.regex != nil {
+				return nil, fmt.Errorf("Filter %d can only have one of the `regex` or `cidr` entries", i+1)
+			}
+			if af.messageType != 0 && af.messageType != 1306 {
+				return nil, fmt.Errorf("Filter %d with a `cidr` entry only applies to message type 1306", i+1)
+			}
+			if _, af.cidr, err = net.ParseCIDR(f.CIDR); err != nil {
+				return nil, fmt.Errorf("`cidr` in filter %d could not be parsed: %s", i+1, f.CIDR)
+			}
+			af.messageType = 1306
+		}
+		if f.Syscall != "" {
+			if _, err := strconv.Atoi(f.Syscall); err != nil && !isSyscallName(f.Syscall) {
+				return nil, fmt.Errorf("Filter %d has an unknown syscall `%s`", i+1, f.Syscall)
+			}
+			af.syscall = f.Syscall
 		}
 
-		if af.regex == nil {
-			return nil, fmt.Errorf("Filter %d is missing the `regex` entry", i+1)
+		if af.regex == nil && af.cidr == nil {
+			return nil, fmt.Errorf("Filter %d is missing the `regex` or `cidr` entry", i+1)
 		}
 
 		if af.syscall == "" {
@@ -356,14 +805,12 @@ func createFilters(config *Config) ([]AuditFilter, error) {
 		}
 
 		filters = append(filters, af)
+		if af.cidr != nil {
+			logrus.Infof("Ignoring  syscall `%v` with a socket address in `%s`", af.syscall, af.cidr.String())
+			continue
+		}
 		logrus.Infof("Ignoring  syscall `%v` containing message type `%v` matching string `%s`", af.syscall, af.messageType, af.regex.String())
 	}
 
 	return filters, nil
 }
-
-type executor func(s string, a ...string) error
-
-func exe(s string, a ...string) error {
-	return exec.Command(s, a...).Run()
-}
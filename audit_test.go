@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"io/ioutil"
@@ -25,6 +26,8 @@ func TestLoadConfig(t *testing.T) {
 	config, err := loadConfig(file)
 	assert.Equal(t, 1300, config.Events.Min, "events.min should default to 1300")
 	assert.Equal(t, 1399, config.Events.Max, "events.max should default to 1399")
+	assert.Equal(t, 2*time.Second, config.Events.CompleteAfter, "events.complete_after should default to 2s")
+	assert.Equal(t, "Local", config.Events.Timezone, "events.timezone should default to Local")
 	assert.Equal(t, true, config.MessageTracking.Enabled, "message_tracking.enabled should default to true")
 	assert.Equal(t, false, config.MessageTracking.LogOutOfOrder, "message_tracking.log_out_of_order should default to false")
 	assert.Equal(t, 500, config.MessageTracking.MaxOutOfOrder, "message_tracking.max_out_of_order should default to 500")
@@ -32,7 +35,27 @@ func TestLoadConfig(t *testing.T) {
 	assert.Equal(t, 132, config.Output.Syslog.Priority, "output.syslog.priority should default to 132")
 	assert.Equal(t, "go-audit", config.Output.Syslog.Tag, "output.syslog.tag should default to go-audit")
 	assert.Equal(t, 3, config.Output.Syslog.Attempts, "output.syslog.attempts should default to 3")
+	assert.Equal(t, false, config.Enrichment.Enabled, "enrichment.enabled should default to false")
+	assert.Equal(t, "/proc", config.Enrichment.ProcRoot, "enrichment.proc_root should default to /proc")
+	assert.Equal(t, 4096, config.Enrichment.CacheSize, "enrichment.cache_size should default to 4096")
+	assert.Equal(t, false, config.Enrichment.Ancestry.Enabled, "enrichment.ancestry.enabled should default to false")
+	assert.Equal(t, 8, config.Enrichment.Ancestry.Depth, "enrichment.ancestry.depth should default to 8")
+	assert.Equal(t, 32768, config.Enrichment.Ancestry.MaxProcesses, "enrichment.ancestry.max_processes should default to 32768")
+	assert.Equal(t, false, config.Enrichment.Sessions.Enabled, "enrichment.sessions.enabled should default to false")
+	assert.Equal(t, 4096, config.Enrichment.Sessions.MaxSessions, "enrichment.sessions.max_sessions should default to 4096")
+	assert.Equal(t, 4096, config.Identity.CacheSize, "identity.cache_size should default to 4096")
+	assert.Equal(t, 10*time.Minute, config.Identity.CacheTTL, "identity.cache_ttl should default to 10m")
+	assert.Equal(t, "/var/spool/go-audit", config.Spool.Directory, "spool.directory should default to /var/spool/go-audit")
+	assert.Equal(t, int64(1<<30), config.Spool.MaxSize, "spool.max_size should default to 1GiB")
+	assert.Equal(t, int64(16<<20), config.Spool.SegmentSize, "spool.segment_size should default to 16MiB")
+	assert.Equal(t, 10*time.Second, config.Shutdown.Timeout, "shutdown.timeout should default to 10s")
 	assert.Equal(t, "warn", config.Log.Level, "log.flags should default to 0")
+	assert.Equal(t, "off", config.Parser.Fields, "parser.fields should default to off")
+	assert.Equal(t, 10*time.Second, config.Kernel.StatusInterval, "kernel.status_interval should default to 10s")
+	assert.Equal(t, -1, config.Kernel.BacklogLimit, "kernel.backlog_limit should default to -1")
+	assert.Equal(t, -1, config.Kernel.RateLimit, "kernel.rate_limit should default to -1")
+	assert.Equal(t, -1, config.Kernel.BacklogWaitTime, "kernel.backlog_wait_time should default to -1")
+	assert.Equal(t, "", config.Kernel.Failure, "kernel.failure should default to empty")
 	assert.Nil(t, err)
 
 	// parse error
@@ -45,54 +68,83 @@ func TestLoadConfig(t *testing.T) {
 func TestSetRules(t *testing.T) {
 	defer resetLogger()
 
-	// fail to flush rules
+	// fail on 0 rules
 	config := &Config{}
+	c := &fakeRuleClient{}
+	err := setRules(config, c)
+	assert.EqualError(t, err, "no audit rules found")
+	assert.Equal(t, 0, c.flushed, "Should not flush without rules")
 
-	err := setRules(config, func(s string, a ...string) error {
-		if s == "auditctl" && a[0] == "-D" {
-			return errors.New("testing")
-		}
-
-		return nil
-	})
+	// fail to parse a rule, nothing is touched
+	config.Rules = []string{"-a exit,always -S execve", "-a sometimes"}
+	err = setRules(config, c)
+	assert.EqualError(t, err, "failed to parse rule #2: list and action must be provided as `list,action`, sometimes provided")
+	assert.Equal(t, 0, c.flushed, "Should not flush with broken rules")
 
+	// fail to flush rules
+	config.Rules = []string{"-a exit,always -S execve", "", "-a never,exit -F auid=unset"}
+	c = &fakeRuleClient{err: errors.New("testing")}
+	err = setRules(config, c)
 	assert.EqualError(t, err, "failed to flush existing audit rules: testing")
 
-	// fail on 0 rules
-	err = setRules(config, func(s string, a ...string) error { return nil })
-	assert.EqualError(t, err, "no audit rules found")
-
 	// failure to set rule
-	r := 0
-	config.Rules = []string{"-a -1 -2", "", "-a -3 -4"}
-	err = setRules(config, func(s string, a ...string) error {
-		if a[0] != "-D" {
-			return errors.New("testing rule")
-		}
-
-		r++
-		return nil
-	})
-
-	assert.Equal(t, 1, r, "Wrong number of rule set attempts")
+	c = &fakeRuleClient{addErr: errors.New("testing rule")}
+	err = setRules(config, c)
+	assert.Equal(t, 1, c.flushed)
+	assert.Equal(t, 0, len(c.added), "Wrong number of rule set attempts")
 	assert.EqualError(t, err, "failed to add rule #1: testing rule")
 
 	// properly set rules
-	r = 0
-	err = setRules(config, func(s string, a ...string) error {
-		// Skip the flush rules
-		if a[0] != "-a" {
-			return nil
-		}
+	config.Rules = append(config.Rules, "-e 1")
+	c = &fakeRuleClient{}
+	err = setRules(config, c)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, c.flushed)
+	assert.Equal(t, 2, len(c.added), "Wrong number of correct rule set attempts")
+	assert.Equal(t, uint32(AUDIT_ALWAYS), c.added[0].Action)
+	assert.Equal(t, uint32(AUDIT_NEVER), c.added[1].Action)
+	if assert.Len(t, c.status, 1) {
+		assert.Equal(t, uint32(AUDIT_STATUS_ENABLED), c.status[0].Mask)
+		assert.Equal(t, uint32(1), c.status[0].Enabled)
+	}
+}
 
-		if (a[1] == "-1" && a[2] == "-2") || (a[1] == "-3" && a[2] == "-4") {
-			r++
-		}
-		return nil
-	})
+func TestSetKernelStatus(t *testing.T) {
+	defer resetLogger()
 
-	assert.Equal(t, 2, r, "Wrong number of correct rule set attempts")
-	assert.Nil(t, err)
+	// nothing to set
+	config := defaultConfig()
+	c := &fakeRuleClient{}
+	assert.Nil(t, setKernelStatus(config, c))
+	assert.Len(t, c.status, 0)
+
+	// invalid values
+	config.Kernel.RateLimit = -2
+	assert.EqualError(t, setKernelStatus(config, c), "kernel rate_limit must be at least 0, -2 provided")
+	config.Kernel.RateLimit = -1
+	config.Kernel.Failure = "explode"
+	assert.EqualError(t, setKernelStatus(config, c), "kernel failure must be one of `silent`, `printk` or `panic`, explode provided")
+
+	// set and verify
+	config.Kernel.BacklogLimit = 8192
+	config.Kernel.RateLimit = 0
+	config.Kernel.Failure = "printk"
+	assert.Nil(t, setKernelStatus(config, c))
+	if assert.Len(t, c.status, 1) {
+		assert.Equal(t, &AuditStatusPayload{
+			Mask:         AUDIT_STATUS_BACKLOG_LIMIT | AUDIT_STATUS_RATE_LIMIT | AUDIT_STATUS_FAILURE,
+			BacklogLimit: 8192,
+			Failure:      AUDIT_FAIL_PRINTK,
+		}, c.status[0])
+	}
+
+	// the kernel did not take the value
+	c = &fakeRuleClient{ignoreStatus: true}
+	assert.EqualError(t, setKernelStatus(config, c), "kernel backlog_limit is 0 after setting it to 8192")
+
+	// the kernel refused
+	c = &fakeRuleClient{err: errors.New("operation not permitted")}
+	assert.EqualError(t, setKernelStatus(config, c), "failed to set the kernel audit status: operation not permitted")
 }
 
 func TestCreateFileOutput(t *testing.T) {
@@ -263,9 +315,64 @@ func TestCreateOutput(t *testing.T) {
 	c.Output.File.Group = g.Name
 
 	w, err = createOutput(context.Background(), c)
-	assert.EqualError(t, err, "only one output can be enabled at a time")
+	assert.Nil(t, err)
+	if assert.Len(t, w, 2) {
+		assert.Equal(t, "syslog", w[0].name)
+		assert.IsType(t, &syslog.Writer{}, w[0].w)
+		assert.Equal(t, "file", w[1].name)
+		assert.IsType(t, &os.File{}, w[1].w)
+	}
+
+	// failure policy error
+	c.Output.File.OnFailure = "retry"
+	w, err = createOutput(context.Background(), c)
+	assert.EqualError(t, err, "output on_failure for file must be one of `exit`, `drop`, `block` or `spool`, retry provided")
+	assert.Nil(t, w)
+
+	// spooling outputs get their own spool directory
+	spoolDir := path.Join(os.TempDir(), "go-audit.test.spool")
+	defer os.RemoveAll(spoolDir)
+	c.Output.File.OnFailure = "spool"
+	c.Spool.Directory = spoolDir
+	c.Spool.MaxSize = 1024
+	c.Spool.SegmentSize = 1024
+	ctx, cancel := context.WithCancel(context.Background())
+	w, err = createOutput(ctx, c)
+	cancel()
+	assert.Nil(t, err)
+	if assert.Len(t, w, 2) {
+		assert.Nil(t, w[0].spool)
+		if assert.NotNil(t, w[1].spool) {
+			assert.Equal(t, path.Join(spoolDir, "file"), w[1].spool.dir)
+			w[1].spool.Close()
+		}
+	}
+
+	// spool error
+	c.Spool.SegmentSize = 0
+	w, err = createOutput(context.Background(), c)
+	assert.EqualError(t, err, "spool segment_size must be at least 1 and not bigger than max_size, 0 and 1024 provided")
+	assert.Nil(t, w)
+	c.Spool.SegmentSize = 1024
+
+	// backoff error
+	c.Output.File.OnFailure = "block"
+	c.Output.File.Backoff = 2 * time.Second
+	c.Output.File.BackoffMax = time.Second
+	w, err = createOutput(context.Background(), c)
+	assert.EqualError(t, err, "output backoff_max for file must be at least backoff 2s, 1s provided")
 	assert.Nil(t, w)
 
+	c.Output.File.BackoffMax = time.Minute
+	w, err = createOutput(context.Background(), c)
+	assert.Nil(t, err)
+	if assert.Len(t, w, 2) {
+		assert.Equal(t, FailurePolicyBlock, w[1].onFailure)
+		assert.Equal(t, 2*time.Second, w[1].backoffInitial)
+		assert.Equal(t, time.Minute, w[1].backoffMax)
+		assert.Equal(t, BACKOFF_INITIAL, w[0].backoffInitial)
+	}
+
 	// syslog error
 	c = &Config{}
 	c.Output.Syslog.Enabled = true
@@ -295,10 +402,10 @@ func TestCreateOutput(t *testing.T) {
 	c.Output.Syslog.Attempts = 1
 	c.Output.Syslog.Network = "tcp"
 	c.Output.Syslog.Address = l.Addr().String()
-	w, err = createSyslogOutput(c)
+	sw, err := createSyslogOutput(c)
 	assert.Nil(t, err)
-	assert.NotNil(t, w)
-	assert.IsType(t, &syslog.Writer{}, w.w)
+	assert.NotNil(t, sw)
+	assert.IsType(t, &syslog.Writer{}, sw.w)
 
 	// All good file
 	c = &Config{}
@@ -310,9 +417,11 @@ func TestCreateOutput(t *testing.T) {
 	c.Output.File.Group = g.Name
 	w, err = createOutput(context.Background(), c)
 	assert.Nil(t, err)
-	assert.NotNil(t, w)
-	assert.IsType(t, &AuditWriter{}, w)
-	assert.IsType(t, &os.File{}, w.w)
+	if assert.Len(t, w, 1) {
+		assert.IsType(t, &AuditWriter{}, w[0])
+		assert.IsType(t, &os.File{}, w[0].w)
+		assert.Equal(t, FailurePolicyExit, w[0].onFailure)
+	}
 
 	// File rotation
 	os.Rename(path.Join(os.TempDir(), "go-audit.test.log"), path.Join(os.TempDir(), "go-audit.test.log.rotated"))
@@ -325,7 +434,7 @@ func TestCreateOutput(t *testing.T) {
 }
 
 func BenchmarkMultiPacketMessage(b *testing.B) {
-	marshaller := NewAuditMarshaller(NewAuditWriter(&noopWriter{}, 1), uint16(1300), uint16(1399), false, false, 1, []AuditFilter{})
+	marshaller := NewAuditMarshaller([]*AuditWriter{NewAuditWriter(&noopWriter{}, 1)}, uint16(1300), uint16(1399), false, false, 1, FieldsModeOff, COMPLETE_AFTER, []AuditFilter{})
 
 	data := make([][]byte, 6)
 
@@ -365,6 +474,302 @@ func BenchmarkMultiPacketMessage(b *testing.B) {
 	}
 }
 
+func TestShutdown(t *testing.T) {
+	w := &bytes.Buffer{}
+	fw := &flushWriter{left: 3}
+	writers := []*AuditWriter{NewAuditWriter(w, 1), NewAuditWriter(fw, 1)}
+	m := NewAuditMarshaller(writers, uint16(1300), uint16(1399), false, false, 0, FieldsModeOff, COMPLETE_AFTER, []AuditFilter{})
+	m.Consume(&syscall.NetlinkMessage{
+		Header: syscall.NlMsghdr{Type: uint16(1300)},
+		Data:   []byte("audit(10000001:1): hi there"),
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	loopDone := make(chan struct{})
+	go func() {
+		<-ctx.Done()
+		close(loopDone)
+	}()
+
+	dropped := shutdown(cancel, loopDone, m, writers, time.Second)
+	assert.Equal(t, 3, dropped, "Messages left in the output queue are dropped")
+	assert.Contains(t, w.String(), "\"sequence\":1,", "Pending groups should be written")
+	assert.Equal(t, 1, fw.flushed)
+	assert.True(t, fw.timeout > 0 && fw.timeout <= time.Second, "Flush should get the remaining timeout")
+
+	// An output that blocks on failure gives up on its message once the timeout expired
+	bw := NewAuditWriter(&flakyWriter{failures: 1 << 30}, 1)
+	bw.onFailure = FailurePolicyBlock
+	bw.backoffInitial = time.Millisecond
+	m = NewAuditMarshaller([]*AuditWriter{bw}, uint16(1300), uint16(1399), false, false, 0, FieldsModeOff, COMPLETE_AFTER, []AuditFilter{})
+	m.Consume(&syscall.NetlinkMessage{
+		Header: syscall.NlMsghdr{Type: uint16(1300)},
+		Data:   []byte("audit(10000001:1): hi there"),
+	})
+
+	ctx, cancel = context.WithCancel(context.Background())
+	loopDone = make(chan struct{})
+	go func() {
+		<-ctx.Done()
+		close(loopDone)
+	}()
+
+	done := make(chan struct{})
+	go func() {
+		shutdown(cancel, loopDone, m, []*AuditWriter{bw}, 50*time.Millisecond)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("shutdown waited for the blocked output beyond the timeout")
+	}
+
+	// The loop itself may be stuck writing to a blocked output
+	bw = NewAuditWriter(&flakyWriter{failures: 1 << 30}, 1)
+	bw.onFailure = FailurePolicyBlock
+	bw.backoffInitial = time.Millisecond
+	m = NewAuditMarshaller([]*AuditWriter{bw}, uint16(1300), uint16(1399), false, false, 0, FieldsModeOff, COMPLETE_AFTER, []AuditFilter{})
+
+	ctx, cancel = context.WithCancel(context.Background())
+	loopDone = make(chan struct{})
+	writing := make(chan struct{})
+	go func() {
+		m.Consume(&syscall.NetlinkMessage{
+			Header: syscall.NlMsghdr{Type: uint16(1300)},
+			Data:   []byte("audit(10000001:1): hi there"),
+		})
+		close(writing)
+		m.Consume(&syscall.NetlinkMessage{
+			Header: syscall.NlMsghdr{Type: uint16(1320)},
+			Data:   []byte("audit(10000001:1): "),
+		})
+		<-ctx.Done()
+		close(loopDone)
+	}()
+	<-writing
+
+	done = make(chan struct{})
+	go func() {
+		shutdown(cancel, loopDone, m, []*AuditWriter{bw}, 50*time.Millisecond)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("shutdown waited for the loop stuck on the blocked output beyond the timeout")
+	}
+}
+
+type flushWriter struct {
+	left    int
+	flushed int
+	timeout time.Duration
+}
+
+func (f *flushWriter) Write(p []byte) (int, error) {
+	return len(p), nil
+}
+
+func (f *flushWriter) Flush(timeout time.Duration) int {
+	f.flushed++
+	f.timeout = timeout
+	return f.left
+}
+
+func TestCreateFilters(t *testing.T) {
+	filters, err := createFilters(&Config{})
+	assert.Nil(t, err)
+	assert.Len(t, filters, 0)
+
+	filters, err = createFilters(&Config{Filters: []Filter{
+		{Syscall: "49", MessageType: 1306, Regex: "saddr=10"},
+		{Syscall: "connect", MessageType: 1306, Regex: "saddr=02"},
+	}})
+	assert.Nil(t, err)
+	if assert.Len(t, filters, 2) {
+		assert.Equal(t, "49", filters[0].syscall)
+		assert.Equal(t, "connect", filters[1].syscall)
+		assert.Equal(t, uint16(1306), filters[1].messageType)
+	}
+
+	_, err = createFilters(&Config{Filters: []Filter{{Syscall: "connectx", MessageType: 1306, Regex: "saddr=02"}}})
+	assert.EqualError(t, err, "Filter 1 has an unknown syscall `connectx`")
+
+	_, err = createFilters(&Config{Filters: []Filter{{MessageType: 1306, Regex: "saddr=02"}}})
+	assert.EqualError(t, err, "Filter 1 is missing the `syscall` entry")
+
+	filters, err = createFilters(&Config{Filters: []Filter{{Syscall: "connect", CIDR: "10.0.0.0/8"}}})
+	assert.Nil(t, err)
+	if assert.Len(t, filters, 1) {
+		assert.Equal(t, uint16(1306), filters[0].messageType)
+		assert.Equal(t, "10.0.0.0/8", filters[0].cidr.String())
+		assert.Nil(t, filters[0].regex)
+	}
+
+	_, err = createFilters(&Config{Filters: []Filter{{Syscall: "connect", CIDR: "10.0.0.0"}}})
+	assert.EqualError(t, err, "`cidr` in filter 1 could not be parsed: 10.0.0.0")
+
+	_, err = createFilters(&Config{Filters: []Filter{{Syscall: "connect", CIDR: "10.0.0.0/8", Regex: "saddr=02"}}})
+	assert.EqualError(t, err, "Filter 1 can only have one of the `regex` or `cidr` entries")
+
+	_, err = createFilters(&Config{Filters: []Filter{{Syscall: "connect", MessageType: 1300, CIDR: "10.0.0.0/8"}}})
+	assert.EqualError(t, err, "Filter 1 with a `cidr` entry only applies to message type 1306")
+
+	_, err = createFilters(&Config{Filters: []Filter{{Syscall: "connect", MessageType: 1306}}})
+	assert.EqualError(t, err, "Filter 1 is missing the `regex` or `cidr` entry")
+
+	filters, err = createFilters(&Config{Filters: []Filter{
+		{Syscall: "connect", CIDR: "10.0.0.0/8"},
+		{Expression: `syscall == "connect"`, Action: FilterActionInclude},
+		{Expression: `syscall == "bind"`},
+	}})
+	assert.Nil(t, err)
+	if assert.Len(t, filters, 3) {
+		assert.Equal(t, 2, filters[1].index)
+		assert.Equal(t, `syscall == "connect"`, filters[1].expr.String())
+		assert.True(t, filters[1].include)
+		assert.False(t, filters[2].include, "Filters should exclude by default")
+	}
+
+	_, err = createFilters(&Config{Filters: []Filter{{Expression: `syscall ==`}}})
+	assert.EqualError(t, err, "`expression` in filter 1 could not be parsed: expected a string or a number after == at 10, got end of expression")
+
+	_, err = createFilters(&Config{Filters: []Filter{{Expression: `syscall == "bind"`, Syscall: "bind"}}})
+	assert.EqualError(t, err, "Filter 1 can not combine `expression` with `syscall`, `message_type`, `regex` or `cidr`")
+
+	_, err = createFilters(&Config{Filters: []Filter{{Expression: `syscall == "bind"`, Action: "keep"}}})
+	assert.EqualError(t, err, "Filter 1 action must be one of `include` or `exclude`, keep provided")
+
+	_, err = createFilters(&Config{Filters: []Filter{{Syscall: "bind", CIDR: "10.0.0.0/8", Action: FilterActionInclude}}})
+	assert.EqualError(t, err, "Filter 1 can only have an `action` with an `expression`")
+}
+
+func TestCreateEnrichers(t *testing.T) {
+	config := defaultConfig()
+	enrichers, err := createEnrichers(config)
+	assert.Nil(t, err)
+	assert.Len(t, enrichers, 0)
+
+	config.Enrichment.Enabled = true
+	config.Enrichment.ProcRoot = os.TempDir()
+	enrichers, err = createEnrichers(config)
+	assert.Nil(t, err)
+	if assert.Len(t, enrichers, 1) {
+		assert.IsType(t, &processEnricher{}, enrichers[0])
+	}
+
+	config.Enrichment.CacheSize = 0
+	_, err = createEnrichers(config)
+	assert.EqualError(t, err, "enrichment cache_size must be at least 1, 0 provided")
+
+	config.Enrichment.CacheSize = 1
+	config.Enrichment.ProcRoot = "/does/not/exist"
+	_, err = createEnrichers(config)
+	assert.EqualError(t, err, "enrichment proc_root could not be used: stat /does/not/exist: no such file or directory")
+
+	config = defaultConfig()
+	config.Enrichment.Ancestry.Enabled = true
+	config.Enrichment.ProcRoot = os.TempDir()
+	enrichers, err = createEnrichers(config)
+	assert.Nil(t, err)
+	if assert.Len(t, enrichers, 1) {
+		assert.IsType(t, &processTable{}, enrichers[0])
+	}
+
+	config.Enrichment.Ancestry.Depth = 0
+	_, err = createEnrichers(config)
+	assert.EqualError(t, err, "enrichment ancestry depth must be at least 1, 0 provided")
+
+	config.Enrichment.Ancestry.Depth = 1
+	config.Enrichment.Ancestry.MaxProcesses = 0
+	_, err = createEnrichers(config)
+	assert.EqualError(t, err, "enrichment ancestry max_processes must be at least 1, 0 provided")
+
+	// Sessions don't need procfs
+	config = defaultConfig()
+	config.Enrichment.Sessions.Enabled = true
+	config.Enrichment.ProcRoot = "/does/not/exist"
+	enrichers, err = createEnrichers(config)
+	assert.Nil(t, err)
+	if assert.Len(t, enrichers, 1) {
+		assert.IsType(t, &sessionTracker{}, enrichers[0])
+	}
+
+	config.Enrichment.Sessions.MaxSessions = 0
+	_, err = createEnrichers(config)
+	assert.EqualError(t, err, "enrichment sessions max_sessions must be at least 1, 0 provided")
+}
+
+func TestLostEvents(t *testing.T) {
+	// Losses are reported from the first poll on, even if it saw none
+	l := &lostEvents{}
+	assert.Equal(t, uint32(0), l.update(0))
+	assert.Equal(t, uint32(3), l.update(3))
+	assert.Equal(t, uint32(0), l.update(3))
+	assert.Equal(t, uint32(2), l.update(5))
+
+	// Losses from before go-audit started are not reported
+	l = &lostEvents{}
+	assert.Equal(t, uint32(0), l.update(7))
+	assert.Equal(t, uint32(1), l.update(8))
+}
+
+type fakeRuleClient struct {
+	err          error
+	addErr       error
+	ignoreStatus bool
+	flushed      int
+	added        []*AuditRule
+	deleted      []*AuditRule
+	status       []*AuditStatusPayload
+	closed       int
+}
+
+func (c *fakeRuleClient) AddRule(r *AuditRule) error {
+	if c.addErr != nil {
+		return c.addErr
+	}
+	c.added = append(c.added, r)
+	return nil
+}
+
+func (c *fakeRuleClient) DeleteRule(r *AuditRule) error {
+	c.deleted = append(c.deleted, r)
+	return nil
+}
+
+func (c *fakeRuleClient) DeleteAllRules() error {
+	if c.err != nil {
+		return c.err
+	}
+	c.flushed++
+	return nil
+}
+
+func (c *fakeRuleClient) SetStatus(s *AuditStatusPayload) error {
+	if c.err != nil {
+		return c.err
+	}
+	c.status = append(c.status, s)
+	return nil
+}
+
+func (c *fakeRuleClient) Close() error {
+	c.closed++
+	return nil
+}
+
+func (c *fakeRuleClient) GetStatus() (*AuditStatusPayload, error) {
+	s := &AuditStatusPayload{}
+	if len(c.status) > 0 && !c.ignoreStatus {
+		*s = *c.status[len(c.status)-1]
+	}
+	return s, nil
+}
+
 type noopWriter struct{ t *testing.T }
 
 func (t *noopWriter) Write(a []byte) (int, error) {
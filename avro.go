@@ -0,0 +1,247 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// The Avro schema of the events is derived from AuditMessageGroup so it can't drift from what go-audit writes.
+// Fields follow the json tags of the struct:
+//
+//	string                        string
+//	int, uint and their sizes     long
+//	bool                          boolean
+//	slices                        array, the items of slices of pointers are never null
+//	maps with string keys         map
+//	structs                       record named after the Go type
+//	pointers                      union of null and the pointed to type, default null
+//
+// Every field has a default so the schema stays compatible when fields are added, pointers default to null and the
+// others to their zero value.
+const avroRecordName = "auditlogs"
+
+// avroField is a field of an Avro record
+type avroField struct {
+	Name    string          `json:"name"`
+	Type    interface{}     `json:"type"`
+	Default json.RawMessage `json:"default,omitempty"`
+}
+
+// avroRecord defines an Avro record, later uses of the same record refer to it by its name
+type avroRecord struct {
+	Type   string      `json:"type"`
+	Name   string      `json:"name"`
+	Fields []avroField `json:"fields"`
+}
+
+type avroArray struct {
+	Type  string      `json:"type"`
+	Items interface{} `json:"items"`
+}
+
+type avroMap struct {
+	Type   string      `json:"type"`
+	Values interface{} `json:"values"`
+}
+
+// canonicalAvroSchema returns the Avro schema of the events
+func canonicalAvroSchema() (string, error) {
+	t := reflect.TypeOf(AuditMessageGroup{})
+	fields, err := avroFields(t, map[reflect.Type]bool{t: true})
+	if err != nil {
+		return "", err
+	}
+
+	buf, err := json.Marshal(avroRecord{Type: "record", Name: avroRecordName, Fields: fields})
+	if err != nil {
+		return "", err
+	}
+	return string(buf), nil
+}
+
+func avroFields(t reflect.Type, defined map[reflect.Type]bool) ([]avroField, error) {
+	var fields []avroField
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name, ok := jsonField(f)
+		if !ok {
+			continue
+		}
+
+		typ, err := avroType(f.Type, defined)
+		if err != nil {
+			return nil, fmt.Errorf("%s.%s: %v", t.Name(), f.Name, err)
+		}
+
+		// Avro defaults are the json of the zero value, except for null, empty arrays and empty maps
+		field := avroField{Name: name, Type: typ}
+		switch f.Type.Kind() {
+		case reflect.Ptr:
+			field.Default = json.RawMessage("null")
+		case reflect.Slice:
+			field.Default = json.RawMessage("[]")
+		case reflect.Map:
+			field.Default = json.RawMessage("{}")
+		default:
+			if field.Default, err = json.Marshal(reflect.Zero(f.Type).Interface()); err != nil {
+				return nil, err
+			}
+		}
+		fields = append(fields, field)
+	}
+
+	return fields, nil
+}
+
+func avroType(t reflect.Type, defined map[reflect.Type]bool) (interface{}, error) {
+	switch t.Kind() {
+	case reflect.String:
+		return "string", nil
+
+	case reflect.Bool:
+		return "boolean", nil
+
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint8, reflect.Uint16, reflect.Uint32:
+		return "long", nil
+
+	case reflect.Slice:
+		elem := t.Elem()
+		if elem.Kind() == reflect.Ptr {
+			elem = elem.Elem()
+		}
+		items, err := avroType(elem, defined)
+		if err != nil {
+			return nil, err
+		}
+		return avroArray{Type: "array", Items: items}, nil
+
+	case reflect.Map:
+		if t.Key().Kind() != reflect.String {
+			return nil, fmt.Errorf("map keys must be strings, %s provided", t.Key())
+		}
+		values, err := avroType(t.Elem(), defined)
+		if err != nil {
+			return nil, err
+		}
+		return avroMap{Type: "map", Values: values}, nil
+
+	case reflect.Ptr:
+		elem, err := avroType(t.Elem(), defined)
+		if err != nil {
+			return nil, err
+		}
+		return []interface{}{"null", elem}, nil
+
+	case reflect.Struct:
+		// Named types can only be defined once
+		if defined[t] {
+			return t.Name(), nil
+		}
+		defined[t] = true
+
+		fields, err := avroFields(t, defined)
+		if err != nil {
+			return nil, err
+		}
+		return avroRecord{Type: "record", Name: t.Name(), Fields: fields}, nil
+	}
+
+	return nil, fmt.Errorf("%s can not be encoded in Avro", t)
+}
+
+// avroNative converts a value to the native form of goavro following the schema of its type
+func avroNative(v reflect.Value) interface{} {
+	switch v.Kind() {
+	case reflect.String:
+		return v.String()
+
+	case reflect.Bool:
+		return v.Bool()
+
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int()
+
+	case reflect.Uint8, reflect.Uint16, reflect.Uint32:
+		return int64(v.Uint())
+
+	case reflect.Slice:
+		items := make([]interface{}, v.Len())
+		for i := range items {
+			item := v.Index(i)
+			if item.Kind() == reflect.Ptr {
+				if item.IsNil() {
+					item = reflect.Zero(item.Type().Elem())
+				} else {
+					item = item.Elem()
+				}
+			}
+			items[i] = avroNative(item)
+		}
+		return items
+
+	case reflect.Map:
+		values := make(map[string]interface{}, v.Len())
+		for _, k := range v.MapKeys() {
+			values[k.String()] = avroNative(v.MapIndex(k))
+		}
+		return values
+
+	case reflect.Ptr:
+		if v.IsNil() {
+			return nil
+		}
+		// Union values are wrapped in a map keyed by the name of their type
+		elem := v.Elem()
+		return map[string]interface{}{avroTypeName(elem.Type()): avroNative(elem)}
+
+	case reflect.Struct:
+		t := v.Type()
+		record := make(map[string]interface{}, t.NumField())
+		for i := 0; i < t.NumField(); i++ {
+			if name, ok := jsonField(t.Field(i)); ok {
+				record[name] = avroNative(v.Field(i))
+			}
+		}
+		return record
+	}
+
+	return nil
+}
+
+// The name of a type in a union, the primitive name or the record name
+func avroTypeName(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.String:
+		return "string"
+	case reflect.Bool:
+		return "boolean"
+	case reflect.Slice:
+		return "array"
+	case reflect.Map:
+		return "map"
+	case reflect.Struct:
+		return t.Name()
+	}
+	return "long"
+}
+
+// Returns the json name of an exported struct field, ok is false if the field is not encoded at all
+func jsonField(f reflect.StructField) (name string, ok bool) {
+	if f.PkgPath != "" {
+		return "", false
+	}
+
+	tag := strings.Split(f.Tag.Get("json"), ",")
+	if tag[0] == "-" {
+		return "", false
+	}
+
+	name = tag[0]
+	if name == "" {
+		name = f.Name
+	}
+	return name, true
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCanonicalAvroSchema(t *testing.T) {
+	schema, err := canonicalAvroSchema()
+	assert.Nil(t, err)
+
+	// The shipped schema is a copy, regenerate it with `go-audit schema avro > avro_schema.json`
+	shipped, err := ioutil.ReadFile("avro_schema.json")
+	assert.Nil(t, err)
+	assert.Equal(t, strings.TrimSpace(string(shipped)), schema)
+
+	assert.True(t, strings.HasPrefix(schema, `{"type":"record","name":"auditlogs","fields":[{"name":"sequence","type":"long","default":0},`))
+	assert.Contains(t, schema, `{"name":"messages","type":{"type":"array","items":{"type":"record","name":"AuditMessage","fields":[{"name":"type","type":"long","default":0},{"name":"data","type":"string","default":""},{"name":"fields","type":{"type":"map","values":"string"},"default":{}}]}},"default":[]}`)
+	assert.Contains(t, schema, `{"name":"uid_map","type":{"type":"map","values":"string"},"default":{}}`)
+	assert.Contains(t, schema, `{"name":"sockaddr","type":["null",{"type":"record","name":"Sockaddr","fields":[{"name":"family","type":"string","default":""},{"name":"addr","type":"string","default":""},{"name":"port","type":"long","default":0},`)
+}
+
+func TestAvroType(t *testing.T) {
+	type inner struct {
+		Name string `json:"name"`
+	}
+	type outer struct {
+		First  *inner         `json:"first"`
+		Second []inner        `json:"second"`
+		Skip   string         `json:"-"`
+		Flag   bool           `json:"flag,omitempty"`
+		Counts map[string]int `json:"counts"`
+		hidden string
+	}
+
+	typ, err := avroType(reflect.TypeOf(outer{}), map[reflect.Type]bool{})
+	assert.Nil(t, err)
+
+	// A record is defined once and referred to by its name after that, every field has a default
+	assert.Equal(t, avroRecord{Type: "record", Name: "outer", Fields: []avroField{
+		{Name: "first", Type: []interface{}{"null", avroRecord{Type: "record", Name: "inner", Fields: []avroField{{Name: "name", Type: "string", Default: []byte(`""`)}}}}, Default: []byte("null")},
+		{Name: "second", Type: avroArray{Type: "array", Items: "inner"}, Default: []byte("[]")},
+		{Name: "flag", Type: "boolean", Default: []byte("false")},
+		{Name: "counts", Type: avroMap{Type: "map", Values: "long"}, Default: []byte("{}")},
+	}}, typ)
+
+	type unsupported struct {
+		Ratio float64 `json:"ratio"`
+	}
+	_, err = avroType(reflect.TypeOf(unsupported{}), map[reflect.Type]bool{})
+	assert.EqualError(t, err, "unsupported.Ratio: float64 can not be encoded in Avro")
+
+	_, err = avroType(reflect.TypeOf(map[int]string{}), map[reflect.Type]bool{})
+	assert.EqualError(t, err, "map keys must be strings, int provided")
+}
+
+func TestAvroNative(t *testing.T) {
+	amg := &AuditMessageGroup{
+		Seq:      5,
+		Hostname: "box",
+		UidMap:   map[string]string{"0": "root"},
+		Ancestry: []*Ancestor{{Pid: 1, Exe: "/sbin/init"}},
+		Session:  &Session{ID: "3"},
+	}
+	amg.Msgs = []*AuditMessage{{Type: 1300, Data: "syscall=42"}}
+
+	native := avroNative(reflect.ValueOf(amg).Elem()).(map[string]interface{})
+
+	// Numbers are longs whatever their Go type, nothing goes through float64
+	assert.Equal(t, int64(5), native["sequence"])
+	assert.Equal(t, "box", native["hostname"])
+	assert.Equal(t, []interface{}{map[string]interface{}{"type": int64(1300), "data": "syscall=42", "fields": map[string]interface{}{}}}, native["messages"])
+	assert.Equal(t, map[string]interface{}{"0": "root"}, native["uid_map"])
+	assert.Equal(t, map[string]interface{}{}, native["gid_map"])
+	assert.Equal(t, []interface{}{}, native["argv"])
+
+	// Set pointers are union values keyed by their record, nil ones are null
+	assert.Equal(t, map[string]interface{}{"Session": map[string]interface{}{"id": "3", "start": "", "user": "", "addr": "", "terminal": ""}}, native["session"])
+	assert.Nil(t, native["sockaddr"])
+	assert.Contains(t, native, "sockaddr")
+
+	// Items of slices of pointers are the records themselves
+	assert.Equal(t, []interface{}{map[string]interface{}{"pid": int64(1), "exe": "/sbin/init", "comm": "", "auid": ""}}, native["ancestry"])
+
+	// Fields that are not encoded in json are left out as well
+	assert.NotContains(t, native, "CompleteAfter")
+	assert.NotContains(t, native, "execve")
+	assert.Len(t, native, 18)
+}
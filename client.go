@@ -18,6 +18,28 @@ var Endianness = binary.LittleEndian
 const (
 	// MAX_AUDIT_MESSAGE_LENGTH see http://lxr.free-electrons.com/source/include/uapi/linux/audit.h#L398
 	MAX_AUDIT_MESSAGE_LENGTH = 8970
+
+	AUDIT_GET = 1000 // Get status
+	AUDIT_SET = 1001 // Set status (enable/disable/auditd)
+
+	// Mask bits of AuditStatusPayload, see http://lxr.free-electrons.com/source/include/uapi/linux/audit.h#L318
+	AUDIT_STATUS_ENABLED           = 0x0001
+	AUDIT_STATUS_FAILURE           = 0x0002
+	AUDIT_STATUS_PID               = 0x0004
+	AUDIT_STATUS_RATE_LIMIT        = 0x0008
+	AUDIT_STATUS_BACKLOG_LIMIT     = 0x0010
+	AUDIT_STATUS_BACKLOG_WAIT_TIME = 0x0020
+
+	// Values of AuditStatusPayload.Failure
+	AUDIT_FAIL_SILENT = 0
+	AUDIT_FAIL_PRINTK = 1
+	AUDIT_FAIL_PANIC  = 2
+
+	// How long to wait for the kernel to answer a request
+	REQUEST_TIMEOUT = time.Second * 5
+
+	// How long Receive waits for an event before returning syscall.EAGAIN
+	RECEIVE_TIMEOUT = time.Second
 )
 
 //TODO: this should live in a marshaller
@@ -37,6 +59,12 @@ type AuditStatusPayload struct {
 // NetlinkPacket is an alias to give the header a similar name here
 type NetlinkPacket syscall.NlMsghdr
 
+// StatusClient reads and changes the kernel audit status
+type StatusClient interface {
+	GetStatus() (*AuditStatusPayload, error)
+	SetStatus(s *AuditStatusPayload) error
+}
+
 type NetlinkClient struct {
 	fd      int
 	address syscall.Sockaddr
@@ -46,6 +74,51 @@ type NetlinkClient struct {
 
 // NewNetlinkClient creates a new NetLinkClient and optionally tries to modify the netlink recv buffer
 func NewNetlinkClient(recvSize int) (*NetlinkClient, error) {
+	n, err := newNetlinkSocket(recvSize)
+	if err != nil {
+		return nil, err
+	}
+
+	// Print the current receive buffer size
+	if v, err := syscall.GetsockoptInt(n.fd, syscall.SOL_SOCKET, syscall.SO_RCVBUF); err == nil {
+		logrus.Infof("socket receive buffer size: %d", v)
+	}
+
+	// Wake up Receive regularly so the receiving loop can be stopped
+	tv := syscall.NsecToTimeval(RECEIVE_TIMEOUT.Nanoseconds())
+	if err := syscall.SetsockoptTimeval(n.fd, syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &tv); err != nil {
+		n.Close()
+		return nil, fmt.Errorf("failed to set receive timeout: %v", err)
+	}
+
+	go func() {
+		for {
+			n.KeepConnection()
+			time.Sleep(time.Second * 5)
+		}
+	}()
+
+	return n, nil
+}
+
+// NewNetlinkRuleClient creates a NetlinkClient to manage audit rules.
+// Unlike NewNetlinkClient it does not register itself to receive events and gives up waiting on the kernel after REQUEST_TIMEOUT
+func NewNetlinkRuleClient() (*NetlinkClient, error) {
+	n, err := newNetlinkSocket(0)
+	if err != nil {
+		return nil, err
+	}
+
+	tv := syscall.NsecToTimeval(REQUEST_TIMEOUT.Nanoseconds())
+	if err := syscall.SetsockoptTimeval(n.fd, syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &tv); err != nil {
+		n.Close()
+		return nil, fmt.Errorf("failed to set receive timeout: %v", err)
+	}
+
+	return n, nil
+}
+
+func newNetlinkSocket(recvSize int) (*NetlinkClient, error) {
 	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW, syscall.NETLINK_AUDIT)
 	if err != nil {
 		return nil, fmt.Errorf("Could not create a socket: %s", err)
@@ -65,27 +138,22 @@ func NewNetlinkClient(recvSize int) (*NetlinkClient, error) {
 	// Set the buffer size if we were asked
 	if recvSize > 0 {
 		if err = syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_RCVBUF, recvSize); err != nil {
+			syscall.Close(fd)
 			return nil, fmt.Errorf("failed to set receive buffer size")
 		}
 	}
 
-	// Print the current receive buffer size
-	if v, err := syscall.GetsockoptInt(n.fd, syscall.SOL_SOCKET, syscall.SO_RCVBUF); err == nil {
-		logrus.Infof("socket receive buffer size: %d", v)
-	}
-
-	go func() {
-		for {
-			n.KeepConnection()
-			time.Sleep(time.Second * 5)
-		}
-	}()
-
 	return n, nil
 }
 
-// Send will send a packet and payload to the netlink socket without waiting for a response
-func (n *NetlinkClient) Send(np *NetlinkPacket, a *AuditStatusPayload) error {
+// Close closes the netlink socket
+func (n *NetlinkClient) Close() error {
+	return syscall.Close(n.fd)
+}
+
+// Send will send a packet and payload to the netlink socket without waiting for a response.
+// The payload is either a struct like AuditStatusPayload, already encoded bytes or nil
+func (n *NetlinkClient) Send(np *NetlinkPacket, a interface{}) error {
 	//We need to get the length first. This is a bit wasteful, but requests are rare so yolo..
 	buf := new(bytes.Buffer)
 	var length int
@@ -95,7 +163,9 @@ func (n *NetlinkClient) Send(np *NetlinkPacket, a *AuditStatusPayload) error {
 	for {
 		buf.Reset()
 		binary.Write(buf, Endianness, np)
-		binary.Write(buf, Endianness, a)
+		if a != nil {
+			binary.Write(buf, Endianness, a)
+		}
 		if np.Len == 0 {
 			length = len(buf.Bytes())
 			np.Len = uint32(length)
@@ -139,14 +209,14 @@ func (n *NetlinkClient) Receive() (*syscall.NetlinkMessage, error) {
 // KeepConnection re-establishes our connection to the netlink socket
 func (n *NetlinkClient) KeepConnection() {
 	payload := &AuditStatusPayload{
-		Mask:    4,
+		Mask:    AUDIT_STATUS_PID,
 		Enabled: 1,
 		Pid:     uint32(syscall.Getpid()),
 		//TODO: Failure: http://lxr.free-electrons.com/source/include/uapi/linux/audit.h#L338
 	}
 
 	packet := &NetlinkPacket{
-		Type:  uint16(1001),
+		Type:  uint16(AUDIT_SET),
 		Flags: syscall.NLM_F_REQUEST | syscall.NLM_F_ACK,
 		Pid:   uint32(syscall.Getpid()),
 	}
@@ -156,3 +226,145 @@ func (n *NetlinkClient) KeepConnection() {
 		logrus.WithError(err).Error("error occurred while trying to keep the connection")
 	}
 }
+
+// AddRule adds an audit rule to the kernel
+func (n *NetlinkClient) AddRule(r *AuditRule) error {
+	return n.request(AUDIT_ADD_RULE, r.toWireFormat())
+}
+
+// DeleteRule deletes an audit rule from the kernel, the rule has to match an existing one exactly
+func (n *NetlinkClient) DeleteRule(r *AuditRule) error {
+	return n.request(AUDIT_DEL_RULE, r.toWireFormat())
+}
+
+// DeleteAllRules lists all audit rules in the kernel and deletes them one by one
+func (n *NetlinkClient) DeleteAllRules() error {
+	packet := &NetlinkPacket{
+		Type:  uint16(AUDIT_LIST_RULES),
+		Flags: syscall.NLM_F_REQUEST,
+		Pid:   uint32(syscall.Getpid()),
+	}
+
+	if err := n.Send(packet, nil); err != nil {
+		return err
+	}
+
+	rules, err := n.receiveReplies(packet.Seq, false)
+	if err != nil {
+		return fmt.Errorf("failed to list rules: %v", err)
+	}
+
+	// The listed rules are in the same format as the one needed to delete them
+	for _, rule := range rules {
+		if err := n.request(AUDIT_DEL_RULE, rule); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// GetStatus asks the kernel for its current audit status
+func (n *NetlinkClient) GetStatus() (*AuditStatusPayload, error) {
+	// The kernel replies from a separate thread, an ack could arrive before the status so we don't ask for one
+	packet := &NetlinkPacket{
+		Type:  uint16(AUDIT_GET),
+		Flags: syscall.NLM_F_REQUEST,
+		Pid:   uint32(syscall.Getpid()),
+	}
+
+	if err := n.Send(packet, nil); err != nil {
+		return nil, err
+	}
+
+	replies, err := n.receiveReplies(packet.Seq, true)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(replies) == 0 {
+		return nil, errors.New("kernel did not reply with a status")
+	}
+
+	return parseAuditStatus(replies[0]), nil
+}
+
+// parseAuditStatus decodes an `audit_status` struct. Older kernels send fewer fields and newer ones more,
+// missing fields are left as 0 and unknown ones are ignored
+func parseAuditStatus(data []byte) *AuditStatusPayload {
+	buf := make([]byte, binary.Size(AuditStatusPayload{}))
+	copy(buf, data)
+
+	s := &AuditStatusPayload{}
+	binary.Read(bytes.NewReader(buf), Endianness, s)
+	return s
+}
+
+// SetStatus changes the kernel audit status, only the values selected by the mask are applied
+func (n *NetlinkClient) SetStatus(s *AuditStatusPayload) error {
+	return n.request(AUDIT_SET, s)
+}
+
+// request sends a message and waits for the kernel to acknowledge it
+func (n *NetlinkClient) request(mtype uint16, payload interface{}) error {
+	packet := &NetlinkPacket{
+		Type:  mtype,
+		Flags: syscall.NLM_F_REQUEST | syscall.NLM_F_ACK,
+		Pid:   uint32(syscall.Getpid()),
+	}
+
+	if err := n.Send(packet, payload); err != nil {
+		return err
+	}
+
+	_, err := n.receiveReplies(packet.Seq, false)
+	return err
+}
+
+// receiveReplies reads the replies to the request with the given sequence until it is acknowledged or done,
+// or the first reply if single is set. The payloads of all replies that are not netlink control messages are returned
+func (n *NetlinkClient) receiveReplies(seq uint32, single bool) ([][]byte, error) {
+	var replies [][]byte
+
+	for {
+		nlen, _, err := syscall.Recvfrom(n.fd, n.buf, 0)
+		if err != nil {
+			if err == syscall.EAGAIN || err == syscall.EWOULDBLOCK {
+				return nil, errors.New("timed out waiting for the kernel to reply")
+			}
+			return nil, err
+		}
+
+		msgs, err := syscall.ParseNetlinkMessage(n.buf[:nlen])
+		if err != nil {
+			return nil, err
+		}
+
+		for _, msg := range msgs {
+			// Skip anything that is not a reply to our request
+			if msg.Header.Seq != seq {
+				continue
+			}
+
+			switch msg.Header.Type {
+			case syscall.NLMSG_DONE:
+				return replies, nil
+			case syscall.NLMSG_ERROR:
+				if len(msg.Data) < 4 {
+					return nil, errors.New("got a truncated netlink error")
+				}
+				if errno := int32(Endianness.Uint32(msg.Data[0:4])); errno != 0 {
+					return nil, syscall.Errno(-errno)
+				}
+				return replies, nil
+			default:
+				reply := make([]byte, len(msg.Data))
+				copy(reply, msg.Data)
+				replies = append(replies, reply)
+				if single {
+					return replies, nil
+				}
+			}
+		}
+	}
+}
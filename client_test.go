@@ -102,8 +102,8 @@ func TestNewNetlinkClient(t *testing.T) {
 		assert.Equal(t, uint32(0), n.seq, "Seq should start at 0")
 		assert.True(t, MAX_AUDIT_MESSAGE_LENGTH >= len(n.buf), "Client buffer is too small")
 
-		assert.Equal(t, "Socket receive buffer size: ", lb.String()[:28], "Expected some nice log lines")
-		assert.Equal(t, "", elb.String(), "Did not expect any error messages")
+		assert.Contains(t, lb.String(), "socket receive buffer size: ", "Expected some nice log lines")
+		assert.NotContains(t, lb.String(), "level=error", "Did not expect any error messages")
 	}
 }
 
@@ -151,3 +151,33 @@ func hookLogger() *bytes.Buffer {
 	logrus.SetOutput(lb)
 	return lb
 }
+
+func TestParseAuditStatus(t *testing.T) {
+	data := make([]byte, 40)
+	for i := 0; i < 10; i++ {
+		binary.LittleEndian.PutUint32(data[i*4:], uint32(i+1))
+	}
+
+	s := parseAuditStatus(data)
+	assert.Equal(t, &AuditStatusPayload{
+		Mask:            1,
+		Enabled:         2,
+		Failure:         3,
+		Pid:             4,
+		RateLimit:       5,
+		BacklogLimit:    6,
+		Lost:            7,
+		Backlog:         8,
+		Version:         9,
+		BacklogWaitTime: 10,
+	}, s)
+
+	// Older kernels don't send the last fields
+	s = parseAuditStatus(data[:32])
+	assert.Equal(t, uint32(8), s.Backlog)
+	assert.Equal(t, uint32(0), s.Version)
+
+	// Newer kernels send more than we know about
+	s = parseAuditStatus(append(data, 1, 2, 3, 4))
+	assert.Equal(t, uint32(10), s.BacklogWaitTime)
+}
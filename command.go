@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+)
+
+// A command runs instead of the daemon, `go-audit <command> <subcommand> [flags]`
+type command func(args []string, stdin io.Reader, stdout io.Writer) error
+
+var commands = map[string]command{
+	"filter test": filterTestCommand,
+	"schema avro": schemaAvroCommand,
+}
+
+// Runs the command named by the first two arguments, returns false if they don't name one
+func runCommand(args []string, stdin io.Reader, stdout io.Writer) (bool, error) {
+	if len(args) < 2 {
+		return false, nil
+	}
+
+	cmd, ok := commands[args[0]+" "+args[1]]
+	if !ok {
+		return false, nil
+	}
+
+	return true, cmd(args[2:], stdin, stdout)
+}
+
+// Reads events as go-audit writes them, a json object per line, and tells which ones the filters keep.
+// The events need their raw `data`, parser.fields must be off or alongside when they are written
+func filterTestCommand(args []string, stdin io.Reader, stdout io.Writer) error {
+	flags := flag.NewFlagSet("filter test", flag.ContinueOnError)
+	configFile := flags.String("config", "", "Config file with the filters to test")
+	expression := flags.String("expression", "", "Expression of a single exclude filter to test instead of a config file")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	var config *Config
+	switch {
+	case *expression != "":
+		config = defaultConfig()
+		config.Filters = []Filter{{Expression: *expression}}
+	case *configFile != "":
+		var err error
+		if config, err = loadConfig(*configFile); err != nil {
+			return fmt.Errorf("failed to load configuration: %v", err)
+		}
+	default:
+		return errors.New("a config file or an expression must be provided")
+	}
+
+	filters, err := createFilters(config)
+	if err != nil {
+		return fmt.Errorf("failed to create filters: %v", err)
+	}
+	m := NewAuditMarshaller(nil, uint16(config.Events.Min), uint16(config.Events.Max), false, false, 0, FieldsModeOff, COMPLETE_AFTER, filters)
+
+	kept, dropped := 0, 0
+	s := bufio.NewScanner(stdin)
+	s.Buffer(make([]byte, 64*1024), 16<<20)
+	for line := 1; s.Scan(); line++ {
+		if len(s.Bytes()) == 0 {
+			continue
+		}
+
+		var event struct {
+			Seq  int             `json:"sequence"`
+			Msgs []*AuditMessage `json:"messages"`
+		}
+		if err := json.Unmarshal(s.Bytes(), &event); err != nil {
+			return fmt.Errorf("line %d is not an event: %v", line, err)
+		}
+
+		amg := &AuditMessageGroup{
+			Seq:    event.Seq,
+			UidMap: make(map[string]string),
+			GidMap: make(map[string]string),
+		}
+		for _, am := range event.Msgs {
+			if am.Data == "" {
+				return fmt.Errorf("line %d has no raw data, parser.fields must be off or alongside", line)
+			}
+			amg.AddMessage(am)
+		}
+
+		drop, reason := m.dropMessage(amg), ""
+		if f := matchExprFilters(m.exprFilters, amg); f != nil {
+			reason = fmt.Sprintf(" by filter %d", f.index)
+		} else if drop {
+			reason = " by a syscall filter"
+		}
+
+		if drop {
+			dropped++
+			fmt.Fprintf(stdout, "%d: dropped%s\n", event.Seq, reason)
+		} else {
+			kept++
+			fmt.Fprintf(stdout, "%d: kept%s\n", event.Seq, reason)
+		}
+	}
+	if err := s.Err(); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(stdout, "%d events, %d kept, %d dropped\n", kept+dropped, kept, dropped)
+	return nil
+}
+
+// Prints the Avro schema of the events, the one the avro encoder registers unless it is given a schema_file
+func schemaAvroCommand(args []string, stdin io.Reader, stdout io.Writer) error {
+	flags := flag.NewFlagSet("schema avro", flag.ContinueOnError)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	schema, err := canonicalAvroSchema()
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintln(stdout, schema)
+	return err
+}
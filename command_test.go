@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const filterTestEvents = `{"sequence":1,"timestamp":10000001000,"messages":[{"type":1300,"data":"arch=c000003e syscall=42 success=yes comm=\"curl\""},{"type":1306,"data":"saddr=02000035080808080000000000000000"}],"uid_map":{}}
+{"sequence":2,"timestamp":10000001000,"messages":[{"type":1300,"data":"arch=c000003e syscall=42 success=yes comm=\"curl\""},{"type":1306,"data":"saddr=020001BB0A0102030000000000000000"}],"uid_map":{}}
+
+{"sequence":3,"timestamp":10000001000,"messages":[{"type":1300,"data":"arch=c000003e syscall=59 success=yes comm=\"ls\""},{"type":1309,"data":"argc=1 a0=\"ls\""}],"uid_map":{}}
+`
+
+func TestRunCommand(t *testing.T) {
+	ok, err := runCommand([]string{"-config", "go-audit.yaml"}, nil, nil)
+	assert.False(t, ok)
+	assert.Nil(t, err)
+
+	ok, err = runCommand([]string{"filter"}, nil, nil)
+	assert.False(t, ok)
+	assert.Nil(t, err)
+
+	out := &bytes.Buffer{}
+	ok, err = runCommand([]string{"filter", "test", "-expression", `saddr.port == 53`}, strings.NewReader(filterTestEvents), out)
+	assert.True(t, ok)
+	assert.Nil(t, err)
+	assert.Equal(t, "1: dropped by filter 1\n2: kept\n3: kept\n3 events, 2 kept, 1 dropped\n", out.String())
+}
+
+func TestFilterTestCommand(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	config := filepath.Join(dir, "go-audit.yaml")
+	writeConfig(t, config, `
+filters:
+  - expression: saddr.addr in "10.0.0.0/8"
+    action: include
+  - expression: syscall == "connect"
+  - syscall: execve
+    message_type: 1309
+    regex: ls
+`)
+
+	out := &bytes.Buffer{}
+	assert.Nil(t, filterTestCommand([]string{"-config", config}, strings.NewReader(filterTestEvents), out))
+	assert.Equal(t, "1: dropped by filter 2\n2: kept by filter 1\n3: dropped by a syscall filter\n3 events, 1 kept, 2 dropped\n", out.String())
+
+	err := filterTestCommand(nil, strings.NewReader(""), out)
+	assert.EqualError(t, err, "a config file or an expression must be provided")
+
+	err = filterTestCommand([]string{"-expression", "syscall =="}, strings.NewReader(""), out)
+	assert.EqualError(t, err, "failed to create filters: `expression` in filter 1 could not be parsed: expected a string or a number after == at 10, got end of expression")
+
+	err = filterTestCommand([]string{"-expression", "true"}, strings.NewReader("{\"sequence\":1}\nnope\n"), out)
+	assert.EqualError(t, err, "line 2 is not an event: invalid character 'o' in literal null (expecting 'u')")
+
+	err = filterTestCommand([]string{"-expression", "true"}, strings.NewReader(`{"sequence":1,"messages":[{"type":1300,"fields":{"syscall":"42"}}]}`), out)
+	assert.EqualError(t, err, "line 1 has no raw data, parser.fields must be off or alongside")
+}
+
+func TestSchemaAvroCommand(t *testing.T) {
+	out := &bytes.Buffer{}
+	ok, err := runCommand([]string{"schema", "avro"}, nil, out)
+	assert.True(t, ok)
+	assert.Nil(t, err)
+
+	schema, err := canonicalAvroSchema()
+	assert.Nil(t, err)
+	assert.Equal(t, schema+"\n", out.String())
+
+	_, err = runCommand([]string{"schema", "avro", "-unknown"}, nil, &bytes.Buffer{})
+	assert.NotNil(t, err)
+}
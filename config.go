@@ -3,6 +3,7 @@ package main
 import (
 	"io/ioutil"
 	"log/syslog"
+	"time"
 
 	yaml "gopkg.in/yaml.v2"
 )
@@ -14,8 +15,10 @@ type Config struct {
 	} `yaml:"socker_buffer"`
 
 	Events struct {
-		Min int `yaml:"min"`
-		Max int `yaml:"max"`
+		Min           int           `yaml:"min"`
+		Max           int           `yaml:"max"`
+		CompleteAfter time.Duration `yaml:"complete_after"`
+		Timezone      string        `yaml:"timezone"`
 	} `yaml:"events"`
 
 	MessageTracking struct {
@@ -26,33 +29,75 @@ type Config struct {
 
 	MetricsAddress string `yaml:"metrics_address"`
 
+	Kernel struct {
+		StatusInterval  time.Duration `yaml:"status_interval"`
+		BacklogLimit    int           `yaml:"backlog_limit"`
+		RateLimit       int           `yaml:"rate_limit"`
+		BacklogWaitTime int           `yaml:"backlog_wait_time"`
+		Failure         string        `yaml:"failure"`
+	} `yaml:"kernel"`
+
+	Parser struct {
+		Fields string `yaml:"fields"`
+	} `yaml:"parser"`
+
 	Output struct {
 		Stdout struct {
-			Enabled  bool `yaml:"enabled"`
-			Attempts int  `yaml:"attempts"`
+			OutputConfig `yaml:",inline"`
 		} `yaml:"stdout"`
 
 		Syslog struct {
-			Enabled  bool   `yaml:"enabled"`
-			Attempts int    `yaml:"attempts"`
-			Network  string `yaml:"network"`
-			Address  string `yaml:"address"`
-			Priority int    `yaml:"priority"`
-			Tag      string `yaml:"tag"`
+			OutputConfig `yaml:",inline"`
+			Network      string `yaml:"network"`
+			Address      string `yaml:"address"`
+			Priority     int    `yaml:"priority"`
+			Tag          string `yaml:"tag"`
 		} `yaml:"syslog"`
 
 		File struct {
-			Enabled  bool   `yaml:"enabled"`
-			Attempts int    `yaml:"attempts"`
-			Path     string `yaml:"path"`
-			Mode     int    `yaml:"mode"`
-			User     string `yaml:"user"`
-			Group    string `yaml:"group"`
+			OutputConfig `yaml:",inline"`
+			Path         string `yaml:"path"`
+			Mode         int    `yaml:"mode"`
+			User         string `yaml:"user"`
+			Group        string `yaml:"group"`
 		} `yaml:"file"`
 
 		Kafka KafkaConfig `yaml:"kafka"`
 	} `yaml:"output"`
 
+	Enrichment struct {
+		Enabled           bool   `yaml:"enabled"`
+		ProcRoot          string `yaml:"proc_root"`
+		ContainerMetadata string `yaml:"container_metadata"`
+		CacheSize         int    `yaml:"cache_size"`
+
+		Ancestry struct {
+			Enabled      bool `yaml:"enabled"`
+			Depth        int  `yaml:"depth"`
+			MaxProcesses int  `yaml:"max_processes"`
+		} `yaml:"ancestry"`
+
+		Sessions struct {
+			Enabled     bool `yaml:"enabled"`
+			MaxSessions int  `yaml:"max_sessions"`
+		} `yaml:"sessions"`
+	} `yaml:"enrichment"`
+
+	Identity struct {
+		CacheSize int           `yaml:"cache_size"`
+		CacheTTL  time.Duration `yaml:"cache_ttl"`
+	} `yaml:"identity"`
+
+	Spool struct {
+		Directory   string `yaml:"directory"`
+		MaxSize     int64  `yaml:"max_size"`
+		SegmentSize int64  `yaml:"segment_size"`
+	} `yaml:"spool"`
+
+	Shutdown struct {
+		Timeout time.Duration `yaml:"timeout"`
+	} `yaml:"shutdown"`
+
 	Log struct {
 		Level string `yaml:"level"`
 	} `yaml:"log"`
@@ -60,13 +105,37 @@ type Config struct {
 	Rules []string `yaml:"rules"`
 
 	Filters []Filter `yaml:"filters"`
+
+	Sampling []SamplingRule `yaml:"sampling"`
 }
 
-// Filter specifies syscalls to ignore.
+// OutputConfig defines the settings shared by every output.
+type OutputConfig struct {
+	Enabled    bool          `yaml:"enabled"`
+	Attempts   int           `yaml:"attempts"`
+	OnFailure  string        `yaml:"on_failure"`
+	Backoff    time.Duration `yaml:"backoff"`
+	BackoffMax time.Duration `yaml:"backoff_max"`
+}
+
+// Filter specifies syscalls to ignore, or events to include or exclude with an expression.
 type Filter struct {
-	Syscall     int    `yaml:"syscall"`
+	Syscall     string `yaml:"syscall"` // A syscall name or number
 	MessageType int    `yaml:"message_type"`
 	Regex       string `yaml:"regex"`
+	CIDR        string `yaml:"cidr"`       // Matches the decoded address of SOCKADDR records instead of a regex
+	Expression  string `yaml:"expression"` // Replaces all of the above, see filterExpr
+	Action      string `yaml:"action"`     // What to do with events matching the expression, include or exclude
+}
+
+// SamplingRule keeps a share of the events matching its expression.
+type SamplingRule struct {
+	Name       string  `yaml:"name"`
+	Expression string  `yaml:"expression"` // Every event if empty, see filterExpr
+	Rate       int     `yaml:"rate"`       // Keeps 1 in every rate events
+	Limit      float64 `yaml:"limit"`      // Keeps up to limit events per second instead
+	Key        string  `yaml:"key"`        // The field to limit every value of on its own
+	Burst      int     `yaml:"burst"`
 }
 
 func loadConfig(filename string) (*Config, error) {
@@ -85,13 +154,33 @@ func defaultConfig() *Config {
 	config := new(Config)
 	config.Events.Min = 1300
 	config.Events.Max = 1399
+	config.Events.CompleteAfter = COMPLETE_AFTER
+	config.Events.Timezone = "Local"
 	config.MessageTracking.Enabled = true
 	config.MessageTracking.LogOutOfOrder = false
 	config.MessageTracking.MaxOutOfOrder = 500
+	config.Parser.Fields = FieldsModeOff
+	config.Kernel.StatusInterval = 10 * time.Second
+	config.Kernel.BacklogLimit = -1
+	config.Kernel.RateLimit = -1
+	config.Kernel.BacklogWaitTime = -1
 	config.Output.Syslog.Enabled = false
 	config.Output.Syslog.Attempts = 3
 	config.Output.Syslog.Priority = int(syslog.LOG_LOCAL0 | syslog.LOG_WARNING)
 	config.Output.Syslog.Tag = "go-audit"
+	config.Output.Kafka.Redeliveries = KAFKA_REDELIVERIES
+	config.Output.Kafka.Encoder.SchemaCacheFile = "/var/lib/go-audit/avro-schema-id.json"
+	config.Enrichment.ProcRoot = "/proc"
+	config.Enrichment.CacheSize = ENRICHMENT_CACHE_SIZE
+	config.Enrichment.Ancestry.Depth = ANCESTRY_DEPTH
+	config.Enrichment.Ancestry.MaxProcesses = ANCESTRY_MAX_PROCESSES
+	config.Enrichment.Sessions.MaxSessions = SESSIONS_MAX
+	config.Identity.CacheSize = IDENTITY_CACHE_SIZE
+	config.Identity.CacheTTL = IDENTITY_CACHE_TTL
+	config.Spool.Directory = "/var/spool/go-audit"
+	config.Spool.MaxSize = 1 << 30
+	config.Spool.SegmentSize = 16 << 20
+	config.Shutdown.Timeout = 10 * time.Second
 	config.Log.Level = "warn"
 	return config
 }
@@ -2,14 +2,24 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/binary"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync/atomic"
 	"time"
 
 	"github.com/karrick/goavro"
+	"github.com/sirupsen/logrus"
 )
 
 // Defines pissible encoders.
@@ -22,28 +32,66 @@ const (
 type EncoderConfig struct {
 	Type              string `yaml:"type"`
 	SchemaFile        string `yaml:"schema_file"`
+	SchemaCacheFile   string `yaml:"schema_cache_file"`
 	SchemaRegistryURL string `yaml:"schema_registry_url"`
 	Topic             string `yaml:"topic"`
+
+	// Authentication of the schema registry, basic auth or a bearer token, and TLS client certificates
+	SchemaRegistryUsername string `yaml:"schema_registry_username"`
+	SchemaRegistryPassword string `yaml:"schema_registry_password"`
+	SchemaRegistryToken    string `yaml:"schema_registry_token"`
+	SchemaRegistryCAFile   string `yaml:"schema_registry_ca_file"`
+	SchemaRegistryCertFile string `yaml:"schema_registry_cert_file"`
+	SchemaRegistryKeyFile  string `yaml:"schema_registry_key_file"`
 }
 
 // NewEncoder creates new Kafka Encoder.
-func NewEncoder(cfg EncoderConfig) (Encoder, error) {
+func NewEncoder(ctx context.Context, cfg EncoderConfig) (Encoder, error) {
 	switch cfg.Type {
 	case JSONEncoderType:
 		return &jsonEncoder{}, nil
 	case AvroEncoderType:
-		schema, id, err := avroSchema(cfg)
+		// The canonical schema matches what is encoded, a schema file has to be compatible with it
+		schema, err := canonicalAvroSchema()
 		if err != nil {
-			return nil, err
+			return nil, fmt.Errorf("failed to create Avro schema: %v", err)
+		}
+		if cfg.SchemaFile != "" {
+			data, err := ioutil.ReadFile(cfg.SchemaFile)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read Avro schema: %v", err)
+			}
+			schema = string(data)
 		}
+
 		codec, err := goavro.NewCodec(schema)
 		if err != nil {
 			return nil, fmt.Errorf("failed to create Avro codec: %v", err)
 		}
-		return &avroEncoder{
-			codec:    codec,
-			schemaID: id,
-		}, nil
+
+		registry, err := newSchemaRegistry(cfg)
+		if err != nil {
+			return nil, err
+		}
+
+		enc := &avroEncoder{codec: codec}
+
+		// A cached id lets go-audit start while the registry is down, the schema is registered in the background
+		if id, ok := registry.cachedID(schema); ok {
+			enc.setSchemaID(id)
+			go enc.register(ctx, registry, schema)
+			return enc, nil
+		}
+
+		id, err := registry.register(ctx, schema)
+		if err != nil {
+			return nil, err
+		}
+		enc.setSchemaID(id)
+		if err := registry.cacheID(schema, id); err != nil {
+			logrus.WithError(err).Warn("failed to cache the Avro schema id")
+		}
+		return enc, nil
 	}
 
 	return nil, fmt.Errorf("encoder is not supported: %s", cfg.Type)
@@ -51,63 +99,169 @@ func NewEncoder(cfg EncoderConfig) (Encoder, error) {
 
 type avroEncoder struct {
 	codec    *goavro.Codec
-	schemaID int
+	schemaID int32 // Accessed atomically, the background registration may change it
+}
+
+// groupEncoder is implemented by encoders that encode a message group from its struct rather than its json
+type groupEncoder interface {
+	EncodeGroup(msg *AuditMessageGroup) ([]byte, error)
 }
 
 func (a *avroEncoder) Encode(data []byte) ([]byte, error) {
-	m := make(map[string]interface{})
-	if err := json.Unmarshal(data, &m); err != nil {
+	msg, err := decodeMessageGroup(data)
+	if err != nil {
 		return nil, err
 	}
-	value, err := a.codec.BinaryFromNative(nil, m)
+	return a.EncodeGroup(msg)
+}
+
+// EncodeGroup encodes a message group in the Confluent wire format, the schema id followed by the Avro value
+func (a *avroEncoder) EncodeGroup(msg *AuditMessageGroup) ([]byte, error) {
+	value, err := a.codec.BinaryFromNative(nil, avroNative(reflect.ValueOf(msg).Elem()))
 	if err != nil {
 		return nil, err
 	}
 
 	buf := bytes.NewBuffer([]byte{})
 	binary.Write(buf, binary.BigEndian, int8(0))
-	binary.Write(buf, binary.BigEndian, int32(a.schemaID))
+	binary.Write(buf, binary.BigEndian, atomic.LoadInt32(&a.schemaID))
 	binary.Write(buf, binary.BigEndian, value)
 
 	return buf.Bytes(), nil
 }
 
+// SchemaID returns the id of the schema registered for the encoded messages
+func (a *avroEncoder) SchemaID() int {
+	return int(atomic.LoadInt32(&a.schemaID))
+}
+
+func (a *avroEncoder) setSchemaID(id int) {
+	atomic.StoreInt32(&a.schemaID, int32(id))
+}
+
+// Registers the schema until it succeeds or the context is done, failures are retried with an exponential backoff
+func (a *avroEncoder) register(ctx context.Context, r *schemaRegistry, schema string) {
+	wait := BACKOFF_INITIAL
+	for {
+		id, err := r.register(ctx, schema)
+		if err == nil {
+			if old := a.SchemaID(); old != id {
+				logrus.Warnf("Avro schema id changed from the cached %d to %d", old, id)
+				a.setSchemaID(id)
+			}
+			if err := r.cacheID(schema, id); err != nil {
+				logrus.WithError(err).Warn("failed to cache the Avro schema id")
+			}
+			return
+		}
+
+		logrus.WithError(err).Warnf("failed to register the Avro schema, using the cached id and retrying in %v", wait)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+
+		if wait *= 2; wait > BACKOFF_MAX {
+			wait = BACKOFF_MAX
+		}
+	}
+}
+
 type jsonEncoder struct{}
 
 func (*jsonEncoder) Encode(data []byte) ([]byte, error) {
 	return data, nil
 }
 
-func avroSchema(cfg EncoderConfig) (string, int, error) {
-	data, err := ioutil.ReadFile(cfg.SchemaFile)
-	if err != nil {
-		return "", -1, fmt.Errorf("failed to read Avro schema: %v", err)
-	}
-	httpClient := http.Client{
-		Transport: http.DefaultTransport,
-		Timeout:   1 * time.Minute,
+// schemaRegistry registers schemas for the value subject of a topic in a Confluent schema registry
+type schemaRegistry struct {
+	url       string
+	subject   string
+	client    *http.Client
+	username  string
+	password  string
+	token     string
+	cacheFile string // Empty if ids are not cached
+}
+
+func newSchemaRegistry(cfg EncoderConfig) (*schemaRegistry, error) {
+	if cfg.SchemaRegistryToken != "" && cfg.SchemaRegistryUsername != "" {
+		return nil, fmt.Errorf("schema registry can only have one of a token or a username")
 	}
 
-	var schema struct {
-		Schema string `json:"schema"`
+	transport := http.DefaultTransport
+	if cfg.SchemaRegistryCAFile != "" || cfg.SchemaRegistryCertFile != "" || cfg.SchemaRegistryKeyFile != "" {
+		tlsConfig := &tls.Config{}
+
+		if cfg.SchemaRegistryCAFile != "" {
+			ca, err := ioutil.ReadFile(cfg.SchemaRegistryCAFile)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read the schema registry CA: %v", err)
+			}
+			tlsConfig.RootCAs = x509.NewCertPool()
+			if !tlsConfig.RootCAs.AppendCertsFromPEM(ca) {
+				return nil, fmt.Errorf("schema registry CA %s has no PEM certificates", cfg.SchemaRegistryCAFile)
+			}
+		}
+
+		if cfg.SchemaRegistryCertFile != "" || cfg.SchemaRegistryKeyFile != "" {
+			cert, err := tls.LoadX509KeyPair(cfg.SchemaRegistryCertFile, cfg.SchemaRegistryKeyFile)
+			if err != nil {
+				return nil, fmt.Errorf("failed to load the schema registry client certificate: %v", err)
+			}
+			tlsConfig.Certificates = []tls.Certificate{cert}
+		}
+
+		transport = &http.Transport{
+			Proxy:               http.ProxyFromEnvironment,
+			TLSClientConfig:     tlsConfig,
+			TLSHandshakeTimeout: 10 * time.Second,
+		}
 	}
-	schema.Schema = string(data)
 
-	body, err := json.Marshal(schema)
+	return &schemaRegistry{
+		url:     cfg.SchemaRegistryURL,
+		subject: cfg.Topic + "-value",
+		client: &http.Client{
+			Transport: transport,
+			Timeout:   1 * time.Minute,
+		},
+		username:  cfg.SchemaRegistryUsername,
+		password:  cfg.SchemaRegistryPassword,
+		token:     cfg.SchemaRegistryToken,
+		cacheFile: cfg.SchemaCacheFile,
+	}, nil
+}
+
+// register registers the schema, or looks it up if it is registered already, and returns its id
+func (r *schemaRegistry) register(ctx context.Context, schema string) (int, error) {
+	body, err := json.Marshal(struct {
+		Schema string `json:"schema"`
+	}{schema})
 	if err != nil {
-		return "", -1, err
+		return -1, err
 	}
 
 	req, err := http.NewRequest(
 		"POST",
-		fmt.Sprintf("%s/subjects/%s-value/versions", cfg.SchemaRegistryURL, cfg.Topic),
+		fmt.Sprintf("%s/subjects/%s/versions", r.url, r.subject),
 		bytes.NewBuffer(body),
 	)
+	if err != nil {
+		return -1, fmt.Errorf("failed to get schema ID: %v", err)
+	}
+	req = req.WithContext(ctx)
 	req.Header.Add("Content-Type", "application/vnd.schemaregistry.v1+json")
+	if r.token != "" {
+		req.Header.Add("Authorization", "Bearer "+r.token)
+	} else if r.username != "" {
+		req.SetBasicAuth(r.username, r.password)
+	}
 
-	resp, err := httpClient.Do(req)
+	resp, err := r.client.Do(req)
 	if err != nil {
-		return "", -1, fmt.Errorf("failed to get schema ID: %v", err)
+		return -1, fmt.Errorf("failed to get schema ID: %v", err)
 	}
 	defer resp.Body.Close()
 	if resp.StatusCode != 200 {
@@ -116,16 +270,77 @@ func avroSchema(cfg EncoderConfig) (string, int, error) {
 			Message   string `json:"message"`
 		}
 		if err = json.NewDecoder(resp.Body).Decode(&errorResp); err == nil {
-			return "", -1, fmt.Errorf("%d error: %s", errorResp.ErrorCode, errorResp.Message)
+			return -1, fmt.Errorf("%d error: %s", errorResp.ErrorCode, errorResp.Message)
 		}
-		return "", -1, fmt.Errorf("%d error: %s", resp.StatusCode, resp.Status)
+		return -1, fmt.Errorf("%d error: %s", resp.StatusCode, resp.Status)
 	}
 
 	var response struct {
 		ID int `json:"id"`
 	}
 	if err = json.NewDecoder(resp.Body).Decode(&response); err != nil {
-		return "", -1, fmt.Errorf("malformed response: %v", err)
+		return -1, fmt.Errorf("malformed response: %v", err)
+	}
+	return response.ID, nil
+}
+
+// schemaCache is the cached id of a schema, it is only used for the same registry, subject and schema
+type schemaCache struct {
+	Registry string `json:"registry"`
+	Subject  string `json:"subject"`
+	Schema   string `json:"schema_sha256"`
+	ID       int    `json:"id"`
+}
+
+func (r *schemaRegistry) cacheEntry(schema string, id int) schemaCache {
+	sum := sha256.Sum256([]byte(schema))
+	return schemaCache{Registry: r.url, Subject: r.subject, Schema: hex.EncodeToString(sum[:]), ID: id}
+}
+
+// cachedID returns the cached id of the schema if there is one
+func (r *schemaRegistry) cachedID(schema string) (int, bool) {
+	if r.cacheFile == "" {
+		return 0, false
+	}
+
+	buf, err := ioutil.ReadFile(r.cacheFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logrus.WithError(err).Warn("failed to read the Avro schema id cache")
+		}
+		return 0, false
+	}
+
+	var cached schemaCache
+	if err := json.Unmarshal(buf, &cached); err != nil {
+		logrus.WithError(err).Warn("failed to parse the Avro schema id cache")
+		return 0, false
+	}
+
+	if cached != r.cacheEntry(schema, cached.ID) {
+		return 0, false
+	}
+	return cached.ID, true
+}
+
+// cacheID writes the id of the schema to the cache file, the file is replaced atomically
+func (r *schemaRegistry) cacheID(schema string, id int) error {
+	if r.cacheFile == "" {
+		return nil
+	}
+
+	buf, err := json.Marshal(r.cacheEntry(schema, id))
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(r.cacheFile), 0700); err != nil {
+		return err
+	}
+
+	tmp := r.cacheFile + ".tmp"
+	if err := ioutil.WriteFile(tmp, buf, 0600); err != nil {
+		return err
 	}
-	return string(data), response.ID, nil
+	return os.Rename(tmp, r.cacheFile)
 }
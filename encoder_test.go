@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Starts a fake schema registry that hands out the given id, or fails while it is down
+func testSchemaRegistry(id int, down *int32) (*httptest.Server, chan *http.Request) {
+	requests := make(chan *http.Request, 10)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests <- r
+		if atomic.LoadInt32(down) != 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte(`{"error_code":50003,"message":"down"}`))
+			return
+		}
+
+		var body struct {
+			Schema string `json:"schema"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Schema == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]int{"id": id})
+	}))
+	return ts, requests
+}
+
+func TestNewEncoderAvro(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-audit-encoder")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	down := int32(0)
+	ts, requests := testSchemaRegistry(42, &down)
+	defer ts.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cfg := EncoderConfig{
+		Type:                   AvroEncoderType,
+		SchemaFile:             "avro_schema.json",
+		SchemaCacheFile:        filepath.Join(dir, "cache", "schema-id.json"),
+		SchemaRegistryURL:      ts.URL,
+		SchemaRegistryUsername: "go-audit",
+		SchemaRegistryPassword: "secret",
+		Topic:                  "audit",
+	}
+
+	// The first start registers the schema and caches its id
+	enc, err := NewEncoder(ctx, cfg)
+	assert.Nil(t, err)
+	assert.Equal(t, 42, enc.(*avroEncoder).SchemaID())
+
+	r := <-requests
+	assert.Equal(t, "/subjects/audit-value/versions", r.URL.Path)
+	user, pass, ok := r.BasicAuth()
+	assert.True(t, ok)
+	assert.Equal(t, "go-audit", user)
+	assert.Equal(t, "secret", pass)
+
+	buf, err := ioutil.ReadFile(cfg.SchemaCacheFile)
+	assert.Nil(t, err)
+	assert.Contains(t, string(buf), `"id":42`)
+
+	// Without a cache a registry that is down stops the start
+	atomic.StoreInt32(&down, 1)
+	noCache := cfg
+	noCache.SchemaCacheFile = ""
+	_, err = NewEncoder(ctx, noCache)
+	assert.EqualError(t, err, "50003 error: down")
+	<-requests
+
+	// With the cache it starts with the cached id and registers the schema in the background
+	enc, err = NewEncoder(ctx, cfg)
+	assert.Nil(t, err)
+	assert.Equal(t, 42, enc.(*avroEncoder).SchemaID())
+	<-requests
+
+	// Another subject does not use the cached id
+	otherTopic := cfg
+	otherTopic.Topic = "audit-exec"
+	_, err = NewEncoder(ctx, otherTopic)
+	assert.EqualError(t, err, "50003 error: down")
+	<-requests
+}
+
+func TestAvroEncoderRegister(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-audit-encoder")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	down := int32(1)
+	ts, requests := testSchemaRegistry(43, &down)
+	defer ts.Close()
+
+	r, err := newSchemaRegistry(EncoderConfig{
+		SchemaRegistryURL:   ts.URL,
+		SchemaRegistryToken: "token",
+		SchemaCacheFile:     filepath.Join(dir, "schema-id.json"),
+		Topic:               "audit",
+	})
+	assert.Nil(t, err)
+	assert.Nil(t, r.cacheID("{}", 42))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	enc := &avroEncoder{}
+	enc.setSchemaID(42)
+	done := make(chan struct{})
+	go func() {
+		enc.register(ctx, r, "{}")
+		close(done)
+	}()
+
+	// Failures are retried until the registry is back, the new id replaces the cached one
+	req := <-requests
+	assert.Equal(t, "Bearer token", req.Header.Get("Authorization"))
+	atomic.StoreInt32(&down, 0)
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the schema was not registered")
+	}
+	assert.Equal(t, 43, enc.SchemaID())
+
+	id, ok := r.cachedID("{}")
+	assert.True(t, ok)
+	assert.Equal(t, 43, id)
+
+	// A changed schema has no cached id
+	_, ok = r.cachedID(`{"type":"string"}`)
+	assert.False(t, ok)
+}
+
+func TestNewSchemaRegistry(t *testing.T) {
+	_, err := newSchemaRegistry(EncoderConfig{SchemaRegistryUsername: "a", SchemaRegistryToken: "b"})
+	assert.EqualError(t, err, "schema registry can only have one of a token or a username")
+
+	_, err = newSchemaRegistry(EncoderConfig{SchemaRegistryCAFile: "/nonexistent/ca.pem"})
+	assert.EqualError(t, err, "failed to read the schema registry CA: open /nonexistent/ca.pem: no such file or directory")
+
+	_, err = newSchemaRegistry(EncoderConfig{SchemaRegistryCAFile: "avro_schema.json"})
+	assert.EqualError(t, err, "schema registry CA avro_schema.json has no PEM certificates")
+
+	_, err = newSchemaRegistry(EncoderConfig{SchemaRegistryCertFile: "/nonexistent/cert.pem"})
+	assert.EqualError(t, err, "failed to load the schema registry client certificate: open /nonexistent/cert.pem: no such file or directory")
+
+	// The registry is verified with the configured CA
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"id":7}`))
+	}))
+	defer ts.Close()
+
+	ca, err := ioutil.TempFile("", "go-audit-ca")
+	assert.Nil(t, err)
+	defer os.Remove(ca.Name())
+	pem.Encode(ca, &pem.Block{Type: "CERTIFICATE", Bytes: ts.TLS.Certificates[0].Certificate[0]})
+	ca.Close()
+
+	r, err := newSchemaRegistry(EncoderConfig{SchemaRegistryURL: ts.URL, Topic: "audit"})
+	assert.Nil(t, err)
+	_, err = r.register(context.Background(), "{}")
+	assert.NotNil(t, err)
+
+	r, err = newSchemaRegistry(EncoderConfig{SchemaRegistryURL: ts.URL, SchemaRegistryCAFile: ca.Name(), Topic: "audit"})
+	assert.Nil(t, err)
+	id, err := r.register(context.Background(), "{}")
+	assert.Nil(t, err)
+	assert.Equal(t, 7, id)
+
+	r, err = newSchemaRegistry(EncoderConfig{SchemaRegistryURL: "http://localhost", Topic: "audit"})
+	assert.Nil(t, err)
+	assert.Equal(t, "audit-value", r.subject)
+	assert.Equal(t, http.DefaultTransport, r.client.Transport)
+}
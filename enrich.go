@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	ENRICHMENT_CACHE_SIZE = 4096
+)
+
+// An enricher adds context to a complete message group right before it is written to the outputs
+type enricher interface {
+	Enrich(msg *AuditMessageGroup)
+}
+
+// An observer sees every complete message group before the filters. Enrichers that keep state implement it so they
+// don't miss what filtered groups tell them
+type observer interface {
+	Observe(msg *AuditMessageGroup)
+}
+
+// A recordObserver sees every record as it arrives, the ones outside of the events range included
+type recordObserver interface {
+	ObserveRecord(am *AuditMessage)
+}
+
+var (
+	// Container cgroups of docker, containerd, cri-o and podman, with the cgroupfs or the systemd driver
+	containerCgroup = regexp.MustCompile(`^(?:docker-|cri-containerd-|crio-|libpod-)?([0-9a-f]{64})(?:\.scope)?$`)
+	// Kubernetes pod cgroups, the systemd driver replaces the dashes of the uid with underscores
+	podCgroup = regexp.MustCompile(`(?:^|-)pod([0-9a-f]{8}[-_][0-9a-f]{4}[-_][0-9a-f]{4}[-_][0-9a-f]{4}[-_][0-9a-f]{12})(?:\.slice)?$`)
+)
+
+// ProcessContext is where the process of an event runs
+type ProcessContext struct {
+	ContainerID  string `json:"container_id,omitempty"`
+	PodUID       string `json:"pod_uid,omitempty"`
+	PodName      string `json:"pod_name,omitempty"`
+	PodNamespace string `json:"pod_namespace,omitempty"`
+	SystemdUnit  string `json:"systemd_unit,omitempty"`
+}
+
+// processEnricher adds the container, pod and systemd unit of the process of an event from its cgroup.
+// Lookups are cached per pid until the process exits
+type processEnricher struct {
+	mu          sync.Mutex
+	procRoot    string // Usually /proc, tests use a fake one
+	metadataDir string // Optional directory of container bundles, `<id>/config.json`
+	size        int
+	cache       map[int]*ProcessContext
+}
+
+func newProcessEnricher(procRoot, metadataDir string, size int) *processEnricher {
+	return &processEnricher{
+		procRoot:    procRoot,
+		metadataDir: metadataDir,
+		size:        size,
+		cache:       make(map[int]*ProcessContext),
+	}
+}
+
+// Observe forgets a process once it is gone, pids are reused and filtered exits must clear the cache as well.
+// The exit itself keeps the context of the process
+func (p *processEnricher) Observe(msg *AuditMessageGroup) {
+	if msg.Pid == 0 || !isExit(msg) {
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if pc, ok := p.cache[msg.Pid]; ok {
+		msg.Process = pc
+		delete(p.cache, msg.Pid)
+	}
+}
+
+func (p *processEnricher) Enrich(msg *AuditMessageGroup) {
+	if msg.Pid == 0 || msg.Process != nil {
+		return
+	}
+
+	// An exited process is not cached again, its pid may belong to another process soon
+	if isExit(msg) {
+		msg.Process, _ = p.read(msg.Pid)
+		return
+	}
+
+	msg.Process = p.lookup(msg.Pid)
+}
+
+func (p *processEnricher) lookup(pid int) *ProcessContext {
+	p.mu.Lock()
+	pc, ok := p.cache[pid]
+	p.mu.Unlock()
+	if ok {
+		return pc
+	}
+
+	pc, err := p.read(pid)
+	if err != nil {
+		// Short lived processes are often gone by the time their events are written
+		logrus.WithError(err).WithField("pid", pid).Debug("failed to read the cgroup of the process")
+		return nil
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.cache) >= p.size {
+		// Exits keep the cache small, this only kicks in if they are not audited. Any entry will do
+		for evict := range p.cache {
+			delete(p.cache, evict)
+			break
+		}
+	}
+	p.cache[pid] = pc
+	return pc
+}
+
+func isExit(msg *AuditMessageGroup) bool {
+	return msg.SyscallName == "exit" || msg.SyscallName == "exit_group"
+}
+
+func (p *processEnricher) read(pid int) (*ProcessContext, error) {
+	f, err := os.Open(filepath.Join(p.procRoot, strconv.Itoa(pid), "cgroup"))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	pc, err := parseCgroup(f)
+	if err != nil {
+		return nil, err
+	}
+
+	if pc.ContainerID != "" && p.metadataDir != "" {
+		p.readContainerMetadata(pc)
+	}
+
+	return pc, nil
+}
+
+// Reads the pod of a container from the annotations of its OCI bundle, or the labels of a docker container
+func (p *processEnricher) readContainerMetadata(pc *ProcessContext) {
+	var meta struct {
+		Annotations map[string]string `json:"annotations"`
+		Config      struct {
+			Labels map[string]string `json:"Labels"`
+		} `json:"Config"`
+	}
+
+	for _, name := range []string{"config.json", "config.v2.json"} {
+		buf, err := ioutil.ReadFile(filepath.Join(p.metadataDir, pc.ContainerID, name))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err == nil {
+			err = json.Unmarshal(buf, &meta)
+		}
+		if err != nil {
+			logrus.WithError(err).WithField("container", pc.ContainerID).Warn("failed to read the container metadata")
+			return
+		}
+
+		for _, labels := range []map[string]string{meta.Annotations, meta.Config.Labels} {
+			for _, key := range []string{"io.kubernetes.pod.name", "io.kubernetes.cri.sandbox-name"} {
+				if pc.PodName == "" {
+					pc.PodName = labels[key]
+				}
+			}
+			for _, key := range []string{"io.kubernetes.pod.namespace", "io.kubernetes.cri.sandbox-namespace"} {
+				if pc.PodNamespace == "" {
+					pc.PodNamespace = labels[key]
+				}
+			}
+		}
+		return
+	}
+}
+
+// Parses /proc/<pid>/cgroup, `hierarchy-id:controllers:path` per line. cgroup v1 has a line per hierarchy, v2 a
+// single `0::path` line. The first container, pod and systemd unit found win
+func parseCgroup(r io.Reader) (*ProcessContext, error) {
+	pc := &ProcessContext{}
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		parts := strings.SplitN(s.Text(), ":", 3)
+		if len(parts) != 3 {
+			continue
+		}
+
+		var unit string
+		for _, segment := range strings.Split(parts[2], "/") {
+			if m := containerCgroup.FindStringSubmatch(segment); m != nil {
+				if pc.ContainerID == "" {
+					pc.ContainerID = m[1]
+				}
+				continue
+			}
+
+			if m := podCgroup.FindStringSubmatch(segment); m != nil {
+				if pc.PodUID == "" {
+					pc.PodUID = strings.Replace(m[1], "_", "-", -1)
+				}
+				continue
+			}
+
+			// The innermost unit is the one the process belongs to, session scopes are nested in user slices
+			if strings.HasSuffix(segment, ".service") || strings.HasSuffix(segment, ".scope") {
+				unit = segment
+			}
+		}
+
+		if pc.SystemdUnit == "" {
+			pc.SystemdUnit = unit
+		}
+	}
+
+	return pc, s.Err()
+}
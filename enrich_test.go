@@ -0,0 +1,142 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	testContainerID = "4e9c3a2f0f1d7c9b8a6e5d4c3b2a190817263544536271809a8b7c6d5e4f3a2b"
+	testPodUID      = "0b7c1d36-6a5e-4f0e-9a4b-2c1d3e4f5a6b"
+)
+
+func TestParseCgroup(t *testing.T) {
+	for _, c := range []struct {
+		name   string
+		cgroup string
+		pc     ProcessContext
+	}{
+		{
+			name:   "systemd service, cgroup v2",
+			cgroup: "0::/system.slice/sshd.service\n",
+			pc:     ProcessContext{SystemdUnit: "sshd.service"},
+		},
+		{
+			name:   "login session, cgroup v2",
+			cgroup: "0::/user.slice/user-1000.slice/session-3.scope\n",
+			pc:     ProcessContext{SystemdUnit: "session-3.scope"},
+		},
+		{
+			name:   "docker, cgroup v1",
+			cgroup: "12:pids:/docker/" + testContainerID + "\n11:cpu,cpuacct:/docker/" + testContainerID + "\n1:name=systemd:/docker/" + testContainerID + "\n",
+			pc:     ProcessContext{ContainerID: testContainerID},
+		},
+		{
+			name:   "docker with the systemd driver, cgroup v2",
+			cgroup: "0::/system.slice/docker-" + testContainerID + ".scope\n",
+			pc:     ProcessContext{ContainerID: testContainerID},
+		},
+		{
+			name:   "kubernetes with the systemd driver, cgroup v2",
+			cgroup: "0::/kubepods.slice/kubepods-burstable.slice/kubepods-burstable-pod" + strings.Replace(testPodUID, "-", "_", -1) + ".slice/cri-containerd-" + testContainerID + ".scope\n",
+			pc:     ProcessContext{ContainerID: testContainerID, PodUID: testPodUID},
+		},
+		{
+			name:   "kubernetes with the cgroupfs driver, cgroup v1",
+			cgroup: "4:memory:/kubepods/besteffort/pod" + testPodUID + "/" + testContainerID + "\n1:name=systemd:/kubepods/besteffort/pod" + testPodUID + "/" + testContainerID + "\n",
+			pc:     ProcessContext{ContainerID: testContainerID, PodUID: testPodUID},
+		},
+		{
+			name:   "garbage",
+			cgroup: "nope\n\n",
+			pc:     ProcessContext{},
+		},
+	} {
+		pc, err := parseCgroup(strings.NewReader(c.cgroup))
+		assert.Nil(t, err, c.name)
+		assert.Equal(t, &c.pc, pc, c.name)
+	}
+}
+
+func TestProcessEnricher(t *testing.T) {
+	root := tempDir(t)
+	defer os.RemoveAll(root)
+	procRoot := filepath.Join(root, "proc")
+	metadataDir := filepath.Join(root, "containers")
+
+	writeCgroup(t, procRoot, 10, "0::/system.slice/sshd.service\n")
+	writeCgroup(t, procRoot, 20, "0::/kubepods.slice/kubepods-pod"+strings.Replace(testPodUID, "-", "_", -1)+".slice/cri-containerd-"+testContainerID+".scope\n")
+	writeFile(t, filepath.Join(metadataDir, testContainerID, "config.json"), `{"ociVersion":"1.0.2","annotations":{"io.kubernetes.cri.sandbox-name":"web-0","io.kubernetes.cri.sandbox-namespace":"shop"}}`)
+
+	p := newProcessEnricher(procRoot, metadataDir, 2)
+
+	amg := &AuditMessageGroup{Pid: 10}
+	p.Enrich(amg)
+	assert.Equal(t, &ProcessContext{SystemdUnit: "sshd.service"}, amg.Process)
+
+	amg = &AuditMessageGroup{Pid: 20}
+	p.Enrich(amg)
+	assert.Equal(t, &ProcessContext{ContainerID: testContainerID, PodUID: testPodUID, PodName: "web-0", PodNamespace: "shop"}, amg.Process)
+
+	// Gone processes and groups without a pid are left alone
+	amg = &AuditMessageGroup{Pid: 30}
+	p.Enrich(amg)
+	assert.Nil(t, amg.Process)
+	p.Enrich(&AuditMessageGroup{})
+	assert.Len(t, p.cache, 2)
+
+	// Lookups are cached until the process exits
+	writeCgroup(t, procRoot, 10, "0::/system.slice/cron.service\n")
+	amg = &AuditMessageGroup{Pid: 10, SyscallName: "exit_group"}
+	p.Observe(amg)
+	p.Enrich(amg)
+	assert.Equal(t, "sshd.service", amg.Process.SystemdUnit)
+	assert.Len(t, p.cache, 1)
+
+	amg = &AuditMessageGroup{Pid: 10}
+	p.Enrich(amg)
+	assert.Equal(t, "cron.service", amg.Process.SystemdUnit)
+
+	// Exits that are filtered out clear the cache as well
+	p.Observe(&AuditMessageGroup{Pid: 10, SyscallName: "exit"})
+	writeCgroup(t, procRoot, 10, "0::/system.slice/atd.service\n")
+	amg = &AuditMessageGroup{Pid: 10}
+	p.Enrich(amg)
+	assert.Equal(t, "atd.service", amg.Process.SystemdUnit)
+
+	// The cache is bounded
+	writeCgroup(t, procRoot, 30, "0::/system.slice/nginx.service\n")
+	p.Enrich(&AuditMessageGroup{Pid: 30})
+	assert.Len(t, p.cache, 2)
+}
+
+func TestProcessEnricherDockerLabels(t *testing.T) {
+	root := tempDir(t)
+	defer os.RemoveAll(root)
+
+	writeCgroup(t, root, 1, "1:name=systemd:/docker/"+testContainerID+"\n")
+	writeFile(t, filepath.Join(root, "containers", testContainerID, "config.v2.json"), `{"Config":{"Labels":{"io.kubernetes.pod.name":"web-1","io.kubernetes.pod.namespace":"shop"}}}`)
+
+	amg := &AuditMessageGroup{Pid: 1}
+	newProcessEnricher(root, filepath.Join(root, "containers"), 10).Enrich(amg)
+	assert.Equal(t, &ProcessContext{ContainerID: testContainerID, PodName: "web-1", PodNamespace: "shop"}, amg.Process)
+}
+
+func writeCgroup(t *testing.T, procRoot string, pid int, cgroup string) {
+	writeFile(t, filepath.Join(procRoot, strconv.Itoa(pid), "cgroup"), cgroup)
+}
+
+func writeFile(t *testing.T, path, content string) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/hex"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// execveArgs collects the arguments of the EXECVE records of a message group.
+// The kernel spreads many arguments over several records and splits long arguments into `aN[i]` chunks
+type execveArgs struct {
+	args   map[int]string
+	chunks map[int]map[int]string // { arg: { chunk: value } }
+	max    int                    // Highest argument index seen so far
+}
+
+// Adds the arguments of an EXECVE record and rebuilds argv and the command line of the group
+func (amg *AuditMessageGroup) addExecveArgs(am *AuditMessage) {
+	if amg.execve == nil {
+		amg.execve = &execveArgs{
+			args:   make(map[int]string),
+			chunks: make(map[int]map[int]string),
+			max:    -1,
+		}
+	}
+	e := amg.execve
+
+	scanFields(am.Data, func(key, value string, quote byte) {
+		if len(key) < 2 || key[0] != 'a' {
+			return
+		}
+
+		// Chunks of a long argument, `aN[i]=`
+		if br := strings.IndexByte(key, '['); br > 0 && key[len(key)-1] == ']' {
+			n, err := strconv.Atoi(key[1:br])
+			if err != nil {
+				return
+			}
+			c, err := strconv.Atoi(key[br+1 : len(key)-1])
+			if err != nil {
+				return
+			}
+
+			if e.chunks[n] == nil {
+				e.chunks[n] = make(map[int]string)
+			}
+			e.chunks[n][c] = decodeExecveValue(value, quote)
+			e.see(n)
+			return
+		}
+
+		// Plain arguments, `aN_len=` is skipped here
+		n, err := strconv.Atoi(key[1:])
+		if err != nil {
+			return
+		}
+		e.args[n] = decodeExecveValue(value, quote)
+		e.see(n)
+	})
+
+	amg.Argv = e.argv()
+	amg.CommandLine = joinCommandLine(amg.Argv)
+}
+
+// Uses the PROCTITLE record for argv and the command line, unless the group has EXECVE records
+func (amg *AuditMessageGroup) addProctitle(am *AuditMessage) {
+	if amg.execve != nil {
+		return
+	}
+
+	var title string
+	found := false
+	scanFields(am.Data, func(key, value string, quote byte) {
+		if key != "proctitle" || found {
+			return
+		}
+
+		found = true
+		title = decodeExecveValue(value, quote)
+	})
+
+	if !found || title == "" {
+		return
+	}
+
+	// Arguments are separated by NUL
+	amg.Argv = strings.Split(strings.TrimRight(title, "\x00"), "\x00")
+	amg.CommandLine = joinCommandLine(amg.Argv)
+}
+
+func (e *execveArgs) see(n int) {
+	if n > e.max {
+		e.max = n
+	}
+}
+
+// Assembles the arguments seen so far, arguments the kernel did not send are empty
+func (e *execveArgs) argv() []string {
+	argv := make([]string, e.max+1)
+	for i := range argv {
+		if v, ok := e.args[i]; ok {
+			argv[i] = v
+			continue
+		}
+
+		chunks, ok := e.chunks[i]
+		if !ok {
+			continue
+		}
+
+		order := make([]int, 0, len(chunks))
+		for c := range chunks {
+			order = append(order, c)
+		}
+		sort.Ints(order)
+
+		parts := make([]string, len(order))
+		for j, c := range order {
+			parts[j] = chunks[c]
+		}
+		argv[i] = strings.Join(parts, "")
+	}
+
+	return argv
+}
+
+// Unquoted arguments are hex encoded by the kernel, quoted ones are taken as is
+func decodeExecveValue(value string, quote byte) string {
+	if quote != 0 || value == "(null)" {
+		return value
+	}
+
+	b, err := hex.DecodeString(value)
+	if err != nil {
+		return value
+	}
+	return string(b)
+}
+
+// Joins argv with spaces, arguments that would be ambiguous are quoted
+func joinCommandLine(argv []string) string {
+	args := make([]string, len(argv))
+	for i, arg := range argv {
+		// strconv.Quote escapes quotes, backslashes and anything not printable, spaces are left alone
+		if arg == "" || strings.ContainsAny(arg, " '") || strconv.Quote(arg) != `"`+arg+`"` {
+			arg = strconv.Quote(arg)
+		}
+		args[i] = arg
+	}
+	return strings.Join(args, " ")
+}
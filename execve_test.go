@@ -0,0 +1,72 @@
+package main
+
+import (
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAuditMessageGroupExecve(t *testing.T) {
+	// Quoted and hex encoded arguments
+	amg := &AuditMessageGroup{}
+	amg.AddMessage(&AuditMessage{Type: 1309, Data: `argc=4 a0="ls" a1="-l" a2=2F746D702F6D7920646972 a3=""`})
+	assert.Equal(t, []string{"ls", "-l", "/tmp/my dir", ""}, amg.Argv)
+	assert.Equal(t, `ls -l "/tmp/my dir" ""`, amg.CommandLine)
+
+	// Long arguments are split into chunks and arguments spread over several records
+	amg = &AuditMessageGroup{}
+	amg.AddMessage(&AuditMessage{Type: 1309, Data: `argc=3 a0="echo" a1_len=10 a1[0]=6869207468 a1[1]="ere"`})
+	amg.AddMessage(&AuditMessage{Type: 1309, Data: `a1[2]="!!" a2=E282AC`})
+	assert.Equal(t, []string{"echo", "hi there!!", "€"}, amg.Argv)
+	assert.Equal(t, `echo "hi there!!" €`, amg.CommandLine)
+
+	// The PROCTITLE of an execve is the old process, it must not replace the arguments
+	amg.AddMessage(&AuditMessage{Type: 1327, Data: `proctitle=2F62696E2F62617368002D63`})
+	assert.Equal(t, []string{"echo", "hi there!!", "€"}, amg.Argv)
+}
+
+func TestAuditMessageGroupProctitle(t *testing.T) {
+	amg := &AuditMessageGroup{UidMap: map[string]string{}}
+	amg.AddMessage(&AuditMessage{Type: 1327, Data: `proctitle=2F62696E2F62617368002D630065636820276869270A00`})
+	assert.Equal(t, []string{"/bin/bash", "-c", "ech 'hi'\n"}, amg.Argv)
+	assert.Equal(t, `/bin/bash -c "ech 'hi'\n"`, amg.CommandLine)
+
+	amg = &AuditMessageGroup{UidMap: map[string]string{}}
+	amg.AddMessage(&AuditMessage{Type: 1327, Data: `proctitle="sshd"`})
+	assert.Equal(t, []string{"sshd"}, amg.Argv)
+	assert.Equal(t, "sshd", amg.CommandLine)
+
+	// EXECVE records win over an earlier PROCTITLE
+	amg.AddMessage(&AuditMessage{Type: 1309, Data: `argc=1 a0="id"`})
+	assert.Equal(t, []string{"id"}, amg.Argv)
+	assert.Equal(t, "id", amg.CommandLine)
+}
+
+func TestAuditMarshallerExecveFieldsInstead(t *testing.T) {
+	w := &noopWriter{}
+	m := NewAuditMarshaller([]*AuditWriter{NewAuditWriter(w, 1)}, uint16(1300), uint16(1399), false, false, 0, FieldsModeInstead, COMPLETE_AFTER, []AuditFilter{})
+	m.Consume(&syscall.NetlinkMessage{
+		Header: syscall.NlMsghdr{Type: 1300},
+		Data:   []byte(`audit(10000001:1): arch=c000003e syscall=59 success=yes uid=0`),
+	})
+	m.Consume(&syscall.NetlinkMessage{
+		Header: syscall.NlMsghdr{Type: 1309},
+		Data:   []byte(`audit(10000001:1): argc=2 a0="ls" a1=2D6C`),
+	})
+
+	// The group is built from the raw data before the fields replace it
+	amg := m.msgs[1]
+	assert.Equal(t, "execve", amg.SyscallName)
+	assert.Equal(t, "ls -l", amg.CommandLine)
+	assert.Equal(t, 1, len(amg.UidMap))
+
+	assert.Equal(t, 1, m.Flush())
+	assert.Equal(t, "", amg.Msgs[1].Data)
+	assert.Equal(t, "-l", amg.Msgs[1].Fields["a1"])
+}
+
+func TestJoinCommandLine(t *testing.T) {
+	assert.Equal(t, "", joinCommandLine(nil))
+	assert.Equal(t, `a "b c" "" "d\"e" "f'g" "h\\i" "\x01"`, joinCommandLine([]string{"a", "b c", "", `d"e`, "f'g", `h\i`, "\x01"}))
+}
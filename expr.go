@@ -0,0 +1,453 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// filterExpr is a compiled filter expression, like `syscall == "connect" && saddr.port == 53 && !(exe =~ "^/usr/")`.
+//
+// Fields are compared to literals with ==, !=, <, <=, >, >=, =~ and !~ for regexes and `in` for cidrs, and
+// combined with &&, || and !. A field on its own is true when it has a value, true and false are literals.
+// Fields are the fields of every record of an event, a field in several records matches if any of its values
+// match and != only if none do. Besides the record fields there are:
+//
+//	syscall                              the syscall name or number
+//	type                                 the message types of the records
+//	saddr.family, addr, port and path    the decoded sockaddr
+//	command_line and argv                the command line and arguments of an execve
+type filterExpr struct {
+	source string
+	root   exprNode
+}
+
+type exprNode interface {
+	eval(c *exprContext) bool
+}
+
+// compileFilterExpr parses an expression, regexes and cidrs are compiled once here
+func compileFilterExpr(source string) (*filterExpr, error) {
+	tokens, err := lexExpr(source)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &exprParser{tokens: tokens}
+	root, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != tokenEOF {
+		return nil, fmt.Errorf("unexpected %s at %d", t, t.pos)
+	}
+
+	return &filterExpr{source: source, root: root}, nil
+}
+
+// Match evaluates the expression against an event
+func (f *filterExpr) Match(c *exprContext) bool {
+	return f.root.eval(c)
+}
+
+func (f *filterExpr) String() string {
+	return f.source
+}
+
+// exprContext resolves the fields of an event, record fields are only parsed if an expression asks for one
+type exprContext struct {
+	msg    *AuditMessageGroup
+	fields map[string][]string
+}
+
+func newExprContext(msg *AuditMessageGroup) *exprContext {
+	return &exprContext{msg: msg}
+}
+
+func (c *exprContext) values(field string) []string {
+	msg := c.msg
+	switch field {
+	case "syscall":
+		return nonEmpty(msg.SyscallName, msg.Syscall)
+	case "type":
+		types := make([]string, len(msg.Msgs))
+		for i, m := range msg.Msgs {
+			types[i] = strconv.Itoa(int(m.Type))
+		}
+		return types
+	case "command_line":
+		return nonEmpty(msg.CommandLine)
+	case "argv":
+		return msg.Argv
+	}
+
+	if strings.HasPrefix(field, "saddr.") {
+		sa := msg.Sockaddr
+		if sa == nil {
+			return nil
+		}
+		switch field {
+		case "saddr.family":
+			return nonEmpty(sa.Family)
+		case "saddr.addr":
+			return nonEmpty(sa.Addr)
+		case "saddr.port":
+			if sa.Family == "inet" || sa.Family == "inet6" {
+				return []string{strconv.Itoa(sa.Port)}
+			}
+			return nil
+		case "saddr.path":
+			return nonEmpty(sa.Path)
+		}
+	}
+
+	if c.fields == nil {
+		c.fields = make(map[string][]string)
+		for _, m := range msg.Msgs {
+			// Messages decoded from json may only have their fields left
+			fields := m.Fields
+			if fields == nil {
+				fields = parseFields(m.Type, m.Data)
+			}
+			for k, v := range fields {
+				c.fields[k] = append(c.fields[k], v)
+			}
+		}
+	}
+	return c.fields[field]
+}
+
+func nonEmpty(values ...string) []string {
+	var ne []string
+	for _, v := range values {
+		if v != "" {
+			ne = append(ne, v)
+		}
+	}
+	return ne
+}
+
+type andNode struct{ left, right exprNode }
+
+func (n *andNode) eval(c *exprContext) bool { return n.left.eval(c) && n.right.eval(c) }
+
+type orNode struct{ left, right exprNode }
+
+func (n *orNode) eval(c *exprContext) bool { return n.left.eval(c) || n.right.eval(c) }
+
+type notNode struct{ node exprNode }
+
+func (n *notNode) eval(c *exprContext) bool { return !n.node.eval(c) }
+
+type boolNode bool
+
+func (n boolNode) eval(c *exprContext) bool { return bool(n) }
+
+type existsNode struct{ field string }
+
+func (n *existsNode) eval(c *exprContext) bool {
+	for _, v := range c.values(n.field) {
+		if v != "" {
+			return true
+		}
+	}
+	return false
+}
+
+type compareNode struct {
+	field  string
+	op     string
+	str    string
+	num    float64
+	isNum  bool
+	regex  *regexp.Regexp
+	cidr   *net.IPNet
+	negate bool // != and !~ match if no value matches == and =~
+}
+
+func (n *compareNode) eval(c *exprContext) bool {
+	for _, v := range c.values(n.field) {
+		if n.match(v) {
+			return !n.negate
+		}
+	}
+	return n.negate
+}
+
+func (n *compareNode) match(v string) bool {
+	switch n.op {
+	case "=~":
+		return n.regex.MatchString(v)
+	case "in":
+		ip := net.ParseIP(v)
+		return ip != nil && n.cidr.Contains(ip)
+	}
+
+	if !n.isNum {
+		return v == n.str
+	}
+
+	// Numbers are compared as numbers, values that are not numbers never match
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return false
+	}
+	switch n.op {
+	case "==":
+		return f == n.num
+	case "<":
+		return f < n.num
+	case "<=":
+		return f <= n.num
+	case ">":
+		return f > n.num
+	case ">=":
+		return f >= n.num
+	}
+	return false
+}
+
+type exprParser struct {
+	tokens []exprToken
+	pos    int
+}
+
+func (p *exprParser) peek() exprToken {
+	return p.tokens[p.pos]
+}
+
+func (p *exprParser) next() exprToken {
+	t := p.tokens[p.pos]
+	if t.kind != tokenEOF {
+		p.pos++
+	}
+	return t
+}
+
+// or := and ('||' and)*
+func (p *exprParser) parseOr() (exprNode, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.peek().is(tokenOp, "||") {
+		p.next()
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = &orNode{left, right}
+	}
+	return left, nil
+}
+
+// and := unary ('&&' unary)*
+func (p *exprParser) parseAnd() (exprNode, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.peek().is(tokenOp, "&&") {
+		p.next()
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = &andNode{left, right}
+	}
+	return left, nil
+}
+
+// unary := '!' unary | '(' or ')' | true | false | field [op literal]
+func (p *exprParser) parseUnary() (exprNode, error) {
+	t := p.next()
+	switch {
+	case t.is(tokenOp, "!"):
+		node, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &notNode{node}, nil
+
+	case t.is(tokenOp, "("):
+		node, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if c := p.next(); !c.is(tokenOp, ")") {
+			return nil, fmt.Errorf("expected ) at %d, got %s", c.pos, c)
+		}
+		return node, nil
+
+	case t.is(tokenIdent, "true"):
+		return boolNode(true), nil
+
+	case t.is(tokenIdent, "false"):
+		return boolNode(false), nil
+
+	case t.kind == tokenIdent:
+		return p.parseComparison(t.value)
+	}
+
+	return nil, fmt.Errorf("unexpected %s at %d", t, t.pos)
+}
+
+func (p *exprParser) parseComparison(field string) (exprNode, error) {
+	op := p.peek()
+	if !(op.kind == tokenOp && isCompareOp(op.value)) && !op.is(tokenIdent, "in") {
+		return &existsNode{field}, nil
+	}
+	p.next()
+
+	lit := p.next()
+	if lit.kind != tokenString && lit.kind != tokenNumber {
+		return nil, fmt.Errorf("expected a string or a number after %s at %d, got %s", op.value, lit.pos, lit)
+	}
+
+	n := &compareNode{field: field, op: op.value, str: lit.value}
+	switch op.value {
+	case "!=":
+		n.op, n.negate = "==", true
+	case "!~":
+		n.op, n.negate = "=~", true
+	}
+
+	var err error
+	switch n.op {
+	case "=~":
+		if n.regex, err = regexp.Compile(lit.value); err != nil {
+			return nil, fmt.Errorf("invalid regex at %d: %v", lit.pos, err)
+		}
+	case "in":
+		if _, n.cidr, err = net.ParseCIDR(lit.value); err != nil {
+			return nil, fmt.Errorf("invalid cidr at %d: %v", lit.pos, err)
+		}
+	case "==":
+		if lit.kind == tokenNumber {
+			n.num, n.isNum = lit.num, true
+		}
+	default:
+		if lit.kind != tokenNumber {
+			return nil, fmt.Errorf("%s needs a number at %d, got %s", op.value, lit.pos, lit)
+		}
+		n.num, n.isNum = lit.num, true
+	}
+
+	return n, nil
+}
+
+func isCompareOp(op string) bool {
+	switch op {
+	case "==", "!=", "=~", "!~", "<", "<=", ">", ">=":
+		return true
+	}
+	return false
+}
+
+type exprTokenKind int
+
+const (
+	tokenEOF exprTokenKind = iota
+	tokenIdent
+	tokenString
+	tokenNumber
+	tokenOp
+)
+
+type exprToken struct {
+	kind  exprTokenKind
+	value string
+	num   float64
+	pos   int
+}
+
+func (t exprToken) is(kind exprTokenKind, value string) bool {
+	return t.kind == kind && t.value == value
+}
+
+func (t exprToken) String() string {
+	switch t.kind {
+	case tokenEOF:
+		return "end of expression"
+	case tokenString:
+		return strconv.Quote(t.value)
+	}
+	return "`" + t.value + "`"
+}
+
+// Operators, the longer ones first
+var exprOps = []string{"==", "!=", "=~", "!~", "<=", ">=", "&&", "||", "<", ">", "!", "(", ")"}
+
+func lexExpr(source string) ([]exprToken, error) {
+	var tokens []exprToken
+	for i := 0; i < len(source); {
+		c := source[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+
+		case c == '"':
+			// Go string syntax, escapes included
+			end := i + 1
+			for end < len(source) && source[end] != '"' {
+				if source[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(source) {
+				return nil, fmt.Errorf("unterminated string at %d", i)
+			}
+			value, err := strconv.Unquote(source[i : end+1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid string at %d: %v", i, err)
+			}
+			tokens = append(tokens, exprToken{kind: tokenString, value: value, pos: i})
+			i = end + 1
+
+		case c >= '0' && c <= '9' || c == '-':
+			end := i + 1
+			for end < len(source) && (source[end] >= '0' && source[end] <= '9' || source[end] == '.') {
+				end++
+			}
+			num, err := strconv.ParseFloat(source[i:end], 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid number at %d: %s", i, source[i:end])
+			}
+			tokens = append(tokens, exprToken{kind: tokenNumber, value: source[i:end], num: num, pos: i})
+			i = end
+
+		case isIdentChar(c):
+			end := i + 1
+			for end < len(source) && (isIdentChar(source[end]) || source[end] >= '0' && source[end] <= '9' || source[end] == '.' || source[end] == '-') {
+				end++
+			}
+			tokens = append(tokens, exprToken{kind: tokenIdent, value: source[i:end], pos: i})
+			i = end
+
+		default:
+			op := ""
+			for _, o := range exprOps {
+				if strings.HasPrefix(source[i:], o) {
+					op = o
+					break
+				}
+			}
+			if op == "" {
+				return nil, fmt.Errorf("unexpected %q at %d", c, i)
+			}
+			tokens = append(tokens, exprToken{kind: tokenOp, value: op, pos: i})
+			i += len(op)
+		}
+	}
+
+	return append(tokens, exprToken{kind: tokenEOF, pos: len(source)}), nil
+}
+
+func isIdentChar(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c == '_'
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFilterExpr(t *testing.T) {
+	amg := &AuditMessageGroup{UidMap: map[string]string{}, GidMap: map[string]string{}}
+	amg.AddMessage(&AuditMessage{Type: 1300, Data: `arch=c000003e syscall=42 success=yes exit=0 ppid=1 pid=900 auid=1000 uid=0 comm="curl" exe="/usr/bin/curl" key=(null)`})
+	amg.AddMessage(&AuditMessage{Type: 1306, Data: `saddr=02000035080808080000000000000000`})
+	amg.AddMessage(&AuditMessage{Type: 1302, Data: `item=0 name="/etc/hosts" inode=1`})
+	amg.AddMessage(&AuditMessage{Type: 1302, Data: `item=1 name=2F746D702F6D792066696C65 inode=2`})
+
+	for expr, match := range map[string]bool{
+		`syscall == "connect" && saddr.port == 53 && !(exe =~ "^/usr/sbin/")`: true,
+		`syscall == "connect" && saddr.port == 53 && !(exe =~ "^/usr/bin/")`:  false,
+		`syscall == 42`:                           true,
+		`syscall != "connect"`:                    false,
+		`saddr.addr in "8.8.0.0/16"`:              true,
+		`saddr.addr in "10.0.0.0/8"`:              false,
+		`saddr.family == "inet" && saddr.path`:    false,
+		`type == 1306`:                            true,
+		`type == 1309`:                            false,
+		`uid == 0 && auid >= 1000 && auid < 2000`: true,
+		`pid > 1000`:                              false,
+		`comm == "curl" || comm == "wget"`:        true,
+		`false || comm == "wget"`:                 false,
+		`true && key`:                             true,
+
+		// Any of the values of a field in several records match, != only if none do
+		`name == "/etc/hosts"`:   true,
+		`name == "/tmp/my file"`: true,
+		`name != "/etc/hosts"`:   false,
+		`name !~ "^/var/"`:       true,
+		`argv`:                   false,
+		`nope != "x"`:            true,
+		`nope == "x"`:            false,
+
+		// && binds stronger than ||
+		`comm == "wget" && pid == 900 || uid == 0`:   true,
+		`comm == "wget" && (pid == 900 || uid == 0)`: false,
+		`!comm == "wget"`: true,
+	} {
+		f, err := compileFilterExpr(expr)
+		if !assert.Nil(t, err, expr) {
+			continue
+		}
+		assert.Equal(t, match, f.Match(newExprContext(amg)), expr)
+		assert.Equal(t, expr, f.String())
+	}
+}
+
+func TestCompileFilterExprErrors(t *testing.T) {
+	for expr, msg := range map[string]string{
+		``:                        "unexpected end of expression at 0",
+		`syscall ==`:              "expected a string or a number after == at 10, got end of expression",
+		`syscall == "connect`:     "unterminated string at 11",
+		`syscall == connect`:      "expected a string or a number after == at 11, got `connect`",
+		`(syscall == "connect"`:   "expected ) at 21, got end of expression",
+		`syscall == "connect")`:   "unexpected `)` at 20",
+		`exe =~ "("`:              "invalid regex at 7: error parsing regexp: missing closing ): `(`",
+		`saddr.addr in "10.0/8"`:  "invalid cidr at 14: invalid CIDR address: 10.0/8",
+		`pid > "1"`:               "> needs a number at 6, got \"1\"",
+		`pid == 1 & uid == 0`:     "unexpected '&' at 9",
+		`pid == 1 uid == 0`:       "unexpected `uid` at 9",
+		`pid == 1.2.3`:            "invalid number at 7: 1.2.3",
+		`"connect" == syscall`:    "unexpected \"connect\" at 0",
+		`syscall == "\q"`:         "invalid string at 11: invalid syntax",
+		`!`:                       "unexpected end of expression at 1",
+		`pid == 1 && || uid == 0`: "unexpected `||` at 12",
+	} {
+		_, err := compileFilterExpr(expr)
+		assert.EqualError(t, err, msg, expr)
+	}
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"container/list"
+	"os/user"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	IDENTITY_CACHE_SIZE = 4096
+	IDENTITY_CACHE_TTL  = 10 * time.Minute
+)
+
+// The fields of audit records holding a uid, these are resolved into the uid_map of a message group
+var uidFields = map[string]bool{
+	"uid":       true,
+	"auid":      true,
+	"euid":      true,
+	"suid":      true,
+	"fsuid":     true,
+	"ouid":      true,
+	"sauid":     true,
+	"old-auid":  true,
+	"inode_uid": true,
+}
+
+// The fields of audit records holding a gid, these are resolved into the gid_map of a message group
+var gidFields = map[string]bool{
+	"gid":       true,
+	"egid":      true,
+	"sgid":      true,
+	"fsgid":     true,
+	"ogid":      true,
+	"inode_gid": true,
+}
+
+// Resolves uids and gids into user and group names, set up in main from the identity config
+var identities = newIdentityResolver(IDENTITY_CACHE_SIZE, IDENTITY_CACHE_TTL)
+
+// identityResolver looks up user and group names and caches them, it is safe for concurrent use
+type identityResolver struct {
+	users  *identityCache
+	groups *identityCache
+}
+
+func newIdentityResolver(size int, ttl time.Duration) *identityResolver {
+	return &identityResolver{
+		users:  newIdentityCache(size, ttl, "UNKNOWN_USER", lookupUsername),
+		groups: newIdentityCache(size, ttl, "UNKNOWN_GROUP", lookupGroupname),
+	}
+}
+
+// Returns the user name of the uid or UNKNOWN_USER
+func (r *identityResolver) username(uid string) string {
+	return r.users.resolve(uid)
+}
+
+// Returns the group name of the gid or UNKNOWN_GROUP
+func (r *identityResolver) groupname(gid string) string {
+	return r.groups.resolve(gid)
+}
+
+func lookupUsername(uid string) (string, error) {
+	u, err := user.LookupId(uid)
+	if err != nil {
+		return "", err
+	}
+	return u.Username, nil
+}
+
+func lookupGroupname(gid string) (string, error) {
+	g, err := user.LookupGroupId(gid)
+	if err != nil {
+		return "", err
+	}
+	return g.Name, nil
+}
+
+// identityCache is a size bounded LRU cache of id to name lookups. Entries expire after the ttl so renamed and
+// deleted accounts are picked up, a ttl of 0 keeps entries until they are evicted
+type identityCache struct {
+	mu      sync.Mutex
+	size    int
+	ttl     time.Duration
+	unknown string // The name of ids that could not be looked up
+	lookup  func(id string) (string, error)
+	entries map[string]*list.Element
+	lru     *list.List // Most recently used first
+	now     func() time.Time
+}
+
+type identityEntry struct {
+	id      string
+	name    string
+	expires time.Time
+}
+
+func newIdentityCache(size int, ttl time.Duration, unknown string, lookup func(string) (string, error)) *identityCache {
+	return &identityCache{
+		size:    size,
+		ttl:     ttl,
+		unknown: unknown,
+		lookup:  lookup,
+		entries: make(map[string]*list.Element, size),
+		lru:     list.New(),
+		now:     time.Now,
+	}
+}
+
+func (c *identityCache) resolve(id string) string {
+	if name, ok := c.get(id); ok {
+		return name
+	}
+
+	// Lookups can be slow, nss may ask ldap and friends, so they don't hold the lock.
+	// Failed lookups are cached as well, they are just as slow
+	name := c.unknown
+	if n, err := c.lookup(id); err == nil {
+		name = n
+	}
+
+	c.add(id, name)
+	return name
+}
+
+func (c *identityCache) get(id string) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.entries[id]
+	if !ok {
+		return "", false
+	}
+
+	e := el.Value.(*identityEntry)
+	if c.ttl > 0 && !c.now().Before(e.expires) {
+		c.lru.Remove(el)
+		delete(c.entries, id)
+		return "", false
+	}
+
+	c.lru.MoveToFront(el)
+	return e.name, true
+}
+
+func (c *identityCache) add(id, name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e := &identityEntry{id: id, name: name, expires: c.now().Add(c.ttl)}
+	if el, ok := c.entries[id]; ok {
+		el.Value = e
+		c.lru.MoveToFront(el)
+		return
+	}
+
+	c.entries[id] = c.lru.PushFront(e)
+	for c.lru.Len() > c.size {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*identityEntry).id)
+	}
+}
+
+// Len returns the amount of cached entries, expired ones included
+func (c *identityCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lru.Len()
+}
+
+// Adds the names of all uid and gid fields of the record to the group
+func (amg *AuditMessageGroup) mapIdentities(am *AuditMessage) {
+	scanFields(am.Data, func(key, value string, quote byte) {
+		if quote != 0 {
+			return
+		}
+
+		var ids map[string]string
+		var resolve func(string) string
+		switch {
+		case uidFields[key]:
+			ids, resolve = amg.UidMap, identities.username
+		case gidFields[key]:
+			ids, resolve = amg.GidMap, identities.groupname
+		default:
+			return
+		}
+
+		// Ids are 32 bit unsigned ints, 4294967295 is an unset id and is resolved like any other
+		if _, err := strconv.ParseUint(value, 10, 32); err != nil {
+			return
+		}
+
+		// Don't bother re-adding if the existing group already has the mapping
+		if _, ok := ids[value]; !ok {
+			ids[value] = resolve(value)
+		}
+	})
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIdentityResolver(t *testing.T) {
+	r := newIdentityResolver(10, time.Minute)
+	assert.Equal(t, "root", r.username("0"), "0 should be root you animal")
+	assert.Equal(t, "UNKNOWN_USER", r.username("-1"), "Expected UNKNOWN_USER")
+	assert.Equal(t, "root", r.groupname("0"))
+	assert.Equal(t, "UNKNOWN_GROUP", r.groupname("-1"), "Expected UNKNOWN_GROUP")
+
+	// Failed lookups are cached as well
+	assert.Equal(t, 2, r.users.Len())
+	assert.Equal(t, 2, r.groups.Len())
+}
+
+func TestIdentityCache(t *testing.T) {
+	lookups := 0
+	c := newIdentityCache(2, time.Minute, "UNKNOWN", func(id string) (string, error) {
+		lookups++
+		if id == "404" {
+			return "", errors.New("unknown id")
+		}
+		return "name-" + id, nil
+	})
+	now := time.Unix(1000, 0)
+	c.now = func() time.Time { return now }
+
+	assert.Equal(t, "name-1", c.resolve("1"))
+	assert.Equal(t, "name-1", c.resolve("1"))
+	assert.Equal(t, 1, lookups, "The second resolve should be cached")
+
+	assert.Equal(t, "UNKNOWN", c.resolve("404"))
+	assert.Equal(t, "UNKNOWN", c.resolve("404"))
+	assert.Equal(t, 2, lookups, "Failed lookups should be cached")
+
+	// 1 was used last, 404 is evicted
+	c.resolve("1")
+	assert.Equal(t, "name-2", c.resolve("2"))
+	assert.Equal(t, 2, c.Len())
+	c.resolve("1")
+	assert.Equal(t, 3, lookups, "1 should still be cached")
+	c.resolve("404")
+	assert.Equal(t, 4, lookups, "404 should have been evicted")
+
+	// Entries expire after the ttl
+	now = now.Add(time.Minute)
+	c.resolve("1")
+	assert.Equal(t, 5, lookups, "1 should have expired")
+	c.resolve("1")
+	assert.Equal(t, 5, lookups)
+
+	// A ttl of 0 never expires
+	c.ttl = 0
+	now = now.Add(24 * time.Hour)
+	c.resolve("1")
+	assert.Equal(t, 5, lookups)
+}
+
+func TestIdentityCacheConcurrent(t *testing.T) {
+	c := newIdentityCache(16, time.Minute, "UNKNOWN", func(id string) (string, error) { return "name-" + id, nil })
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				id := fmt.Sprint((i + j) % 32)
+				assert.Equal(t, "name-"+id, c.resolve(id))
+			}
+		}(i)
+	}
+	wg.Wait()
+	assert.Equal(t, 16, c.Len())
+}
+
+func TestAuditMessageGroupMapIdentities(t *testing.T) {
+	defer func() { identities = newIdentityResolver(IDENTITY_CACHE_SIZE, IDENTITY_CACHE_TTL) }()
+	identities = testIdentities(
+		map[string]string{"0": "root", "1000": "alice", "1001": "bob", "4294967295": "UNKNOWN_USER"},
+		map[string]string{"0": "root", "100": "users"},
+	)
+
+	amg := &AuditMessageGroup{
+		UidMap: make(map[string]string, 2),
+		GidMap: make(map[string]string, 2),
+	}
+	amg.mapIdentities(&AuditMessage{
+		Data: `ppid=1 pid=2 auid=1000 uid=0 gid=100 euid=1001 suid=0 fsuid=0 egid=0 sgid=0 fsgid=0 tty=pts0 comm="uid=5" notuid=6 ouid=4294967295`,
+	})
+
+	assert.Equal(t, map[string]string{"0": "root", "1000": "alice", "1001": "bob", "4294967295": "UNKNOWN_USER"}, amg.UidMap)
+	assert.Equal(t, map[string]string{"0": "root", "100": "users"}, amg.GidMap)
+
+	// Values that are not ids are skipped
+	amg = &AuditMessageGroup{
+		UidMap: make(map[string]string, 2),
+		GidMap: make(map[string]string, 2),
+	}
+	amg.mapIdentities(&AuditMessage{Data: "uid=-1 gid=abc auid=99999999999"})
+	assert.Len(t, amg.UidMap, 0)
+	assert.Len(t, amg.GidMap, 0)
+}
+
+func BenchmarkIdentityResolver(b *testing.B) {
+	r := newIdentityResolver(IDENTITY_CACHE_SIZE, IDENTITY_CACHE_TTL)
+	for i := 0; i < b.N; i++ {
+		_ = r.username("0")
+	}
+}
+
+// Builds a resolver that looks ids up in the given maps instead of the system
+func testIdentities(users, groups map[string]string) *identityResolver {
+	lookup := func(names map[string]string) func(string) (string, error) {
+		return func(id string) (string, error) {
+			if name, ok := names[id]; ok {
+				return name, nil
+			}
+			return "", errors.New("unknown id")
+		}
+	}
+
+	return &identityResolver{
+		users:  newIdentityCache(IDENTITY_CACHE_SIZE, 0, "UNKNOWN_USER", lookup(users)),
+		groups: newIdentityCache(IDENTITY_CACHE_SIZE, 0, "UNKNOWN_GROUP", lookup(groups)),
+	}
+}
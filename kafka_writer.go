@@ -1,13 +1,25 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/confluentinc/confluent-kafka-go/kafka"
 	"github.com/sirupsen/logrus"
 )
 
+// Defaults of the Kafka delivery settings
+const (
+	KAFKA_REDELIVERIES = 3
+)
+
 // Encoder encodes data from auditd to publish it in Kafka.
 type Encoder interface {
 	Encode(data []byte) (value []byte, err error)
@@ -15,80 +27,410 @@ type Encoder interface {
 
 // KafkaConfig defines configuration for Kafka Writer.
 type KafkaConfig struct {
-	Enabled  bool            `yaml:"enabled"`
-	Attempts int             `yaml:"attempts"`
-	Topic    string          `yaml:"topic"`
-	Encoder  EncoderConfig   `yaml:"encoder"`
-	Config   kafka.ConfigMap `yaml:"config"`
+	OutputConfig `yaml:",inline"`
+	Topic        string       `yaml:"topic"`
+	Key          string       `yaml:"key"`
+	Routes       []KafkaRoute `yaml:"routes"`
+
+	// Acks take precedence over the same setting in Config
+	Acks           string `yaml:"acks"`
+	Redeliveries   int    `yaml:"redeliveries"`
+	DeadLetterFile string `yaml:"dead_letter_file"`
+
+	Encoder EncoderConfig   `yaml:"encoder"`
+	Config  kafka.ConfigMap `yaml:"config"`
+}
+
+// KafkaRoute sends the events matching the expression to another topic
+type KafkaRoute struct {
+	Expression string `yaml:"expression"`
+	Topic      string `yaml:"topic"`
+}
+
+type kafkaRoute struct {
+	expr  *filterExpr
+	topic string
+}
+
+// kafkaProducer is the part of *kafka.Producer the writer uses
+type kafkaProducer interface {
+	Produce(msg *kafka.Message, deliveryChan chan kafka.Event) error
+	Events() chan kafka.Event
+	Flush(timeoutMs int) int
+	Close()
+}
+
+// kafkaDelivery follows a message until it is delivered
+type kafkaDelivery struct {
+	attempts int
+	value    []byte // The marshaled message group, only kept for the dead letter file
 }
 
 // KafkaWriter is an io.Writer that writes to the Kafka.
 type KafkaWriter struct {
-	producer *kafka.Producer
-	topic    string
-	enc      Encoder
+	producer     kafkaProducer
+	topic        string
+	key          *keyTemplate // nil produces without a key
+	routes       []*kafkaRoute
+	enc          Encoder
+	redeliveries int            // How many times a message that failed delivery is produced again
+	deadLetter   io.WriteCloser // Messages that could not be delivered at all end up here, nil drops them
 }
 
 // NewKafkaWriter creates new KafkaWrite.
 func NewKafkaWriter(ctx context.Context, cfg KafkaConfig) (*KafkaWriter, error) {
+	var key *keyTemplate
+	if cfg.Key != "" {
+		var err error
+		if key, err = compileKeyTemplate(cfg.Key); err != nil {
+			return nil, fmt.Errorf("Kafka key could not be parsed: %v", err)
+		}
+	}
+
+	routes, err := buildKafkaRoutes(cfg.Routes)
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.Redeliveries < 0 {
+		return nil, fmt.Errorf("Kafka redeliveries must be at least 0, %d provided", cfg.Redeliveries)
+	}
+
+	producerConfig, err := kafkaProducerConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	// The schema is registered for the subject of the default topic, routed events carry the same schema id
 	cfg.Encoder.Topic = cfg.Topic
-	enc, err := NewEncoder(cfg.Encoder)
+	enc, err := NewEncoder(ctx, cfg.Encoder)
 	if err != nil {
 		return nil, err
 	}
 
-	p, err := kafka.NewProducer(&cfg.Config)
+	var deadLetter *os.File
+	if cfg.DeadLetterFile != "" {
+		deadLetter, err = os.OpenFile(cfg.DeadLetterFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open Kafka dead letter file: %v", err)
+		}
+	}
+
+	p, err := kafka.NewProducer(&producerConfig)
 	if err != nil {
+		if deadLetter != nil {
+			deadLetter.Close()
+		}
 		return nil, err
 	}
 	kw := &KafkaWriter{
-		producer: p,
-		topic:    cfg.Topic,
-		enc:      enc,
+		producer:     p,
+		topic:        cfg.Topic,
+		key:          key,
+		routes:       routes,
+		enc:          enc,
+		redeliveries: cfg.Redeliveries,
+	}
+	if deadLetter != nil {
+		kw.deadLetter = deadLetter
 	}
 	go kw.handleResponse(ctx)
 	return kw, nil
 }
 
-// Write writes data to the Kafka, implements io.Writer.
+// Builds the librdkafka configuration, the delivery settings are added to a copy of the configured one
+func kafkaProducerConfig(cfg KafkaConfig) (kafka.ConfigMap, error) {
+	pc := kafka.ConfigMap{}
+	for k, v := range cfg.Config {
+		pc[k] = v
+	}
+
+	if cfg.Acks == "" {
+		return pc, nil
+	}
+
+	acks, ok := map[string]int{"all": -1, "0": 0, "1": 1}[cfg.Acks]
+	if !ok {
+		return nil, fmt.Errorf("Kafka acks must be one of `all`, `0` or `1`, %s provided", cfg.Acks)
+	}
+
+	// Acks are a topic setting, librdkafka 0.9 only takes those from the default topic config
+	tc := kafka.ConfigMap{}
+	switch dtc := pc["default.topic.config"].(type) {
+	case kafka.ConfigMap:
+		for k, v := range dtc {
+			tc[k] = v
+		}
+	case map[interface{}]interface{}:
+		// Nested maps of the yaml config
+		for k, v := range dtc {
+			tc[fmt.Sprint(k)] = v
+		}
+	}
+	tc["request.required.acks"] = acks
+	pc["default.topic.config"] = tc
+
+	return pc, nil
+}
+
+// Write writes a marshaled message group to Kafka, implements io.Writer. Spooled messages are replayed this way
 func (kw *KafkaWriter) Write(value []byte) (int, error) {
-	inFlightLogs.WithLabelValues(hostname).Inc()
-	value, err := kw.enc.Encode(value)
+	msg, err := kw.messageFromJSON(value)
 	if err != nil {
 		return 0, err
 	}
+
+	d := &kafkaDelivery{}
+	if kw.deadLetter != nil {
+		// The caller reuses the buffer of spooled messages
+		d.value = append([]byte(nil), value...)
+	}
+
+	if err := kw.produce(msg, d); err != nil {
+		return 0, err
+	}
+	return len(value), nil
+}
+
+// WriteGroup writes a message group to Kafka, encoders of groups encode it without going through json
+func (kw *KafkaWriter) WriteGroup(group *AuditMessageGroup) error {
+	// The json encoder and the dead letter file need the json
+	var value []byte
+	if _, ok := kw.enc.(groupEncoder); !ok || kw.deadLetter != nil {
+		b, err := json.Marshal(group)
+		if err != nil {
+			return err
+		}
+		value = append(b, '\n')
+	}
+
+	msg, err := kw.message(group, value)
+	if err != nil {
+		return err
+	}
+
+	d := &kafkaDelivery{}
+	if kw.deadLetter != nil {
+		d.value = value
+	}
+	return kw.produce(msg, d)
+}
+
+func (kw *KafkaWriter) produce(msg *kafka.Message, d *kafkaDelivery) error {
+	msg.Opaque = d
+
+	// set delivery channel `nil` because we will read from Events channel
+	inFlightLogs.WithLabelValues(hostname).Inc()
+	if err := kw.producer.Produce(msg, nil); err != nil {
+		inFlightLogs.WithLabelValues(hostname).Dec()
+		return err
+	}
+	return nil
+}
+
+// Builds the Kafka message of a marshaled message group. The topic and key come from the message itself, it is only
+// decoded if one of them or the encoder needs it
+func (kw *KafkaWriter) messageFromJSON(value []byte) (*kafka.Message, error) {
+	var group *AuditMessageGroup
+	if _, ok := kw.enc.(groupEncoder); ok || kw.key != nil || len(kw.routes) > 0 {
+		var err error
+		if group, err = decodeMessageGroup(value); err != nil {
+			return nil, err
+		}
+	}
+
+	return kw.message(group, value)
+}
+
+// Builds the Kafka message of a message group, encoders of groups get the group and the others its json
+func (kw *KafkaWriter) message(group *AuditMessageGroup, value []byte) (*kafka.Message, error) {
+	var encoded []byte
+	var err error
+	if ge, ok := kw.enc.(groupEncoder); ok {
+		encoded, err = ge.EncodeGroup(group)
+	} else {
+		encoded, err = kw.enc.Encode(value)
+	}
+	if err != nil {
+		return nil, err
+	}
+
 	msg := &kafka.Message{
 		TopicPartition: kafka.TopicPartition{
 			Topic:     &kw.topic,
 			Partition: kafka.PartitionAny,
 		},
-		Value: value,
+		Value: encoded,
 	}
 
-	// set delivery channel `nil` because we will read from Events channel
-	if err := kw.producer.Produce(msg, nil); err != nil {
-		return 0, err
+	if kw.key != nil {
+		msg.Key = kw.key.render(group)
 	}
-	return len(value), nil
+
+	// The first route that matches wins, the default topic is used if none does
+	if len(kw.routes) > 0 {
+		c := newExprContext(group)
+		for _, r := range kw.routes {
+			if r.expr.Match(c) {
+				msg.TopicPartition.Topic = &r.topic
+				break
+			}
+		}
+	}
+
+	return msg, nil
+}
+
+// Flush waits until all queued messages are delivered or the timeout expired and returns how many are left
+func (kw *KafkaWriter) Flush(timeout time.Duration) int {
+	return kw.producer.Flush(int(timeout / time.Millisecond))
 }
 
 func (kw *KafkaWriter) handleResponse(ctx context.Context) {
 	for {
 		select {
 		case evt := <-kw.producer.Events():
-
-			if msg, ok := evt.(*kafka.Message); ok {
-				if msg.TopicPartition.Error != nil {
-					logrus.WithError(msg.TopicPartition.Error).Error("failed to producer message")
-					sentErrorsTotal.WithLabelValues(hostname).Inc()
-				}
-
-				inFlightLogs.WithLabelValues(hostname).Dec()
-				sentLatencyNanoseconds.WithLabelValues(hostname).Observe(float64(time.Since(msg.Timestamp)))
+			switch e := evt.(type) {
+			case *kafka.Message:
+				kw.delivered(e)
+			case kafka.Error:
+				logrus.WithError(e).Error("kafka producer error")
 			}
 		case <-ctx.Done():
 			kw.producer.Close()
+			if kw.deadLetter != nil {
+				kw.deadLetter.Close()
+			}
 			return
 		}
 	}
 }
+
+// Handles the delivery report of a message. A message that failed is produced again up to `redeliveries` times,
+// it may end up after messages that were produced later. After that it goes to the dead letter file
+func (kw *KafkaWriter) delivered(msg *kafka.Message) {
+	err := msg.TopicPartition.Error
+	if err == nil {
+		inFlightLogs.WithLabelValues(hostname).Dec()
+		sentLatencyNanoseconds.WithLabelValues(hostname).Observe(float64(time.Since(msg.Timestamp)))
+		return
+	}
+
+	sentErrorsTotal.WithLabelValues(hostname, "kafka").Inc()
+	log := logrus.WithError(err).WithField("topic", *msg.TopicPartition.Topic)
+
+	d, _ := msg.Opaque.(*kafkaDelivery)
+	if d != nil && d.attempts < kw.redeliveries {
+		d.attempts++
+		msg.TopicPartition.Error = nil
+		msg.TopicPartition.Partition = kafka.PartitionAny
+
+		// The message stays in flight
+		if err = kw.producer.Produce(msg, nil); err == nil {
+			log.Warnf("failed to deliver message, producing it again (%d of %d)", d.attempts, kw.redeliveries)
+			return
+		}
+		log = log.WithField("redelivery_error", err)
+	}
+
+	inFlightLogs.WithLabelValues(hostname).Dec()
+
+	if kw.deadLetter == nil || d == nil {
+		log.Error("failed to deliver message, dropping it")
+		droppedLogsTotal.WithLabelValues(hostname, "kafka").Inc()
+		return
+	}
+
+	if _, err := kw.deadLetter.Write(d.value); err != nil {
+		log.WithField("dead_letter_error", err).Error("failed to deliver message and to write it to the dead letter file, dropping it")
+		droppedLogsTotal.WithLabelValues(hostname, "kafka").Inc()
+		return
+	}
+
+	log.Error("failed to deliver message, wrote it to the dead letter file")
+	deadLetterLogsTotal.WithLabelValues(hostname).Inc()
+}
+
+func buildKafkaRoutes(routes []KafkaRoute) ([]*kafkaRoute, error) {
+	var built []*kafkaRoute
+	for i, r := range routes {
+		if r.Topic == "" {
+			return nil, fmt.Errorf("Kafka route %d is missing the `topic` entry", i+1)
+		}
+		if r.Expression == "" {
+			return nil, fmt.Errorf("Kafka route %d is missing the `expression` entry", i+1)
+		}
+
+		expr, err := compileFilterExpr(r.Expression)
+		if err != nil {
+			return nil, fmt.Errorf("`expression` in Kafka route %d could not be parsed: %v", i+1, err)
+		}
+		built = append(built, &kafkaRoute{expr: expr, topic: r.Topic})
+	}
+
+	return built, nil
+}
+
+// keyTemplate builds the key of a message from its fields, like `{{hostname}}` or `{{hostname}}-{{auid}}`.
+// Fields are the ones of filter expressions plus hostname and sequence, the first value of a field is used and
+// missing fields are empty. Messages with the same key end up in the same partition, in order
+type keyTemplate struct {
+	parts []keyPart
+}
+
+type keyPart struct {
+	text  string
+	field string // Set for placeholders
+}
+
+func compileKeyTemplate(source string) (*keyTemplate, error) {
+	t := &keyTemplate{}
+	for rest := source; rest != ""; {
+		open := strings.Index(rest, "{{")
+		if open < 0 {
+			t.parts = append(t.parts, keyPart{text: rest})
+			break
+		}
+		if open > 0 {
+			t.parts = append(t.parts, keyPart{text: rest[:open]})
+		}
+
+		end := strings.Index(rest[open:], "}}")
+		if end < 0 {
+			return nil, fmt.Errorf("unterminated placeholder at %d", len(source)-len(rest)+open)
+		}
+
+		field := strings.TrimSpace(rest[open+2 : open+end])
+		if field == "" {
+			return nil, fmt.Errorf("empty placeholder at %d", len(source)-len(rest)+open)
+		}
+		t.parts = append(t.parts, keyPart{field: field})
+		rest = rest[open+end+2:]
+	}
+
+	return t, nil
+}
+
+func (t *keyTemplate) render(msg *AuditMessageGroup) []byte {
+	var c *exprContext
+	var b bytes.Buffer
+	for _, p := range t.parts {
+		switch p.field {
+		case "":
+			b.WriteString(p.text)
+		case "hostname":
+			b.WriteString(msg.Hostname)
+		case "sequence":
+			b.WriteString(strconv.Itoa(msg.Seq))
+		default:
+			if c == nil {
+				c = newExprContext(msg)
+			}
+			if values := c.values(p.field); len(values) > 0 {
+				b.WriteString(values[0])
+			}
+		}
+	}
+
+	return b.Bytes()
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCompileKeyTemplate(t *testing.T) {
+	k, err := compileKeyTemplate("{{hostname}}")
+	assert.Nil(t, err)
+	assert.Equal(t, []keyPart{{field: "hostname"}}, k.parts)
+
+	k, err = compileKeyTemplate("audit-{{ hostname }}/{{auid}}")
+	assert.Nil(t, err)
+	assert.Equal(t, []keyPart{{text: "audit-"}, {field: "hostname"}, {text: "/"}, {field: "auid"}}, k.parts)
+
+	k, err = compileKeyTemplate("static")
+	assert.Nil(t, err)
+	assert.Equal(t, []keyPart{{text: "static"}}, k.parts)
+
+	_, err = compileKeyTemplate("{{hostname}}-{{auid")
+	assert.EqualError(t, err, "unterminated placeholder at 13")
+
+	_, err = compileKeyTemplate("{{ }}")
+	assert.EqualError(t, err, "empty placeholder at 0")
+}
+
+func TestKeyTemplateRender(t *testing.T) {
+	msg := &AuditMessageGroup{Seq: 12, Hostname: "box", UidMap: map[string]string{}, GidMap: map[string]string{}}
+	msg.AddMessage(&AuditMessage{Type: 1300, Data: `syscall=59 success=yes pid=10 auid=1000 uid=0`})
+	msg.AddMessage(&AuditMessage{Type: 1302, Data: `item=0 name="/bin/ls" auid=1001`})
+
+	k, _ := compileKeyTemplate("{{hostname}}-{{sequence}}-{{auid}}-{{syscall}}-{{missing}}")
+	assert.Equal(t, "box-12-1000-59-", string(k.render(msg)))
+}
+
+func TestKafkaWriterMessage(t *testing.T) {
+	routes, err := buildKafkaRoutes([]KafkaRoute{
+		{Expression: `syscall == "execve"`, Topic: "audit-exec"},
+		{Expression: `type == 1306 || syscall == "connect"`, Topic: "audit-net"},
+		{Expression: `syscall == "execve" || syscall == "connect"`, Topic: "never"},
+	})
+	assert.Nil(t, err)
+
+	key, _ := compileKeyTemplate("{{hostname}}")
+	kw := &KafkaWriter{topic: "audit", key: key, routes: routes, enc: &jsonEncoder{}}
+
+	encode := func(mode string, records ...*AuditMessage) []byte {
+		msg := &AuditMessageGroup{Hostname: "box", UidMap: map[string]string{}, GidMap: map[string]string{}}
+		for _, am := range records {
+			msg.AddMessage(am)
+		}
+		for _, am := range msg.Msgs {
+			am.parseFields(mode)
+		}
+
+		b, err := json.Marshal(msg)
+		assert.Nil(t, err)
+		return b
+	}
+
+	value := encode(FieldsModeOff, &AuditMessage{Type: 1300, Data: `arch=c000003e syscall=59 success=yes`})
+	msg, err := kw.messageFromJSON(value)
+	assert.Nil(t, err)
+	assert.Equal(t, "audit-exec", *msg.TopicPartition.Topic)
+	assert.Equal(t, "box", string(msg.Key))
+	assert.Equal(t, value, msg.Value)
+
+	// Routes also work if only the parsed fields are emitted
+	msg, err = kw.messageFromJSON(encode(
+		FieldsModeInstead,
+		&AuditMessage{Type: 1300, Data: `arch=c000003e syscall=42 success=yes`},
+		&AuditMessage{Type: 1306, Data: `saddr=0200003508080808`},
+	))
+	assert.Nil(t, err)
+	assert.Equal(t, "audit-net", *msg.TopicPartition.Topic)
+
+	msg, err = kw.messageFromJSON(encode(FieldsModeOff, &AuditMessage{Type: 1300, Data: `arch=c000003e syscall=2 success=yes`}))
+	assert.Nil(t, err)
+	assert.Equal(t, "audit", *msg.TopicPartition.Topic)
+
+	_, err = kw.messageFromJSON([]byte("not json"))
+	assert.NotNil(t, err)
+
+	// Syscalls of architectures without a name table are matched by their number
+	routes, err = buildKafkaRoutes([]KafkaRoute{{Expression: `syscall == 42`, Topic: "audit-42"}})
+	assert.Nil(t, err)
+	key, _ = compileKeyTemplate("{{hostname}}-{{syscall}}")
+	unknown := &KafkaWriter{topic: "audit", key: key, routes: routes, enc: &jsonEncoder{}}
+	for _, mode := range []string{FieldsModeOff, FieldsModeInstead} {
+		msg, err = unknown.messageFromJSON(encode(mode, &AuditMessage{Type: 1300, Data: `arch=deadbeef syscall=42 success=yes`}))
+		assert.Nil(t, err)
+		assert.Equal(t, "audit-42", *msg.TopicPartition.Topic)
+		assert.Equal(t, "box-42", string(msg.Key))
+	}
+
+	// Without a key or routes the message is not decoded at all
+	kw = &KafkaWriter{topic: "audit", enc: &jsonEncoder{}}
+	msg, err = kw.messageFromJSON([]byte("not json"))
+	assert.Nil(t, err)
+	assert.Equal(t, "audit", *msg.TopicPartition.Topic)
+	assert.Nil(t, msg.Key)
+}
+
+func TestBuildKafkaRoutes(t *testing.T) {
+	routes, err := buildKafkaRoutes(nil)
+	assert.Nil(t, err)
+	assert.Empty(t, routes)
+
+	_, err = buildKafkaRoutes([]KafkaRoute{{Expression: `syscall == "execve"`}})
+	assert.EqualError(t, err, "Kafka route 1 is missing the `topic` entry")
+
+	_, err = buildKafkaRoutes([]KafkaRoute{{Expression: `syscall == "execve"`, Topic: "a"}, {Topic: "b"}})
+	assert.EqualError(t, err, "Kafka route 2 is missing the `expression` entry")
+
+	_, err = buildKafkaRoutes([]KafkaRoute{{Expression: `syscall ==`, Topic: "a"}})
+	assert.EqualError(t, err, "`expression` in Kafka route 1 could not be parsed: expected a string or a number after == at 10, got end of expression")
+}
+
+type fakeProducer struct {
+	produced []*kafka.Message
+	err      error
+}
+
+func (p *fakeProducer) Produce(msg *kafka.Message, deliveryChan chan kafka.Event) error {
+	if p.err != nil {
+		return p.err
+	}
+	p.produced = append(p.produced, msg)
+	return nil
+}
+
+func (p *fakeProducer) Events() chan kafka.Event { return nil }
+func (p *fakeProducer) Flush(timeoutMs int) int  { return 0 }
+func (p *fakeProducer) Close()                   {}
+
+type closeBuffer struct {
+	bytes.Buffer
+}
+
+func (*closeBuffer) Close() error { return nil }
+
+func TestKafkaWriterDelivery(t *testing.T) {
+	p := &fakeProducer{}
+	dlq := &closeBuffer{}
+	kw := &KafkaWriter{producer: p, topic: "audit", enc: &jsonEncoder{}, redeliveries: 2, deadLetter: dlq}
+
+	line := []byte(`{"sequence":1}` + "\n")
+	n, err := kw.Write(line)
+	assert.Nil(t, err)
+	assert.Equal(t, len(line), n)
+	assert.Len(t, p.produced, 1)
+
+	// The buffer of the caller may be reused
+	line[2] = 'X'
+
+	// Failed deliveries are produced again until they run out of redeliveries
+	msg := p.produced[0]
+	for i := 1; i <= 2; i++ {
+		msg.TopicPartition.Error = errors.New("timed out")
+		msg.TopicPartition.Partition = 3
+		kw.delivered(msg)
+		assert.Len(t, p.produced, i+1)
+		assert.Nil(t, msg.TopicPartition.Error)
+		assert.Equal(t, kafka.PartitionAny, msg.TopicPartition.Partition)
+	}
+
+	msg.TopicPartition.Error = errors.New("timed out")
+	kw.delivered(msg)
+	assert.Len(t, p.produced, 3)
+	assert.Equal(t, `{"sequence":1}`+"\n", dlq.String())
+
+	// Delivered messages are done
+	kw.Write([]byte(`{"sequence":2}` + "\n"))
+	kw.delivered(p.produced[3])
+	assert.Len(t, p.produced, 4)
+	assert.Equal(t, `{"sequence":1}`+"\n", dlq.String())
+
+	// Without a dead letter file the message is dropped, so is a message that can't be produced again
+	kw.deadLetter = nil
+	kw.Write([]byte(`{"sequence":3}` + "\n"))
+	p.err = errors.New("queue full")
+	msg = p.produced[4]
+	msg.TopicPartition.Error = errors.New("timed out")
+	kw.delivered(msg)
+	assert.Len(t, p.produced, 5)
+
+	// Messages that fail to produce or encode are left to the caller
+	_, err = kw.Write([]byte(`{"sequence":4}` + "\n"))
+	assert.EqualError(t, err, "queue full")
+
+	kw.key, _ = compileKeyTemplate("{{hostname}}")
+	_, err = kw.Write([]byte("not json"))
+	assert.NotNil(t, err)
+}
+
+func TestKafkaProducerConfig(t *testing.T) {
+	cfg := KafkaConfig{Config: kafka.ConfigMap{"client.id": "go-audit"}}
+	pc, err := kafkaProducerConfig(cfg)
+	assert.Nil(t, err)
+	assert.Equal(t, kafka.ConfigMap{"client.id": "go-audit"}, pc)
+
+	cfg.Acks = "all"
+	pc, err = kafkaProducerConfig(cfg)
+	assert.Nil(t, err)
+	assert.Equal(t, kafka.ConfigMap{"client.id": "go-audit", "default.topic.config": kafka.ConfigMap{"request.required.acks": -1}}, pc)
+
+	// Acks are added to the configured topic settings
+	cfg.Acks = "0"
+	cfg.Config["default.topic.config"] = map[interface{}]interface{}{"request.required.acks": 1, "message.timeout.ms": 1000}
+	pc, err = kafkaProducerConfig(cfg)
+	assert.Nil(t, err)
+	assert.Equal(t, kafka.ConfigMap{"request.required.acks": 0, "message.timeout.ms": 1000}, pc["default.topic.config"])
+
+	// The configured map is left alone, reloads compare it
+	assert.Equal(t, map[interface{}]interface{}{"request.required.acks": 1, "message.timeout.ms": 1000}, cfg.Config["default.topic.config"])
+
+	cfg.Acks = "some"
+	_, err = kafkaProducerConfig(cfg)
+	assert.EqualError(t, err, "Kafka acks must be one of `all`, `0` or `1`, some provided")
+}
+
+type fakeGroupEncoder struct {
+	jsonEncoder
+}
+
+func (*fakeGroupEncoder) EncodeGroup(msg *AuditMessageGroup) ([]byte, error) {
+	return []byte(fmt.Sprintf("group %d", msg.Seq)), nil
+}
+
+func TestKafkaWriterGroupEncoder(t *testing.T) {
+	// Encoders of message groups get the decoded group instead of the json
+	kw := &KafkaWriter{topic: "audit", enc: &fakeGroupEncoder{}}
+	msg, err := kw.messageFromJSON([]byte(`{"sequence":12}`))
+	assert.Nil(t, err)
+	assert.Equal(t, "group 12", string(msg.Value))
+
+	_, err = kw.messageFromJSON([]byte("not json"))
+	assert.NotNil(t, err)
+
+	// Groups are routed and encoded as they are, the json is only made for the dead letter file
+	p := &fakeProducer{}
+	routes, err := buildKafkaRoutes([]KafkaRoute{{Expression: `syscall == 42`, Topic: "audit-42"}})
+	assert.Nil(t, err)
+	kw = &KafkaWriter{producer: p, topic: "audit", routes: routes, enc: &fakeGroupEncoder{}}
+
+	group := &AuditMessageGroup{Seq: 13, UidMap: map[string]string{}, GidMap: map[string]string{}}
+	group.AddMessage(&AuditMessage{Type: 1300, Data: `arch=deadbeef syscall=42 success=yes`})
+	assert.Nil(t, kw.WriteGroup(group))
+	assert.Equal(t, "group 13", string(p.produced[0].Value))
+	assert.Equal(t, "audit-42", *p.produced[0].TopicPartition.Topic)
+	assert.Nil(t, p.produced[0].Opaque.(*kafkaDelivery).value)
+
+	// Write reports the json it was handed as written, not the encoded message
+	line := []byte(`{"sequence":14}` + "\n")
+	n, err := kw.Write(line)
+	assert.Nil(t, err)
+	assert.Equal(t, len(line), n)
+	assert.Equal(t, "group 14", string(p.produced[1].Value))
+
+	kw.deadLetter = &closeBuffer{}
+	assert.Nil(t, kw.WriteGroup(group))
+	assert.Contains(t, string(p.produced[2].Opaque.(*kafkaDelivery).value), `"sequence":13,`)
+}
@@ -1,7 +1,11 @@
 package main
 
 import (
+	"context"
+	"net"
 	"regexp"
+	"sort"
+	"sync"
 	"syscall"
 	"time"
 
@@ -13,8 +17,9 @@ const (
 )
 
 type AuditMarshaller struct {
+	mu            sync.Mutex // Guards everything below, Consume and the flush timer run concurrently
 	msgs          map[int]*AuditMessageGroup
-	writer        *AuditWriter
+	writers       []*AuditWriter
 	lastSeq       int
 	missed        map[int]bool
 	worstLag      int
@@ -24,19 +29,34 @@ type AuditMarshaller struct {
 	logOutOfOrder bool
 	maxOutOfOrder int
 	attempts      int
+	fieldsMode    string
+	completeAfter time.Duration
 	filters       map[string]map[uint16][]*regexp.Regexp // { syscall: { mtype: [regexp, ...] } }
+	cidrFilters   map[string][]*net.IPNet                // { syscall: [cidr, ...] }
+	exprFilters   []AuditFilter                          // In order, the first match decides
+	enrichers     []enricher
+	samplers      []*sampler // In order, the first match decides
 }
 
+const (
+	FilterActionInclude = "include"
+	FilterActionExclude = "exclude"
+)
+
 type AuditFilter struct {
+	index       int // Position in the config, starting at 1
 	messageType uint16
 	regex       *regexp.Regexp
+	cidr        *net.IPNet
 	syscall     string
+	expr        *filterExpr
+	include     bool
 }
 
 // Create a new marshaller
-func NewAuditMarshaller(w *AuditWriter, eventMin uint16, eventMax uint16, trackMessages, logOOO bool, maxOOO int, filters []AuditFilter) *AuditMarshaller {
+func NewAuditMarshaller(w []*AuditWriter, eventMin uint16, eventMax uint16, trackMessages, logOOO bool, maxOOO int, fieldsMode string, completeAfter time.Duration, filters []AuditFilter) *AuditMarshaller {
 	am := AuditMarshaller{
-		writer:        w,
+		writers:       w,
 		msgs:          make(map[int]*AuditMessageGroup, 5), // It is not typical to have more than 2 message groups at any given time
 		missed:        make(map[int]bool, 10),
 		eventMin:      eventMin,
@@ -44,26 +64,101 @@ func NewAuditMarshaller(w *AuditWriter, eventMin uint16, eventMax uint16, trackM
 		trackMessages: trackMessages,
 		logOutOfOrder: logOOO,
 		maxOutOfOrder: maxOOO,
-		filters:       make(map[string]map[uint16][]*regexp.Regexp),
+		fieldsMode:    fieldsMode,
+		completeAfter: completeAfter,
+		filters:       buildFilters(filters),
+		cidrFilters:   buildCIDRFilters(filters),
+		exprFilters:   buildExprFilters(filters),
 	}
 
+	return &am
+}
+
+// Reload replaces the outputs, filters and parsing settings. Pending message groups are kept and will be written
+// to the new outputs. Returns the outputs that were replaced
+func (a *AuditMarshaller) Reload(w []*AuditWriter, eventMin uint16, eventMax uint16, fieldsMode string, filters []AuditFilter) []*AuditWriter {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	old := a.writers
+	a.writers = w
+	a.eventMin = eventMin
+	a.eventMax = eventMax
+	a.fieldsMode = fieldsMode
+	a.filters = buildFilters(filters)
+	a.cidrFilters = buildCIDRFilters(filters)
+	a.exprFilters = buildExprFilters(filters)
+
+	return old
+}
+
+// SetEnrichers configures the enrichers every message group passes before it is written
+func (a *AuditMarshaller) SetEnrichers(e []enricher) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.enrichers = e
+}
+
+// SetSamplers configures the sampling rules of the message groups the filters keep
+func (a *AuditMarshaller) SetSamplers(s []*sampler) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.samplers = s
+}
+
+func buildFilters(filters []AuditFilter) map[string]map[uint16][]*regexp.Regexp {
+	fm := make(map[string]map[uint16][]*regexp.Regexp)
+
 	for _, filter := range filters {
-		if _, ok := am.filters[filter.syscall]; !ok {
-			am.filters[filter.syscall] = make(map[uint16][]*regexp.Regexp)
+		if filter.regex == nil {
+			continue
+		}
+
+		if _, ok := fm[filter.syscall]; !ok {
+			fm[filter.syscall] = make(map[uint16][]*regexp.Regexp)
 		}
 
-		if _, ok := am.filters[filter.syscall][filter.messageType]; !ok {
-			am.filters[filter.syscall][filter.messageType] = []*regexp.Regexp{}
+		if _, ok := fm[filter.syscall][filter.messageType]; !ok {
+			fm[filter.syscall][filter.messageType] = []*regexp.Regexp{}
 		}
 
-		am.filters[filter.syscall][filter.messageType] = append(am.filters[filter.syscall][filter.messageType], filter.regex)
+		fm[filter.syscall][filter.messageType] = append(fm[filter.syscall][filter.messageType], filter.regex)
 	}
 
-	return &am
+	return fm
+}
+
+func buildCIDRFilters(filters []AuditFilter) map[string][]*net.IPNet {
+	fm := make(map[string][]*net.IPNet)
+
+	for _, filter := range filters {
+		if filter.cidr != nil {
+			fm[filter.syscall] = append(fm[filter.syscall], filter.cidr)
+		}
+	}
+
+	return fm
+}
+
+func buildExprFilters(filters []AuditFilter) []AuditFilter {
+	var ef []AuditFilter
+
+	for _, filter := range filters {
+		if filter.expr != nil {
+			ef = append(ef, filter)
+		}
+	}
+
+	return ef
 }
 
 // Ingests a netlink message and likely prepares it to be logged
 func (a *AuditMarshaller) Consume(nlMsg *syscall.NetlinkMessage) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
 	aMsg := NewAuditMessage(nlMsg)
 
 	if aMsg.Seq == 0 {
@@ -76,6 +171,12 @@ func (a *AuditMarshaller) Consume(nlMsg *syscall.NetlinkMessage) {
 		a.detectMissing(aMsg.Seq)
 	}
 
+	for _, e := range a.enrichers {
+		if o, ok := e.(recordObserver); ok {
+			o.ObserveRecord(aMsg)
+		}
+	}
+
 	if nlMsg.Header.Type < a.eventMin || nlMsg.Header.Type > a.eventMax {
 		// Drop all audit messages that aren't things we care about or end a multi packet event
 		a.flushOld()
@@ -91,12 +192,50 @@ func (a *AuditMarshaller) Consume(nlMsg *syscall.NetlinkMessage) {
 		val.AddMessage(aMsg)
 	} else {
 		// Create a new AuditMessageGroup
-		a.msgs[aMsg.Seq] = NewAuditMessageGroup(aMsg)
+		amg := NewAuditMessageGroup(aMsg)
+		amg.CompleteAfter = time.Now().Add(a.completeAfter)
+		a.msgs[aMsg.Seq] = amg
 	}
 
 	a.flushOld()
 }
 
+// Flushes message groups once their completion window expired, even when no new messages arrive.
+// Runs until the context is done
+func (a *AuditMarshaller) FlushOnTimer(ctx context.Context) {
+	ticker := time.NewTicker(a.completeAfter / 4)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			a.mu.Lock()
+			a.flushOld()
+			a.mu.Unlock()
+		}
+	}
+}
+
+// Flush completes every pending message group, regardless of its completion window, and returns how many there were
+func (a *AuditMarshaller) Flush() int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	seqs := make([]int, 0, len(a.msgs))
+	for seq := range a.msgs {
+		seqs = append(seqs, seq)
+	}
+	sort.Ints(seqs)
+
+	for _, seq := range seqs {
+		a.completeMessage(seq)
+	}
+
+	return len(seqs)
+}
+
 // Outputs any messages that are old enough
 // This is because there is no indication of multi message events coming from kaudit
 func (a *AuditMarshaller) flushOld() {
@@ -108,7 +247,7 @@ func (a *AuditMarshaller) flushOld() {
 	}
 }
 
-// Write a complete message group to the configured output in json format
+// Write a complete message group to the configured outputs in json format
 func (a *AuditMarshaller) completeMessage(seq int) {
 	var msg *AuditMessageGroup
 	var ok bool
@@ -118,21 +257,116 @@ func (a *AuditMarshaller) completeMessage(seq int) {
 		return
 	}
 
-	if a.dropMessage(msg) {
+	for _, e := range a.enrichers {
+		if o, ok := e.(observer); ok {
+			o.Observe(msg)
+		}
+	}
+
+	if a.dropMessage(msg) || a.sampleMessage(msg) {
 		delete(a.msgs, seq)
 		return
 	}
 
-	if err := a.writer.Write(msg); err != nil {
-		logrus.WithError(err).Fatal("failed to write message")
+	// Fields are parsed last, grouping and filters work on the raw data which `instead` drops
+	for _, m := range msg.Msgs {
+		m.parseFields(a.fieldsMode)
+	}
+
+	for _, e := range a.enrichers {
+		e.Enrich(msg)
+	}
+
+	// Every output gets the message, a failing output must not prevent the others from receiving it
+	for _, w := range a.writers {
+		if err := w.Write(msg); err != nil {
+			if w.onFailure == FailurePolicyDrop || err == errOutputStopped {
+				logrus.WithError(err).WithField("output", w.name).Error("failed to write message, dropping it")
+				droppedLogsTotal.WithLabelValues(hostname, w.name).Inc()
+				continue
+			}
+			logrus.WithError(err).WithField("output", w.name).Fatal("failed to write message")
+		}
 	}
 
 	delete(a.msgs, seq)
 }
 
+// The first matching expression filter decides, if none match the filters configured by syscall number or by name
+// drop a group if any of them match
 func (a *AuditMarshaller) dropMessage(msg *AuditMessageGroup) bool {
-	filters, ok := a.filters[msg.Syscall]
-	if !ok {
+	if f := matchExprFilters(a.exprFilters, msg); f != nil {
+		return !f.include
+	}
+
+	for _, syscall := range []string{msg.Syscall, msg.SyscallName} {
+		if syscall == "" {
+			continue
+		}
+
+		if a.matchFilters(a.filters[syscall], msg) || matchCIDRs(a.cidrFilters[syscall], msg.Sockaddr) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// The first sampling rule matching the group decides if it is sampled away
+func (a *AuditMarshaller) sampleMessage(msg *AuditMessageGroup) bool {
+	if len(a.samplers) == 0 {
+		return false
+	}
+
+	c := newExprContext(msg)
+	for _, s := range a.samplers {
+		if !s.matches(c) {
+			continue
+		}
+
+		if s.keep(c) {
+			return false
+		}
+		sampledLogsTotal.WithLabelValues(hostname, s.name).Inc()
+		return true
+	}
+
+	return false
+}
+
+// Returns the first expression filter matching the group, or nil
+func matchExprFilters(filters []AuditFilter, msg *AuditMessageGroup) *AuditFilter {
+	if len(filters) == 0 {
+		return nil
+	}
+
+	c := newExprContext(msg)
+	for i := range filters {
+		if filters[i].expr.Match(c) {
+			return &filters[i]
+		}
+	}
+
+	return nil
+}
+
+func matchCIDRs(cidrs []*net.IPNet, sa *Sockaddr) bool {
+	if len(cidrs) == 0 || sa == nil || sa.Addr == "" {
+		return false
+	}
+
+	ip := net.ParseIP(sa.Addr)
+	for _, cidr := range cidrs {
+		if cidr.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (a *AuditMarshaller) matchFilters(filters map[uint16][]*regexp.Regexp, msg *AuditMessageGroup) bool {
+	if filters == nil {
 		return false
 	}
 
@@ -2,7 +2,9 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"errors"
+	"fmt"
 	"syscall"
 	"testing"
 	"time"
@@ -16,7 +18,7 @@ func TestMarshallerConstants(t *testing.T) {
 
 func TestAuditMarshallerConsume(t *testing.T) {
 	w := &bytes.Buffer{}
-	m := NewAuditMarshaller(NewAuditWriter(w, 1), uint16(1100), uint16(1399), false, false, 0, []AuditFilter{})
+	m := NewAuditMarshaller([]*AuditWriter{NewAuditWriter(w, 1)}, uint16(1100), uint16(1399), false, false, 0, FieldsModeOff, COMPLETE_AFTER, []AuditFilter{})
 
 	// Flush group on 1320
 	m.Consume(&syscall.NetlinkMessage{
@@ -45,7 +47,7 @@ func TestAuditMarshallerConsume(t *testing.T) {
 
 	assert.Equal(
 		t,
-		"{\"sequence\":1,\"timestamp\":10000001000,\"year\":\"1970\",\"month\":\"04\",\"day\":\"26\",\"hour\":\"17\",\"hostname\":\""+hostname+"\",\"messages\":[{\"type\":1300,\"data\":\"hi there\"},{\"type\":1301,\"data\":\"hi there\"}],\"uid_map\":{}}\n",
+		"{\"sequence\":1,\"timestamp\":10000001000,\"time\":\"1970-04-26T17:46:41Z\",\"year\":\"1970\",\"month\":\"04\",\"day\":\"26\",\"hour\":\"17\",\"hostname\":\""+hostname+"\",\"messages\":[{\"type\":1300,\"data\":\"hi there\"},{\"type\":1301,\"data\":\"hi there\"}],\"uid_map\":{},\"gid_map\":{}}\n",
 		w.String(),
 	)
 	assert.Equal(t, 0, len(m.msgs))
@@ -113,7 +115,7 @@ func TestAuditMarshallerConsume(t *testing.T) {
 		m.Consume(new1320("0"))
 	}
 
-	assert.Equal(t, "{\"sequence\":4,\"timestamp\":10000001000,\"year\":\"1970\",\"month\":\"04\",\"day\":\"26\",\"hour\":\"17\",\"hostname\":\""+hostname+"\",\"messages\":[{\"type\":1300,\"data\":\"hi there\"}],\"uid_map\":{}}\n", w.String())
+	assert.Equal(t, "{\"sequence\":4,\"timestamp\":10000001000,\"time\":\"1970-04-26T17:46:41Z\",\"year\":\"1970\",\"month\":\"04\",\"day\":\"26\",\"hour\":\"17\",\"hostname\":\""+hostname+"\",\"messages\":[{\"type\":1300,\"data\":\"hi there\"}],\"uid_map\":{},\"gid_map\":{}}\n", w.String())
 	expected := start.Add(time.Second * 2)
 	assert.True(t, expected.Equal(time.Now()) || expected.Before(time.Now()), "Should have taken at least 2 seconds to flush")
 	assert.Equal(t, 0, len(m.msgs))
@@ -124,7 +126,7 @@ func TestAuditMarshallerCompleteMessage(t *testing.T) {
 	t.Skip()
 	return
 	// lb, elb := hookLogger()
-	// m := NewAuditMarshaller(NewAuditWriter(&FailWriter{}, 1), uint16(1300), uint16(1399), false, false, 0, []AuditFilter{})
+	// m := NewAuditMarshaller([]*AuditWriter{NewAuditWriter(&FailWriter{}, 1)}, uint16(1300), uint16(1399), false, false, 0, FieldsModeOff, COMPLETE_AFTER, []AuditFilter{})
 
 	// m.Consume(&syscall.NetlinkMessage{
 	// 	Header: syscall.NlMsghdr{
@@ -142,6 +144,88 @@ func TestAuditMarshallerCompleteMessage(t *testing.T) {
 	// assert.Equal(t, "!", elb.String())
 }
 
+func TestAuditMarshallerMultipleOutputs(t *testing.T) {
+	w := &bytes.Buffer{}
+	fw := NewAuditWriter(&FailWriter{}, 1)
+	fw.onFailure = FailurePolicyDrop
+	m := NewAuditMarshaller([]*AuditWriter{fw, NewAuditWriter(w, 1)}, uint16(1300), uint16(1399), false, false, 0, FieldsModeOff, COMPLETE_AFTER, []AuditFilter{})
+
+	m.Consume(&syscall.NetlinkMessage{
+		Header: syscall.NlMsghdr{
+			Len:   uint32(44),
+			Type:  uint16(1300),
+			Flags: uint16(0),
+			Seq:   uint32(0),
+			Pid:   uint32(0),
+		},
+		Data: []byte("audit(10000001:1): hi there"),
+	})
+	m.Consume(new1320("1"))
+
+	// The failing output is dropped, the healthy one still gets the message
+	assert.Equal(t, "{\"sequence\":1,\"timestamp\":10000001000,\"time\":\"1970-04-26T17:46:41Z\",\"year\":\"1970\",\"month\":\"04\",\"day\":\"26\",\"hour\":\"17\",\"hostname\":\""+hostname+"\",\"messages\":[{\"type\":1300,\"data\":\"hi there\"}],\"uid_map\":{},\"gid_map\":{}}\n", w.String())
+	assert.Equal(t, 0, len(m.msgs))
+}
+
+func TestAuditMarshallerFlushOnTimer(t *testing.T) {
+	w := &bytes.Buffer{}
+	m := NewAuditMarshaller([]*AuditWriter{NewAuditWriter(w, 1)}, uint16(1300), uint16(1399), false, false, 0, FieldsModeOff, 100*time.Millisecond, []AuditFilter{})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go m.FlushOnTimer(ctx)
+
+	m.Consume(&syscall.NetlinkMessage{
+		Header: syscall.NlMsghdr{
+			Len:   uint32(44),
+			Type:  uint16(1300),
+			Flags: uint16(0),
+			Seq:   uint32(0),
+			Pid:   uint32(0),
+		},
+		Data: []byte("audit(10000001:1): hi there"),
+	})
+
+	// Nothing else arrives, the timer has to flush the group
+	time.Sleep(300 * time.Millisecond)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	assert.Equal(t, 0, len(m.msgs))
+	assert.Contains(t, w.String(), "\"sequence\":1,")
+}
+
+func TestAuditMarshallerFlush(t *testing.T) {
+	w := &bytes.Buffer{}
+	m := NewAuditMarshaller([]*AuditWriter{NewAuditWriter(w, 1)}, uint16(1300), uint16(1399), false, false, 0, FieldsModeOff, COMPLETE_AFTER, []AuditFilter{})
+
+	for _, seq := range []string{"2", "1"} {
+		m.Consume(&syscall.NetlinkMessage{
+			Header: syscall.NlMsghdr{
+				Len:   uint32(44),
+				Type:  uint16(1300),
+				Flags: uint16(0),
+				Seq:   uint32(0),
+				Pid:   uint32(0),
+			},
+			Data: []byte("audit(10000001:" + seq + "): hi there"),
+		})
+	}
+
+	assert.Equal(t, 2, len(m.msgs))
+	assert.Equal(t, 2, m.Flush())
+	assert.Equal(t, 0, len(m.msgs))
+
+	// Groups are written in sequence order
+	lines := bytes.Split(bytes.TrimSpace(w.Bytes()), []byte("\n"))
+	if assert.Len(t, lines, 2) {
+		assert.Contains(t, string(lines[0]), "\"sequence\":1,")
+		assert.Contains(t, string(lines[1]), "\"sequence\":2,")
+	}
+
+	assert.Equal(t, 0, m.Flush())
+}
+
 func new1320(seq string) *syscall.NetlinkMessage {
 	return &syscall.NetlinkMessage{
 		Header: syscall.NlMsghdr{
@@ -155,6 +239,150 @@ func new1320(seq string) *syscall.NetlinkMessage {
 	}
 }
 
+func TestAuditMarshallerFilters(t *testing.T) {
+	w := &bytes.Buffer{}
+	filters, err := createFilters(&Config{Filters: []Filter{
+		{Syscall: "bind", MessageType: 1306, Regex: "saddr=10"},
+		{Syscall: "59", MessageType: 1309, Regex: "ls"},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := NewAuditMarshaller([]*AuditWriter{NewAuditWriter(w, 1)}, uint16(1300), uint16(1399), false, false, 0, FieldsModeOff, COMPLETE_AFTER, filters)
+
+	consume := func(seq string, mtype uint16, data string) {
+		m.Consume(&syscall.NetlinkMessage{
+			Header: syscall.NlMsghdr{Type: mtype},
+			Data:   []byte("audit(10000001:" + seq + "): " + data),
+		})
+	}
+
+	// Filtered by name
+	consume("1", 1300, "arch=c000003e syscall=49 success=yes")
+	consume("1", 1306, "saddr=100007")
+	// Filtered by number
+	consume("2", 1300, "arch=c000003e syscall=59 success=yes")
+	consume("2", 1309, "argc=1 a0=ls")
+	// Filtered, bind is 361 on i386 but the name still matches
+	consume("3", 1300, "arch=40000003 syscall=361 success=yes")
+	consume("3", 1306, "saddr=100007")
+	// Not filtered, the regex does not match
+	consume("4", 1300, "arch=c000003e syscall=49 success=yes")
+	consume("4", 1306, "saddr=020000")
+
+	assert.Equal(t, 4, m.Flush())
+	assert.NotContains(t, w.String(), `"sequence":1,`)
+	assert.NotContains(t, w.String(), `"sequence":2,`)
+	assert.NotContains(t, w.String(), `"sequence":3,`)
+	assert.Contains(t, w.String(), `"sequence":4,`)
+	assert.Contains(t, w.String(), `"syscall_name":"bind"`)
+}
+
+func TestAuditMarshallerCIDRFilters(t *testing.T) {
+	w := &bytes.Buffer{}
+	filters, err := createFilters(&Config{Filters: []Filter{
+		{Syscall: "connect", CIDR: "10.0.0.0/8"},
+		{Syscall: "connect", CIDR: "fd00::/8"},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := NewAuditMarshaller([]*AuditWriter{NewAuditWriter(w, 1)}, uint16(1300), uint16(1399), false, false, 0, FieldsModeOff, COMPLETE_AFTER, filters)
+
+	consume := func(seq string, mtype uint16, data string) {
+		m.Consume(&syscall.NetlinkMessage{
+			Header: syscall.NlMsghdr{Type: mtype},
+			Data:   []byte("audit(10000001:" + seq + "): " + data),
+		})
+	}
+
+	// 10.1.2.3:443
+	consume("1", 1300, "arch=c000003e syscall=42 success=yes")
+	consume("1", 1306, "saddr=020001BB0A0102030000000000000000")
+	// fd00::1:53
+	consume("2", 1300, "arch=c000003e syscall=42 success=yes")
+	consume("2", 1306, "saddr=0A00003500000000FD00000000000000000000000000000100000000")
+	// 192.168.1.1:443 is not in the filtered ranges
+	consume("3", 1300, "arch=c000003e syscall=42 success=yes")
+	consume("3", 1306, "saddr=020001BBC0A801010000000000000000")
+	// 10.1.2.3:443 but not a connect
+	consume("4", 1300, "arch=c000003e syscall=49 success=yes")
+	consume("4", 1306, "saddr=020001BB0A0102030000000000000000")
+
+	assert.Equal(t, 4, m.Flush())
+	assert.NotContains(t, w.String(), `"sequence":1,`)
+	assert.NotContains(t, w.String(), `"sequence":2,`)
+	assert.Contains(t, w.String(), `"sequence":3,`)
+	assert.Contains(t, w.String(), `"sequence":4,`)
+	assert.Contains(t, w.String(), `"sockaddr":{"family":"inet","addr":"192.168.1.1","port":443}`)
+}
+
+func TestAuditMarshallerExprFilters(t *testing.T) {
+	w := &bytes.Buffer{}
+	filters, err := createFilters(&Config{Filters: []Filter{
+		{Expression: `syscall == "connect" && saddr.addr in "10.0.0.0/8"`, Action: FilterActionInclude},
+		{Expression: `syscall == "connect"`},
+		{Syscall: "execve", MessageType: 1309, Regex: "ls"},
+		{Expression: `comm == "ls"`, Action: FilterActionInclude},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := NewAuditMarshaller([]*AuditWriter{NewAuditWriter(w, 1)}, uint16(1300), uint16(1399), false, false, 0, FieldsModeOff, COMPLETE_AFTER, filters)
+
+	consume := func(seq string, mtype uint16, data string) {
+		m.Consume(&syscall.NetlinkMessage{
+			Header: syscall.NlMsghdr{Type: mtype},
+			Data:   []byte("audit(10000001:" + seq + "): " + data),
+		})
+	}
+
+	// Included by the first filter before the second one excludes every connect
+	consume("1", 1300, "arch=c000003e syscall=42 success=yes comm=\"curl\"")
+	consume("1", 1306, "saddr=020001BB0A0102030000000000000000")
+	// Excluded by the second filter
+	consume("2", 1300, "arch=c000003e syscall=42 success=yes comm=\"curl\"")
+	consume("2", 1306, "saddr=020001BBC0A801010000000000000000")
+	// The regex filter is only checked if no expression matches
+	consume("3", 1300, "arch=c000003e syscall=59 success=yes comm=\"ls\"")
+	consume("3", 1309, "argc=1 a0=\"ls\"")
+	consume("4", 1300, "arch=c000003e syscall=59 success=yes comm=\"cat\"")
+	consume("4", 1309, "argc=1 a0=\"ls\"")
+
+	assert.Equal(t, 4, m.Flush())
+	assert.Contains(t, w.String(), `"sequence":1,`)
+	assert.NotContains(t, w.String(), `"sequence":2,`)
+	assert.Contains(t, w.String(), `"sequence":3,`)
+	assert.NotContains(t, w.String(), `"sequence":4,`)
+}
+
+func TestAuditMarshallerEnrichers(t *testing.T) {
+	w := &bytes.Buffer{}
+	m := NewAuditMarshaller([]*AuditWriter{NewAuditWriter(w, 1)}, uint16(1300), uint16(1399), false, false, 0, FieldsModeOff, COMPLETE_AFTER, []AuditFilter{})
+	e := &pidEnricher{}
+	m.SetEnrichers([]enricher{e})
+
+	m.Consume(&syscall.NetlinkMessage{
+		Header: syscall.NlMsghdr{Type: 1300},
+		Data:   []byte("audit(10000001:1): arch=c000003e syscall=59 success=yes ppid=1 pid=42 auid=4294967295"),
+	})
+	assert.Equal(t, 1, m.Flush())
+	assert.Equal(t, []int{42}, e.pids)
+	assert.Contains(t, w.String(), `"process":{"systemd_unit":"pid-42.service"}`)
+}
+
+type pidEnricher struct {
+	pids []int
+}
+
+func (e *pidEnricher) Enrich(msg *AuditMessageGroup) {
+	e.pids = append(e.pids, msg.Pid)
+	msg.Process = &ProcessContext{SystemdUnit: fmt.Sprintf("pid-%d.service", msg.Pid)}
+}
+
 type FailWriter struct{}
 
 func (f *FailWriter) Write(p []byte) (n int, err error) {
@@ -7,8 +7,24 @@ var (
 		prometheus.CounterOpts{
 			Namespace: "goaudit",
 			Name:      "sent_logs_total",
-			Help:      "The amount of logs that were sent to Kafka.",
-		}, []string{"host"},
+			Help:      "The amount of logs that were sent to an output.",
+		}, []string{"host", "output"},
+	)
+
+	droppedLogsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "goaudit",
+			Name:      "dropped_logs_total",
+			Help:      "The amount of logs an output dropped because it failed to write them.",
+		}, []string{"host", "output"},
+	)
+
+	sampledLogsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "goaudit",
+			Name:      "sampled_logs_total",
+			Help:      "The amount of logs a sampling rule dropped.",
+		}, []string{"host", "rule"},
 	)
 
 	inFlightLogs = prometheus.NewGaugeVec(
@@ -23,8 +39,8 @@ var (
 		prometheus.CounterOpts{
 			Namespace: "goaudit",
 			Name:      "sent_error_total",
-			Help:      "The amount of errors while sending logs to Kafka.",
-		}, []string{"host"},
+			Help:      "The amount of errors while sending logs to an output.",
+		}, []string{"host", "output"},
 	)
 
 	sentLatencyNanoseconds = prometheus.NewSummaryVec(
@@ -34,11 +50,132 @@ var (
 			Help:      "The latecncy to send log to Kafka.",
 		}, []string{"host"},
 	)
+
+	deadLetterLogsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "goaudit",
+			Subsystem: "kafka",
+			Name:      "dead_letter_logs_total",
+			Help:      "The amount of logs written to the Kafka dead letter file after failing delivery.",
+		}, []string{"host"},
+	)
+
+	processTableSize = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "goaudit",
+			Subsystem: "process_table",
+			Name:      "processes",
+			Help:      "The amount of processes tracked for the ancestry of events.",
+		}, []string{"host"},
+	)
+
+	processTableEvictedTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "goaudit",
+			Subsystem: "process_table",
+			Name:      "evicted_total",
+			Help:      "The amount of processes evicted from a full process table.",
+		}, []string{"host"},
+	)
+
+	kernelLost = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "goaudit",
+			Subsystem: "kernel",
+			Name:      "lost",
+			Help:      "The amount of events the kernel dropped since boot.",
+		}, []string{"host"},
+	)
+
+	kernelBacklog = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "goaudit",
+			Subsystem: "kernel",
+			Name:      "backlog",
+			Help:      "The amount of events waiting in the kernel queue.",
+		}, []string{"host"},
+	)
+
+	kernelBacklogLimit = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "goaudit",
+			Subsystem: "kernel",
+			Name:      "backlog_limit",
+			Help:      "The maximum amount of events the kernel queues.",
+		}, []string{"host"},
+	)
+
+	kernelRateLimit = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "goaudit",
+			Subsystem: "kernel",
+			Name:      "rate_limit",
+			Help:      "The maximum amount of events per second the kernel emits, 0 is unlimited.",
+		}, []string{"host"},
+	)
+
+	kernelEnabled = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "goaudit",
+			Subsystem: "kernel",
+			Name:      "enabled",
+			Help:      "Whether kernel auditing is disabled (0), enabled (1) or enabled and locked (2).",
+		}, []string{"host"},
+	)
+
+	spoolDepth = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "goaudit",
+			Subsystem: "spool",
+			Name:      "depth",
+			Help:      "The amount of logs waiting in the spool of an output.",
+		}, []string{"host", "output"},
+	)
+
+	spoolBytes = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "goaudit",
+			Subsystem: "spool",
+			Name:      "bytes",
+			Help:      "The size of the spool segments of an output on disk.",
+		}, []string{"host", "output"},
+	)
+
+	spoolCorruptedTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "goaudit",
+			Subsystem: "spool",
+			Name:      "corrupted_total",
+			Help:      "The amount of logs lost because a spool segment was corrupted.",
+		}, []string{"host", "output"},
+	)
 )
 
 func init() {
 	prometheus.MustRegister(sentLogsTotal)
 	prometheus.MustRegister(inFlightLogs)
 	prometheus.MustRegister(sentErrorsTotal)
+	prometheus.MustRegister(droppedLogsTotal)
+	prometheus.MustRegister(sampledLogsTotal)
 	prometheus.MustRegister(sentLatencyNanoseconds)
+	prometheus.MustRegister(deadLetterLogsTotal)
+	prometheus.MustRegister(kernelLost)
+	prometheus.MustRegister(kernelBacklog)
+	prometheus.MustRegister(kernelBacklogLimit)
+	prometheus.MustRegister(kernelRateLimit)
+	prometheus.MustRegister(kernelEnabled)
+	prometheus.MustRegister(spoolDepth)
+	prometheus.MustRegister(spoolBytes)
+	prometheus.MustRegister(spoolCorruptedTotal)
+	prometheus.MustRegister(processTableSize)
+	prometheus.MustRegister(processTableEvictedTotal)
+}
+
+// updateKernelMetrics exports the kernel audit status
+func updateKernelMetrics(s *AuditStatusPayload) {
+	kernelLost.WithLabelValues(hostname).Set(float64(s.Lost))
+	kernelBacklog.WithLabelValues(hostname).Set(float64(s.Backlog))
+	kernelBacklogLimit.WithLabelValues(hostname).Set(float64(s.BacklogLimit))
+	kernelRateLimit.WithLabelValues(hostname).Set(float64(s.RateLimit))
+	kernelEnabled.WithLabelValues(hostname).Set(float64(s.Enabled))
 }
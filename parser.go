@@ -2,8 +2,10 @@ package main
 
 import (
 	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
 	"os"
-	"os/user"
 	"strconv"
 	"strings"
 	"syscall"
@@ -12,29 +14,58 @@ import (
 	"github.com/sirupsen/logrus"
 )
 
-var uidMap = map[string]string{}
 var headerEndChar = []byte{")"[0]}
 var headerSepChar = byte(':')
 var spaceChar = byte(' ')
 
 var hostname = getHostname()
 
+// The timezone of the date fields of a message group, configured with `events.timezone`
+var timezone = time.Local
+
 const (
 	HEADER_MIN_LENGTH = 7               // Minimum length of an audit header
 	HEADER_START_POS  = 6               // Position in the audit header that the data starts
 	COMPLETE_AFTER    = time.Second * 2 // Log a message after this time or EOE
+
+	// Shortest configurable completion window, the flush timer ticks at a quarter of it
+	COMPLETE_AFTER_MIN = time.Millisecond
 )
 
+// Defines how the parsed fields of a record are emitted.
+const (
+	FieldsModeOff       = "off"       // Only emit the raw record as `data`
+	FieldsModeAlongside = "alongside" // Emit `fields` next to `data`
+	FieldsModeInstead   = "instead"   // Emit `fields` and drop `data`
+)
+
+// Fields whose values the kernel hex encodes when they contain spaces, quotes or control characters
+var untrustedFields = map[string]bool{
+	"acct":      true,
+	"cmd":       true,
+	"comm":      true,
+	"cwd":       true,
+	"data":      true,
+	"exe":       true,
+	"key":       true,
+	"name":      true,
+	"ocomm":     true,
+	"path":      true,
+	"proctitle": true,
+}
+
 type AuditMessage struct {
-	Type      uint16 `json:"type"`
-	Data      string `json:"data"`
-	Seq       int    `json:"-"`
-	AuditTime string `json:"-"`
+	Type      uint16            `json:"type"`
+	Data      string            `json:"data,omitempty"`
+	Fields    map[string]string `json:"fields,omitempty"`
+	Seq       int               `json:"-"`
+	AuditTime string            `json:"-"`
 }
 
 type AuditMessageGroup struct {
 	Seq           int               `json:"sequence"`
 	AuditTime     int64             `json:"timestamp"`
+	AuditTimeISO  string            `json:"time"`
 	AuditYear     string            `json:"year"`
 	AuditMonth    string            `json:"month"`
 	AuditDay      string            `json:"day"`
@@ -43,22 +74,36 @@ type AuditMessageGroup struct {
 	CompleteAfter time.Time         `json:"-"`
 	Msgs          []*AuditMessage   `json:"messages"`
 	UidMap        map[string]string `json:"uid_map"`
+	GidMap        map[string]string `json:"gid_map"`
 	Syscall       string            `json:"-"`
+	Pid           int               `json:"-"`
+	Ppid          int               `json:"-"`
+	Ses           string            `json:"-"`
+	SyscallName   string            `json:"syscall_name,omitempty"`
+	CommandLine   string            `json:"command_line,omitempty"`
+	Argv          []string          `json:"argv,omitempty"`
+	Sockaddr      *Sockaddr         `json:"sockaddr,omitempty"`
+	Process       *ProcessContext   `json:"process,omitempty"`
+	Ancestry      []*Ancestor       `json:"ancestry,omitempty"`
+	Session       *Session          `json:"session,omitempty"`
+	execve        *execveArgs
 }
 
 // Creates a new message group from the details parsed from the message
 func NewAuditMessageGroup(am *AuditMessage) *AuditMessageGroup {
-	auditUnixTime, err := strconv.ParseInt(am.AuditTime, 10, 64)
+	auditTime, err := parseAuditTime(am.AuditTime)
 	if err != nil {
-		auditUnixTime = time.Now().Unix()
+		logrus.WithError(err).WithField("sequence", am.Seq).Warn("failed to parse the audit time, using the current time")
+		auditTime = time.Now()
 	}
-	auditTime := time.Unix(auditUnixTime, 0)
+	auditTime = auditTime.In(timezone)
 
 	//TODO: allocating 6 msgs per group is lame and we _should_ know ahead of time roughly how many we need
 	amg := &AuditMessageGroup{
 		Seq: am.Seq,
 		// send time in milliseconds
-		AuditTime:     auditUnixTime * 1000,
+		AuditTime:     auditTime.UnixNano() / int64(time.Millisecond),
+		AuditTimeISO:  auditTime.Format(time.RFC3339Nano),
 		AuditYear:     auditTime.Format("2006"),
 		AuditMonth:    auditTime.Format("01"),
 		AuditDay:      auditTime.Format("02"),
@@ -66,6 +111,7 @@ func NewAuditMessageGroup(am *AuditMessage) *AuditMessageGroup {
 		Hostname:      hostname,
 		CompleteAfter: time.Now().Add(COMPLETE_AFTER),
 		UidMap:        make(map[string]string, 2), // Usually only 2 individual uids per execve
+		GidMap:        make(map[string]string, 2),
 		Msgs:          make([]*AuditMessage, 0, 6),
 	}
 
@@ -84,6 +130,175 @@ func NewAuditMessage(nlm *syscall.NetlinkMessage) *AuditMessage {
 	}
 }
 
+// Parses the record data into fields and applies the emitting mode
+func (am *AuditMessage) parseFields(mode string) {
+	if mode == FieldsModeOff || mode == "" {
+		return
+	}
+
+	am.Fields = parseFields(am.Type, am.Data)
+	if mode == FieldsModeInstead {
+		am.Data = ""
+	}
+}
+
+// Validates the configured fields mode, an empty mode means off
+func validateFieldsMode(mode string) (string, error) {
+	switch mode {
+	case "":
+		return FieldsModeOff, nil
+	case FieldsModeOff, FieldsModeAlongside, FieldsModeInstead:
+		return mode, nil
+	}
+	return "", fmt.Errorf("parser fields must be one of `off`, `alongside` or `instead`, %s provided", mode)
+}
+
+// Splits the `key=value` pairs of a record into a map, values stay strings whatever their type.
+// Quoted values are unquoted, hex encoded values of untrusted fields are decoded and the
+// `msg='...'` section of user space records is parsed as well, without overriding kernel provided fields
+func parseFields(mtype uint16, data string) map[string]string {
+	fields := make(map[string]string, strings.Count(data, "="))
+	parseFieldsInto(fields, mtype, data)
+	return fields
+}
+
+func parseFieldsInto(fields map[string]string, mtype uint16, data string) {
+	scanFields(data, func(key, value string, quote byte) {
+		if quote == '\'' && key == "msg" {
+			parseFieldsInto(fields, mtype, value)
+			return
+		}
+
+		if quote == 0 && isUntrustedField(mtype, key) {
+			value = decodeHexValue(value)
+		}
+
+		if _, ok := fields[key]; !ok {
+			fields[key] = value
+		}
+	})
+}
+
+// Calls fn for every `key=value` pair of the record data in order. Quoted values are passed without their quotes
+// and the quote character, unquoted values with a quote of 0. Tokens without an = sign are skipped
+func scanFields(data string, fn func(key, value string, quote byte)) {
+	for i := 0; i < len(data); {
+		if data[i] == spaceChar {
+			i++
+			continue
+		}
+
+		// Read the key
+		eq := strings.IndexAny(data[i:], "= ")
+		if eq < 0 {
+			return
+		}
+		if data[i+eq] == spaceChar {
+			i += eq
+			continue
+		}
+		key := data[i : i+eq]
+		i += eq + 1
+
+		var value string
+		var quote byte
+		if i < len(data) && (data[i] == '"' || data[i] == '\'') {
+			quote = data[i]
+			end := strings.IndexByte(data[i+1:], quote)
+			if end < 0 {
+				end = len(data) - i - 1
+			}
+			value = data[i+1 : i+1+end]
+			i += end + 2
+		} else {
+			end := strings.IndexByte(data[i:], spaceChar)
+			if end < 0 {
+				end = len(data) - i
+			}
+			value = data[i : i+end]
+			i += end
+		}
+
+		fn(key, value, quote)
+	}
+}
+
+// Reports if the kernel may have hex encoded the value of this field
+func isUntrustedField(mtype uint16, key string) bool {
+	if untrustedFields[key] {
+		return true
+	}
+
+	// EXECVE arguments are a0, a1, ...; in other records these are raw syscall arguments
+	if mtype == 1309 && len(key) > 1 && key[0] == 'a' {
+		_, err := strconv.Atoi(key[1:])
+		return err == nil
+	}
+
+	return false
+}
+
+// Decodes a hex encoded value, values that are not hex encoded are returned untouched.
+// NUL separators, as used by PROCTITLE, are turned into spaces
+func decodeHexValue(value string) string {
+	if len(value) == 0 || len(value)%2 != 0 || value == "(null)" {
+		return value
+	}
+
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		if !(c >= '0' && c <= '9' || c >= 'A' && c <= 'F') {
+			return value
+		}
+	}
+
+	b, err := hex.DecodeString(value)
+	if err != nil {
+		return value
+	}
+
+	return strings.Replace(strings.TrimRight(string(b), "\x00"), "\x00", " ", -1)
+}
+
+// Parses the `seconds.fraction` time of an audit header, the kernel sends milliseconds but any precision
+// up to nanoseconds is kept
+func parseAuditTime(value string) (time.Time, error) {
+	secs, frac := value, ""
+	if i := strings.IndexByte(value, '.'); i >= 0 {
+		secs, frac = value[:i], value[i+1:]
+	}
+
+	sec, err := strconv.ParseInt(secs, 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid audit time %q", value)
+	}
+
+	var nsec int64
+	if frac != "" {
+		for i := 0; i < 9; i++ {
+			nsec *= 10
+			if i >= len(frac) {
+				continue
+			}
+			if frac[i] < '0' || frac[i] > '9' {
+				return time.Time{}, fmt.Errorf("invalid audit time %q", value)
+			}
+			nsec += int64(frac[i] - '0')
+		}
+	}
+
+	return time.Unix(sec, nsec), nil
+}
+
+// Loads the timezone of the date fields, `Local` is the timezone of the host
+func loadTimezone(name string) (*time.Location, error) {
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return nil, fmt.Errorf("events timezone %s could not be loaded: %v", name, err)
+	}
+	return loc, nil
+}
+
 // Gets the timestamp and audit sequence id from a netlink message
 func parseAuditHeader(msg *syscall.NetlinkMessage) (time string, seq int) {
 	headerStop := bytes.Index(msg.Data, headerEndChar)
@@ -111,98 +326,100 @@ func (amg *AuditMessageGroup) AddMessage(am *AuditMessage) {
 	amg.Msgs = append(amg.Msgs, am)
 	//TODO: need to find more message types that won't contain uids, also make these constants
 	switch am.Type {
-	case 1309, 1307, 1306:
+	case 1309:
+		// Don't map uids here
+		amg.addExecveArgs(am)
+	case 1306:
 		// Don't map uids here
+		amg.parseSockaddr(am)
+	case 1307:
+		// Don't map uids here
+	case 1327:
+		amg.addProctitle(am)
+		amg.mapIdentities(am)
 	case 1300:
 		amg.findSyscall(am)
-		amg.mapUids(am)
+		amg.findPid(am)
+		amg.mapIdentities(am)
 	default:
-		amg.mapUids(am)
+		amg.findPid(am)
+		amg.mapIdentities(am)
 	}
 }
 
-// Find all `uid=` occurrences in a message and adds the username to the UidMap object
-func (amg *AuditMessageGroup) mapUids(am *AuditMessage) {
-	data := am.Data
-	start := 0
-	end := 0
-
-	for {
-		if start = strings.Index(data, "uid="); start < 0 {
-			break
-		}
-
-		// Progress the start point beyon the = sign
-		start += 4
-		if end = strings.IndexByte(data[start:], spaceChar); end < 0 {
-			// There was no ending space, maybe the uid is at the end of the line
-			end = len(data) - start
-
-			// If the end of the line is greater than 5 characters away (overflows a 16 bit uint) then it can't be a uid
-			if end > 5 {
-				break
-			}
-		}
-
-		uid := data[start : start+end]
-
-		// Don't bother re-adding if the existing group already has the mapping
-		if _, ok := amg.UidMap[uid]; !ok {
-			amg.UidMap[uid] = getUsername(data[start : start+end])
-		}
-
-		// Find the next uid= if we have space for one
-		next := start + end + 1
-		if next >= len(data) {
-			break
-		}
-
-		data = data[next:]
+// Finds the process of the group, SYSCALL records carry the pid, ppid and login session, most other records only
+// the pid
+func (amg *AuditMessageGroup) findPid(am *AuditMessage) {
+	if amg.Pid != 0 {
+		return
 	}
 
+	amg.Pid, _ = strconv.Atoi(recordValue(am.Data, "pid="))
+	amg.Ppid, _ = strconv.Atoi(recordValue(am.Data, "ppid="))
+	amg.Ses = recordValue(am.Data, "ses=")
 }
 
 func (amg *AuditMessageGroup) findSyscall(am *AuditMessage) {
-	data := am.Data
-	start := 0
-	end := 0
+	nr := recordValue(am.Data, "syscall=")
 
-	if start = strings.Index(data, "syscall="); start < 0 {
+	// A syscall id overflowing a 16 bit uint is not a syscall id
+	if nr == "" || len(nr) > 5 {
 		return
 	}
 
-	// Progress the start point beyond the = sign
-	start += 8
-	if end = strings.IndexByte(data[start:], spaceChar); end < 0 {
-		// There was no ending space, maybe the syscall id is at the end of the line
-		end = len(data) - start
+	amg.Syscall = nr
+	amg.SyscallName = syscallName(recordValue(am.Data, "arch="), nr)
+}
 
-		// If the end of the line is greater than 5 characters away (overflows a 16 bit uint) then it can't be a syscall id
-		if end > 5 {
-			return
+// decodeMessageGroup decodes a group that was written as json, like a spooled one. The syscall number is not
+// written, it is found again in the SYSCALL record so routes and keys work the same as on the original group
+func decodeMessageGroup(b []byte) (*AuditMessageGroup, error) {
+	amg := &AuditMessageGroup{}
+	if err := json.Unmarshal(b, amg); err != nil {
+		return nil, err
+	}
+
+	for _, am := range amg.Msgs {
+		if am.Type != 1300 {
+			continue
+		}
+
+		// Records that only kept their parsed fields have no data
+		if am.Data == "" {
+			amg.Syscall = am.Fields["syscall"]
+		} else {
+			amg.Syscall = recordValue(am.Data, "syscall=")
 		}
+		break
 	}
 
-	amg.Syscall = data[start : start+end]
+	return amg, nil
 }
 
-// Gets a username for a user id
-func getUsername(uid string) string {
-	uname := "UNKNOWN_USER"
+// Finds the unquoted value of a `key=value` pair in the record data
+func recordValue(data string, key string) string {
+	start := 0
+	for {
+		i := strings.Index(data[start:], key)
+		if i < 0 {
+			return ""
+		}
 
-	// Make sure we have a uid element to work with.
-	// Give a default value in case we don't find something.
-	if lUser, ok := uidMap[uid]; ok {
-		uname = lUser
-	} else {
-		lUser, err := user.LookupId(uid)
-		if err == nil {
-			uname = lUser.Username
+		// The key must start a field, `syscall=` is not `xsyscall=`
+		start += i
+		if start == 0 || data[start-1] == spaceChar {
+			break
 		}
-		uidMap[uid] = uname
+		start += len(key)
+	}
+
+	start += len(key)
+	end := strings.IndexByte(data[start:], spaceChar)
+	if end < 0 {
+		return data[start:]
 	}
 
-	return uname
+	return data[start : start+end]
 }
 
 func getHostname() string {
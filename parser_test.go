@@ -35,9 +35,8 @@ func TestNewAuditMessage(t *testing.T) {
 }
 
 func TestAuditMessageGroupAddMessage(t *testing.T) {
-	uidMap = make(map[string]string, 0)
-	uidMap["0"] = "hi"
-	uidMap["1"] = "nope"
+	defer func() { identities = newIdentityResolver(IDENTITY_CACHE_SIZE, IDENTITY_CACHE_TTL) }()
+	identities = testIdentities(map[string]string{"0": "hi", "1": "nope"}, nil)
 
 	amg := &AuditMessageGroup{
 		Seq:           1,
@@ -77,7 +76,6 @@ func TestAuditMessageGroupAddMessage(t *testing.T) {
 }
 
 func TestNewAuditMessageGroup(t *testing.T) {
-	uidMap = make(map[string]string, 0)
 	m := &AuditMessage{
 		Type:      uint16(1300),
 		Seq:       1019,
@@ -92,57 +90,167 @@ func TestNewAuditMessageGroup(t *testing.T) {
 	assert.Equal(t, 6, cap(amg.Msgs), "Msgs capacity should be 6")
 	assert.Equal(t, 1, len(amg.Msgs), "Msgs should only have 1 message")
 	assert.Equal(t, 0, len(amg.UidMap), "No uids in the original message")
+	assert.Equal(t, 0, len(amg.GidMap), "No gids in the original message")
 	assert.Equal(t, m, amg.Msgs[0], "First message should be the original")
 }
 
-func TestGetUsername(t *testing.T) {
-	uidMap = make(map[string]string, 0)
-	assert.Equal(t, "root", getUsername("0"), "0 should be root you animal")
-	assert.Equal(t, "UNKNOWN_USER", getUsername("-1"), "Expected UNKNOWN_USER")
+func TestNewAuditMessageGroupTime(t *testing.T) {
+	defer func() { timezone = time.Local }()
 
-	val, ok := uidMap["0"]
-	if !ok {
-		t.Fatal("Expected the uid mapping to be cached")
+	timezone = time.UTC
+	amg := NewAuditMessageGroup(&AuditMessage{Type: 1300, Seq: 1, AuditTime: "1234567890.123"})
+	assert.Equal(t, int64(1234567890123), amg.AuditTime)
+	assert.Equal(t, "2009-02-13T23:31:30.123Z", amg.AuditTimeISO)
+	assert.Equal(t, "2009", amg.AuditYear)
+	assert.Equal(t, "02", amg.AuditMonth)
+	assert.Equal(t, "13", amg.AuditDay)
+	assert.Equal(t, "23", amg.AuditHour)
+
+	// The date fields follow the configured timezone
+	timezone, _ = loadTimezone("Europe/Zurich")
+	amg = NewAuditMessageGroup(&AuditMessage{Type: 1300, Seq: 1, AuditTime: "1234567890.123"})
+	assert.Equal(t, int64(1234567890123), amg.AuditTime)
+	assert.Equal(t, "2009-02-14T00:31:30.123+01:00", amg.AuditTimeISO)
+	assert.Equal(t, "2009", amg.AuditYear)
+	assert.Equal(t, "02", amg.AuditMonth)
+	assert.Equal(t, "14", amg.AuditDay)
+	assert.Equal(t, "00", amg.AuditHour)
+
+	// A broken time falls back to now
+	amg = NewAuditMessageGroup(&AuditMessage{Type: 1300, Seq: 1, AuditTime: "12a.4"})
+	assert.InDelta(t, time.Now().UnixNano()/int64(time.Millisecond), amg.AuditTime, 1000)
+}
+
+func TestParseAuditTime(t *testing.T) {
+	for value, expected := range map[string]time.Time{
+		"1234567890":            time.Unix(1234567890, 0),
+		"1234567890.123":        time.Unix(1234567890, 123000000),
+		"1234567890.000123":     time.Unix(1234567890, 123000),
+		"1234567890.123456789":  time.Unix(1234567890, 123456789),
+		"1234567890.1234567891": time.Unix(1234567890, 123456789),
+		"1234567890.":           time.Unix(1234567890, 0),
+	} {
+		got, err := parseAuditTime(value)
+		assert.NoError(t, err, value)
+		assert.True(t, expected.Equal(got), "%s parsed as %v", value, got)
 	}
-	assert.Equal(t, "root", val)
 
-	val, ok = uidMap["-1"]
-	if !ok {
-		t.Fatal("Expected the uid mapping to be cached")
+	for _, value := range []string{"", "nope", "12.3a", "12.+3", ".5"} {
+		_, err := parseAuditTime(value)
+		assert.EqualError(t, err, "invalid audit time \""+value+"\"")
 	}
-	assert.Equal(t, "UNKNOWN_USER", val)
+
+	_, err := loadTimezone("Nowhere/Special")
+	assert.EqualError(t, err, "events timezone Nowhere/Special could not be loaded: unknown time zone Nowhere/Special")
 }
 
-func TestAuditMessageGroupMapUids(t *testing.T) {
-	uidMap = make(map[string]string, 0)
-	uidMap["0"] = "hi"
-	uidMap["1"] = "there"
-	uidMap["2"] = "fun"
-	uidMap["3"] = "test"
-	uidMap["99999"] = "derp"
+func TestAuditMessageGroupFindSyscall(t *testing.T) {
+	amg := &AuditMessageGroup{}
+	amg.findSyscall(&AuditMessage{Type: 1300, Data: `arch=c000003e syscall=49 success=yes exit=0 a0=3`})
+	assert.Equal(t, "49", amg.Syscall)
+	assert.Equal(t, "bind", amg.SyscallName)
 
-	amg := &AuditMessageGroup{
-		Seq:           1,
-		AuditTime:     15000000000,
-		CompleteAfter: time.Now().Add(COMPLETE_AFTER),
-		UidMap:        make(map[string]string, 2),
-	}
+	// Keys have to start a field and the syscall may end the record
+	amg = &AuditMessageGroup{}
+	amg.findSyscall(&AuditMessage{Type: 1300, Data: `xarch=c000003e arch=40000003 nosyscall=1 syscall=11`})
+	assert.Equal(t, "11", amg.Syscall)
+	assert.Equal(t, "execve", amg.SyscallName)
 
-	m := &AuditMessage{
-		Data: "uid=0 1uid=1 2uid=2 3uid=3 not here 4uid=99999",
-	}
-	amg.mapUids(m)
+	// Unknown arch
+	amg = &AuditMessageGroup{}
+	amg.findSyscall(&AuditMessage{Type: 1300, Data: `syscall=49`})
+	assert.Equal(t, "49", amg.Syscall)
+	assert.Equal(t, "", amg.SyscallName)
 
-	assert.Equal(t, 5, len(amg.UidMap), "Uid map is too big")
-	assert.Equal(t, "hi", amg.UidMap["0"])
-	assert.Equal(t, "there", amg.UidMap["1"])
-	assert.Equal(t, "fun", amg.UidMap["2"])
-	assert.Equal(t, "test", amg.UidMap["3"])
-	assert.Equal(t, "derp", amg.UidMap["99999"])
+	// Not a syscall id
+	amg = &AuditMessageGroup{}
+	amg.findSyscall(&AuditMessage{Type: 1300, Data: `arch=c000003e syscall=1234567`})
+	assert.Equal(t, "", amg.Syscall)
+	assert.Equal(t, "", amg.SyscallName)
+}
+
+func TestAuditMessageGroupFindPid(t *testing.T) {
+	amg := &AuditMessageGroup{UidMap: map[string]string{}, GidMap: map[string]string{}}
+	amg.AddMessage(&AuditMessage{Type: 1300, Data: "arch=c000003e syscall=59 success=yes exit=0 ppid=11552 pid=11623 auid=4294967295"})
+	assert.Equal(t, 11623, amg.Pid)
+	assert.Equal(t, 11552, amg.Ppid)
+
+	// The first record with a pid wins
+	amg.AddMessage(&AuditMessage{Type: 1400, Data: "apparmor=\"DENIED\" pid=1 comm=\"cat\""})
+	assert.Equal(t, 11623, amg.Pid)
+
+	amg = &AuditMessageGroup{UidMap: map[string]string{}, GidMap: map[string]string{}}
+	amg.AddMessage(&AuditMessage{Type: 1309, Data: "argc=2 a0=\"kill\" a1=\"pid=3\""})
+	assert.Equal(t, 0, amg.Pid)
+}
+
+func TestParseFields(t *testing.T) {
+	// Quoted and plain values
+	f := parseFields(1300, `arch=c000003e syscall=59 success=yes a0=cc4e68 comm="ls" exe="/bin/ls" key=(null)`)
+	assert.Equal(t, map[string]string{
+		"arch":    "c000003e",
+		"syscall": "59",
+		"success": "yes",
+		"a0":      "cc4e68",
+		"comm":    "ls",
+		"exe":     "/bin/ls",
+		"key":     "(null)",
+	}, f)
+
+	// Hex encoded untrusted values are decoded
+	f = parseFields(1307, `cwd=2F686F6D652F6D7920737475666620`)
+	assert.Equal(t, "/home/my stuff ", f["cwd"])
+
+	// EXECVE arguments are decoded, but only in EXECVE records
+	f = parseFields(1309, `argc=2 a0="ls" a1=2D6C2061`)
+	assert.Equal(t, "-l a", f["a1"])
+	f = parseFields(1300, `a1=2D6C2061`)
+	assert.Equal(t, "2D6C2061", f["a1"])
+
+	// PROCTITLE NUL separators become spaces
+	f = parseFields(1327, `proctitle=6C73002D6C00`)
+	assert.Equal(t, "ls -l", f["proctitle"])
+
+	// The msg section of user space records does not override kernel fields
+	f = parseFields(1112, `pid=1 uid=0 auid=1000 ses=2 msg='op=login acct="root" exe="/usr/sbin/sshd" pid=3 addr=10.0.0.1 terminal=ssh res=success'`)
+	assert.Equal(t, "1", f["pid"])
+	assert.Equal(t, "login", f["op"])
+	assert.Equal(t, "root", f["acct"])
+	assert.Equal(t, "/usr/sbin/sshd", f["exe"])
+	assert.Equal(t, "10.0.0.1", f["addr"])
+	assert.Equal(t, "success", f["res"])
+	_, ok := f["msg"]
+	assert.False(t, ok, "msg should have been expanded")
+
+	// Garbage is skipped
+	f = parseFields(1300, ` novalue  a=1 b= c="unterminated`)
+	assert.Equal(t, map[string]string{"a": "1", "b": "", "c": "unterminated"}, f)
+}
+
+func TestAuditMessageParseFields(t *testing.T) {
+	am := &AuditMessage{Type: 1300, Data: "syscall=59"}
+	am.parseFields(FieldsModeOff)
+	assert.Nil(t, am.Fields)
+	assert.Equal(t, "syscall=59", am.Data)
+
+	am.parseFields(FieldsModeAlongside)
+	assert.Equal(t, map[string]string{"syscall": "59"}, am.Fields)
+	assert.Equal(t, "syscall=59", am.Data)
+
+	am.parseFields(FieldsModeInstead)
+	assert.Equal(t, map[string]string{"syscall": "59"}, am.Fields)
+	assert.Equal(t, "", am.Data)
+
+	_, err := validateFieldsMode("sometimes")
+	assert.EqualError(t, err, "parser fields must be one of `off`, `alongside` or `instead`, sometimes provided")
+	mode, err := validateFieldsMode("")
+	assert.Nil(t, err)
+	assert.Equal(t, FieldsModeOff, mode)
 }
 
-func BenchmarkGetUsername(b *testing.B) {
+func BenchmarkParseFields(b *testing.B) {
+	data := `arch=c000003e syscall=59 success=yes exit=0 a0=cc4e68 a1=d10bc8 a2=c69808 a3=7fff2a700900 items=2 ppid=11552 pid=11623 auid=1000 uid=1000 gid=1000 euid=1000 suid=1000 fsuid=1000 egid=1000 sgid=1000 fsgid=1000 tty=pts0 ses=35 comm="ls" exe="/bin/ls" key=(null)`
 	for i := 0; i < b.N; i++ {
-		_ = getUsername("0")
+		_ = parseFields(1300, data)
 	}
 }
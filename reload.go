@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+
+	"github.com/sirupsen/logrus"
+)
+
+// kernelClient is what a reload needs to change the kernel rules and status
+type kernelClient interface {
+	RuleClient
+	StatusClient
+	Close() error
+}
+
+// reloader holds the running configuration and the parts of go-audit a reload can replace
+type reloader struct {
+	filename     string
+	config       *Config
+	marshaller   *AuditMarshaller
+	writers      []*AuditWriter
+	outputCancel context.CancelFunc
+
+	// Opens a connection to the kernel when rules or the kernel status changed
+	kernelClient func() (kernelClient, error)
+}
+
+// reload loads the config file again and applies whatever changed. The new config is validated completely before
+// anything is changed, an invalid config is rejected and the running one stays in place
+func (r *reloader) reload() error {
+	config, err := loadConfig(r.filename)
+	if err != nil {
+		return fmt.Errorf("failed to load configuration: %v", err)
+	}
+
+	r.keepStartupSettings(config)
+
+	filters, err := createFilters(config)
+	if err != nil {
+		return fmt.Errorf("failed to create filters: %v", err)
+	}
+
+	samplers, err := createSamplers(config)
+	if err != nil {
+		return fmt.Errorf("failed to create sampling rules: %v", err)
+	}
+
+	fieldsMode, err := validateFieldsMode(config.Parser.Fields)
+	if err != nil {
+		return fmt.Errorf("failed to configure the parser: %v", err)
+	}
+
+	if _, err := parseRules(config); err != nil {
+		return err
+	}
+
+	// New outputs are created next to the running ones so a broken output leaves the running ones untouched
+	outputsChanged := !reflect.DeepEqual(config.Output, r.config.Output) || config.Spool != r.config.Spool
+	writers, outputCancel := r.writers, r.outputCancel
+	if outputsChanged {
+		outputCtx, cancel := context.WithCancel(context.Background())
+		if writers, err = createOutput(outputCtx, config); err != nil {
+			cancel()
+			return fmt.Errorf("failed to create outputs: %v", err)
+		}
+		outputCancel = cancel
+	}
+
+	if err := r.applyKernel(config); err != nil {
+		if outputsChanged {
+			outputCancel()
+			closeOutputs(writers)
+		}
+		return err
+	}
+
+	// Replaced outputs that block on failure give up on their message once the shutdown timeout expired
+	if outputsChanged {
+		t := stopOutputsAfter(r.writers, config.Shutdown.Timeout)
+		defer t.Stop()
+	}
+
+	old := r.marshaller.Reload(writers, uint16(config.Events.Min), uint16(config.Events.Max), fieldsMode, filters)
+	r.marshaller.SetSamplers(samplers)
+
+	// Whatever the replaced outputs still queue is delivered before they are closed
+	if outputsChanged {
+		if n := flushOutputs(old, config.Shutdown.Timeout); n > 0 {
+			logrus.Errorf("%d events were dropped while replacing the outputs", n)
+		}
+		r.outputCancel()
+		closeOutputs(old)
+		logrus.Info("replaced the outputs")
+	}
+
+	r.config = config
+	r.writers = writers
+	r.outputCancel = outputCancel
+	return nil
+}
+
+// Applies the rules and the kernel status if they changed, the old rules are restored if the new ones fail
+func (r *reloader) applyKernel(config *Config) error {
+	rulesChanged := !reflect.DeepEqual(config.Rules, r.config.Rules)
+	kernelChanged := config.Kernel != r.config.Kernel
+	if !rulesChanged && !kernelChanged {
+		return nil
+	}
+
+	c, err := r.kernelClient()
+	if err != nil {
+		return fmt.Errorf("failed to create netlink rule client: %v", err)
+	}
+	defer c.Close()
+
+	if kernelChanged {
+		if err := setKernelStatus(config, c); err != nil {
+			return err
+		}
+	}
+
+	if rulesChanged {
+		if err := setRules(config, c); err != nil {
+			if rerr := setRules(r.config, c); rerr != nil {
+				logrus.WithError(rerr).Error("failed to restore the previous audit rules")
+			}
+			return err
+		}
+		logrus.Infof("replaced the audit rules, %d rules configured", len(config.Rules))
+	}
+
+	return nil
+}
+
+// Settings that are only read on startup keep their running value, changing them requires a restart
+func (r *reloader) keepStartupSettings(config *Config) {
+	for _, s := range []struct {
+		name    string
+		changed bool
+		keep    func()
+	}{
+		{"socket_buffer", config.SockerBuffer != r.config.SockerBuffer, func() { config.SockerBuffer = r.config.SockerBuffer }},
+		{"metrics_address", config.MetricsAddress != r.config.MetricsAddress, func() { config.MetricsAddress = r.config.MetricsAddress }},
+		{"message_tracking", config.MessageTracking != r.config.MessageTracking, func() { config.MessageTracking = r.config.MessageTracking }},
+		{"events.timezone", config.Events.Timezone != r.config.Events.Timezone, func() { config.Events.Timezone = r.config.Events.Timezone }},
+		{"enrichment", config.Enrichment != r.config.Enrichment, func() { config.Enrichment = r.config.Enrichment }},
+		{"identity", config.Identity != r.config.Identity, func() { config.Identity = r.config.Identity }},
+		{"events.complete_after", config.Events.CompleteAfter != r.config.Events.CompleteAfter, func() { config.Events.CompleteAfter = r.config.Events.CompleteAfter }},
+		{"kernel.status_interval", config.Kernel.StatusInterval != r.config.Kernel.StatusInterval, func() { config.Kernel.StatusInterval = r.config.Kernel.StatusInterval }},
+	} {
+		if s.changed {
+			logrus.Warnf("changing %s requires a restart, keeping the running value", s.name)
+			s.keep()
+		}
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const reloadTestConfig = `
+output:
+  stdout:
+    enabled: true
+    attempts: 1
+rules:
+  - -a exit,always -S execve
+`
+
+func TestReloaderReload(t *testing.T) {
+	f, err := ioutil.TempFile("", "go-audit.reload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+
+	kc := &fakeRuleClient{}
+	r, cancelled := newTestReloader(t, f.Name(), reloadTestConfig, kc)
+	oldWriters := r.writers
+
+	// Nothing changed, nothing is touched
+	assert.NoError(t, r.reload())
+	assert.Equal(t, 0, kc.closed, "The kernel should not be touched")
+	assert.Equal(t, oldWriters, r.writers)
+
+	// Filters and parser settings are swapped in the marshaller
+	writeConfig(t, f.Name(), reloadTestConfig+`
+parser:
+  fields: alongside
+filters:
+  - syscall: 59
+    message_type: 1309
+    regex: bash
+`)
+	assert.NoError(t, r.reload())
+	assert.Equal(t, 0, kc.closed, "The kernel should not be touched")
+	assert.Equal(t, FieldsModeAlongside, r.marshaller.fieldsMode)
+	assert.Equal(t, map[string]map[uint16][]*regexp.Regexp{"59": {1309: {regexp.MustCompile("bash")}}}, r.marshaller.filters)
+	assert.Equal(t, oldWriters, r.writers)
+	assert.False(t, *cancelled)
+
+	// Invalid configs are rejected as a whole
+	writeConfig(t, f.Name(), `
+output:
+  stdout:
+    enabled: true
+    attempts: 2
+filters:
+  - syscall: 59
+    message_type: 1309
+    regex: "("
+rules:
+  - -a exit,always -S execve -k changed
+`)
+	assert.EqualError(t, r.reload(), "failed to create filters: `regex` in filter 1 could not be parsed: (")
+	assert.Equal(t, 0, kc.closed)
+	assert.Equal(t, FieldsModeAlongside, r.marshaller.fieldsMode)
+	assert.Equal(t, oldWriters, r.writers)
+
+	writeConfig(t, f.Name(), reloadTestConfig+`
+  - -a sometimes
+`)
+	assert.EqualError(t, r.reload(), "failed to parse rule #2: list and action must be provided as `list,action`, sometimes provided")
+	assert.Equal(t, 0, kc.closed)
+
+	writeConfig(t, f.Name(), `
+output:
+  stdout:
+    enabled: true
+    attempts: 0
+rules:
+  - -a exit,always -S execve
+`)
+	assert.EqualError(t, r.reload(), "failed to create outputs: output attempts for stdout must be at least 1, 0 provided")
+	assert.Equal(t, oldWriters, r.writers)
+	assert.Equal(t, oldWriters, r.marshaller.writers)
+
+	// Changed rules are applied
+	writeConfig(t, f.Name(), reloadTestConfig+`
+  - -a never,exit -F auid=unset
+`)
+	assert.NoError(t, r.reload())
+	assert.Equal(t, 1, kc.closed)
+	assert.Equal(t, 1, kc.flushed)
+	assert.Len(t, kc.added, 2)
+	assert.Len(t, kc.status, 0, "The kernel status did not change")
+
+	// Broken rules restore the previous ones
+	kc.addErr = errors.New("testing rule")
+	writeConfig(t, f.Name(), reloadTestConfig)
+	assert.EqualError(t, r.reload(), "failed to add rule #1: testing rule")
+	assert.Equal(t, 3, kc.flushed, "Should flush for the new and the restored rules")
+	assert.Len(t, r.config.Rules, 2)
+	kc.addErr = nil
+
+	// Changed outputs are replaced and the old ones are shut down
+	writeConfig(t, f.Name(), `
+output:
+  stdout:
+    enabled: true
+    attempts: 2
+rules:
+  - -a exit,always -S execve
+  - -a never,exit -F auid=unset
+`)
+	assert.NoError(t, r.reload())
+	assert.True(t, *cancelled, "Old outputs should have been shut down")
+	if assert.Len(t, r.writers, 1) {
+		assert.NotEqual(t, oldWriters[0], r.writers[0])
+		assert.Equal(t, 2, r.writers[0].attempts)
+		assert.Equal(t, r.writers, r.marshaller.writers)
+	}
+	assert.Equal(t, 2, kc.closed, "The kernel should not be touched")
+	r.outputCancel()
+}
+
+func TestReloaderKeepStartupSettings(t *testing.T) {
+	lb := hookLogger()
+	defer resetLogger()
+
+	r := &reloader{config: defaultConfig()}
+	config := defaultConfig()
+	config.SockerBuffer.Receive = 1024
+	config.MessageTracking.Enabled = false
+	config.Parser.Fields = FieldsModeInstead
+	config.Identity.CacheTTL = time.Minute
+
+	r.keepStartupSettings(config)
+	assert.Equal(t, r.config.SockerBuffer, config.SockerBuffer)
+	assert.Equal(t, r.config.MessageTracking, config.MessageTracking)
+	assert.Equal(t, r.config.Identity, config.Identity)
+	assert.Equal(t, FieldsModeInstead, config.Parser.Fields, "Reloadable settings should not be touched")
+	assert.Contains(t, lb.String(), "changing identity requires a restart, keeping the running value")
+	assert.Contains(t, lb.String(), "changing socket_buffer requires a restart, keeping the running value")
+	assert.Contains(t, lb.String(), "changing message_tracking requires a restart, keeping the running value")
+	assert.NotContains(t, lb.String(), "metrics_address")
+}
+
+// Builds a reloader like main does from the given config
+func newTestReloader(t *testing.T, filename, config string, kc *fakeRuleClient) (*reloader, *bool) {
+	writeConfig(t, filename, config)
+	c, err := loadConfig(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cancelled := false
+	w := []*AuditWriter{NewAuditWriter(&bytes.Buffer{}, 1)}
+	return &reloader{
+		filename:     filename,
+		config:       c,
+		marshaller:   NewAuditMarshaller(w, uint16(1300), uint16(1399), false, false, 0, FieldsModeOff, COMPLETE_AFTER, []AuditFilter{}),
+		writers:      w,
+		outputCancel: func() { cancelled = true },
+		kernelClient: func() (kernelClient, error) { return kc, nil },
+	}, &cancelled
+}
+
+func writeConfig(t *testing.T, filename, config string) {
+	if err := ioutil.WriteFile(filename, []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,795 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"os/user"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// Rule related constants, see http://lxr.free-electrons.com/source/include/uapi/linux/audit.h
+const (
+	AUDIT_LIST_RULES = 1013 // List syscall filtering rules
+	AUDIT_ADD_RULE   = 1011 // Add syscall filtering rule
+	AUDIT_DEL_RULE   = 1012 // Delete syscall filtering rule
+
+	AUDIT_BITMASK_SIZE = 64
+	AUDIT_MAX_FIELDS   = 64
+	AUDIT_MAX_KEY_LEN  = 256
+
+	// Rule lists
+	AUDIT_FILTER_USER    = 0x00
+	AUDIT_FILTER_TASK    = 0x01
+	AUDIT_FILTER_ENTRY   = 0x02
+	AUDIT_FILTER_EXIT    = 0x04
+	AUDIT_FILTER_EXCLUDE = 0x05
+	AUDIT_FILTER_FS      = 0x06
+	AUDIT_FILTER_PREPEND = 0x10
+
+	// Rule actions
+	AUDIT_NEVER  = 0
+	AUDIT_ALWAYS = 2
+
+	// Rule fields
+	AUDIT_PID           = 0
+	AUDIT_UID           = 1
+	AUDIT_EUID          = 2
+	AUDIT_SUID          = 3
+	AUDIT_FSUID         = 4
+	AUDIT_GID           = 5
+	AUDIT_EGID          = 6
+	AUDIT_SGID          = 7
+	AUDIT_FSGID         = 8
+	AUDIT_LOGINUID      = 9
+	AUDIT_PERS          = 10
+	AUDIT_ARCH          = 11
+	AUDIT_MSGTYPE       = 12
+	AUDIT_SUBJ_USER     = 13
+	AUDIT_SUBJ_ROLE     = 14
+	AUDIT_SUBJ_TYPE     = 15
+	AUDIT_SUBJ_SEN      = 16
+	AUDIT_SUBJ_CLR      = 17
+	AUDIT_PPID          = 18
+	AUDIT_OBJ_USER      = 19
+	AUDIT_OBJ_ROLE      = 20
+	AUDIT_OBJ_TYPE      = 21
+	AUDIT_OBJ_LEV_LOW   = 22
+	AUDIT_OBJ_LEV_HIGH  = 23
+	AUDIT_LOGINUID_SET  = 24
+	AUDIT_SESSIONID     = 25
+	AUDIT_FSTYPE        = 26
+	AUDIT_DEVMAJOR      = 100
+	AUDIT_DEVMINOR      = 101
+	AUDIT_INODE         = 102
+	AUDIT_EXIT          = 103
+	AUDIT_SUCCESS       = 104
+	AUDIT_WATCH         = 105
+	AUDIT_PERM          = 106
+	AUDIT_DIR           = 107
+	AUDIT_FILETYPE      = 108
+	AUDIT_OBJ_UID       = 109
+	AUDIT_OBJ_GID       = 110
+	AUDIT_EXE           = 112
+	AUDIT_ARG0          = 200
+	AUDIT_ARG1          = 201
+	AUDIT_ARG2          = 202
+	AUDIT_ARG3          = 203
+	AUDIT_FILTERKEY     = 210
+	AUDIT_PERM_EXEC     = 1
+	AUDIT_PERM_WRITE    = 2
+	AUDIT_PERM_READ     = 4
+	AUDIT_PERM_ATTR     = 8
+	AUDITSC_SUCCESS     = 1
+	AUDITSC_FAILURE     = 2
+	AUDIT_UNSET_ID      = 4294967295
+	AUDIT_PERM_ALL      = AUDIT_PERM_EXEC | AUDIT_PERM_WRITE | AUDIT_PERM_READ | AUDIT_PERM_ATTR
+	AUDIT_RULE_DATA_LEN = 4*3 + 4*AUDIT_BITMASK_SIZE + 4*3*AUDIT_MAX_FIELDS + 4
+
+	// Rule operators
+	AUDIT_BIT_MASK              = 0x08000000
+	AUDIT_LESS_THAN             = 0x10000000
+	AUDIT_GREATER_THAN          = 0x20000000
+	AUDIT_NOT_EQUAL             = 0x30000000
+	AUDIT_EQUAL                 = 0x40000000
+	AUDIT_BIT_TEST              = AUDIT_BIT_MASK | AUDIT_EQUAL
+	AUDIT_LESS_THAN_OR_EQUAL    = AUDIT_LESS_THAN | AUDIT_EQUAL
+	AUDIT_GREATER_THAN_OR_EQUAL = AUDIT_GREATER_THAN | AUDIT_EQUAL
+
+	// Architectures
+	AUDIT_ARCH_X86_64  = 0xc000003e
+	AUDIT_ARCH_I386    = 0x40000003
+	AUDIT_ARCH_AARCH64 = 0xc00000b7
+	AUDIT_ARCH_ARM     = 0x40000028
+)
+
+// Kinds of rule commands a config line can hold
+const (
+	ruleAdd = iota
+	ruleDelete
+	ruleDeleteAll
+	ruleStatus
+)
+
+var ruleLists = map[string]uint32{
+	"user":       AUDIT_FILTER_USER,
+	"task":       AUDIT_FILTER_TASK,
+	"entry":      AUDIT_FILTER_ENTRY,
+	"exit":       AUDIT_FILTER_EXIT,
+	"exclude":    AUDIT_FILTER_EXCLUDE,
+	"filesystem": AUDIT_FILTER_FS,
+}
+
+var ruleActions = map[string]uint32{
+	"never":  AUDIT_NEVER,
+	"always": AUDIT_ALWAYS,
+}
+
+var ruleFields = map[string]uint32{
+	"pid":          AUDIT_PID,
+	"uid":          AUDIT_UID,
+	"euid":         AUDIT_EUID,
+	"suid":         AUDIT_SUID,
+	"fsuid":        AUDIT_FSUID,
+	"gid":          AUDIT_GID,
+	"egid":         AUDIT_EGID,
+	"sgid":         AUDIT_SGID,
+	"fsgid":        AUDIT_FSGID,
+	"auid":         AUDIT_LOGINUID,
+	"loginuid":     AUDIT_LOGINUID,
+	"pers":         AUDIT_PERS,
+	"arch":         AUDIT_ARCH,
+	"msgtype":      AUDIT_MSGTYPE,
+	"subj_user":    AUDIT_SUBJ_USER,
+	"subj_role":    AUDIT_SUBJ_ROLE,
+	"subj_type":    AUDIT_SUBJ_TYPE,
+	"subj_sen":     AUDIT_SUBJ_SEN,
+	"subj_clr":     AUDIT_SUBJ_CLR,
+	"ppid":         AUDIT_PPID,
+	"obj_user":     AUDIT_OBJ_USER,
+	"obj_role":     AUDIT_OBJ_ROLE,
+	"obj_type":     AUDIT_OBJ_TYPE,
+	"obj_lev_low":  AUDIT_OBJ_LEV_LOW,
+	"obj_lev_high": AUDIT_OBJ_LEV_HIGH,
+	"loginuid_set": AUDIT_LOGINUID_SET,
+	"sessionid":    AUDIT_SESSIONID,
+	"fstype":       AUDIT_FSTYPE,
+	"devmajor":     AUDIT_DEVMAJOR,
+	"devminor":     AUDIT_DEVMINOR,
+	"inode":        AUDIT_INODE,
+	"exit":         AUDIT_EXIT,
+	"success":      AUDIT_SUCCESS,
+	"path":         AUDIT_WATCH,
+	"perm":         AUDIT_PERM,
+	"dir":          AUDIT_DIR,
+	"filetype":     AUDIT_FILETYPE,
+	"obj_uid":      AUDIT_OBJ_UID,
+	"obj_gid":      AUDIT_OBJ_GID,
+	"exe":          AUDIT_EXE,
+	"a0":           AUDIT_ARG0,
+	"a1":           AUDIT_ARG1,
+	"a2":           AUDIT_ARG2,
+	"a3":           AUDIT_ARG3,
+	"key":          AUDIT_FILTERKEY,
+}
+
+// Operators ordered so that two character operators are matched first
+var ruleOperators = []struct {
+	op  string
+	val uint32
+}{
+	{"!=", AUDIT_NOT_EQUAL},
+	{"<=", AUDIT_LESS_THAN_OR_EQUAL},
+	{">=", AUDIT_GREATER_THAN_OR_EQUAL},
+	{"&=", AUDIT_BIT_TEST},
+	{"=", AUDIT_EQUAL},
+	{"<", AUDIT_LESS_THAN},
+	{">", AUDIT_GREATER_THAN},
+	{"&", AUDIT_BIT_MASK},
+}
+
+var ruleArches = map[string]uint32{
+	"x86_64":  AUDIT_ARCH_X86_64,
+	"i386":    AUDIT_ARCH_I386,
+	"i486":    AUDIT_ARCH_I386,
+	"i586":    AUDIT_ARCH_I386,
+	"i686":    AUDIT_ARCH_I386,
+	"aarch64": AUDIT_ARCH_AARCH64,
+	"arm":     AUDIT_ARCH_ARM,
+	"armv7l":  AUDIT_ARCH_ARM,
+}
+
+// The 64 and 32 bit architectures of the machine go-audit was built for, used for `arch=b64` and `arch=b32`
+var nativeArches = map[string][2]uint32{
+	"amd64": {AUDIT_ARCH_X86_64, AUDIT_ARCH_I386},
+	"386":   {0, AUDIT_ARCH_I386},
+	"arm64": {AUDIT_ARCH_AARCH64, AUDIT_ARCH_ARM},
+	"arm":   {0, AUDIT_ARCH_ARM},
+}
+
+var syscallTables = map[uint32]map[string]int{
+	AUDIT_ARCH_X86_64:  syscallsX8664,
+	AUDIT_ARCH_I386:    syscallsI386,
+	AUDIT_ARCH_AARCH64: syscallsAarch64,
+	AUDIT_ARCH_ARM:     syscallsArm,
+}
+
+var ruleFileTypes = map[string]uint32{
+	"file":      syscall.S_IFREG,
+	"dir":       syscall.S_IFDIR,
+	"socket":    syscall.S_IFSOCK,
+	"link":      syscall.S_IFLNK,
+	"character": syscall.S_IFCHR,
+	"block":     syscall.S_IFBLK,
+	"fifo":      syscall.S_IFIFO,
+}
+
+var ruleErrnos = map[string]syscall.Errno{
+	"EPERM":        syscall.EPERM,
+	"ENOENT":       syscall.ENOENT,
+	"ESRCH":        syscall.ESRCH,
+	"EINTR":        syscall.EINTR,
+	"EIO":          syscall.EIO,
+	"ENXIO":        syscall.ENXIO,
+	"E2BIG":        syscall.E2BIG,
+	"ENOEXEC":      syscall.ENOEXEC,
+	"EBADF":        syscall.EBADF,
+	"ECHILD":       syscall.ECHILD,
+	"EAGAIN":       syscall.EAGAIN,
+	"ENOMEM":       syscall.ENOMEM,
+	"EACCES":       syscall.EACCES,
+	"EFAULT":       syscall.EFAULT,
+	"EBUSY":        syscall.EBUSY,
+	"EEXIST":       syscall.EEXIST,
+	"EXDEV":        syscall.EXDEV,
+	"ENODEV":       syscall.ENODEV,
+	"ENOTDIR":      syscall.ENOTDIR,
+	"EISDIR":       syscall.EISDIR,
+	"EINVAL":       syscall.EINVAL,
+	"ENFILE":       syscall.ENFILE,
+	"EMFILE":       syscall.EMFILE,
+	"ENOTTY":       syscall.ENOTTY,
+	"ETXTBSY":      syscall.ETXTBSY,
+	"EFBIG":        syscall.EFBIG,
+	"ENOSPC":       syscall.ENOSPC,
+	"ESPIPE":       syscall.ESPIPE,
+	"EROFS":        syscall.EROFS,
+	"EMLINK":       syscall.EMLINK,
+	"EPIPE":        syscall.EPIPE,
+	"ENOSYS":       syscall.ENOSYS,
+	"ENOTEMPTY":    syscall.ENOTEMPTY,
+	"ELOOP":        syscall.ELOOP,
+	"EINPROGRESS":  syscall.EINPROGRESS,
+	"EADDRINUSE":   syscall.EADDRINUSE,
+	"ENETUNREACH":  syscall.ENETUNREACH,
+	"ECONNREFUSED": syscall.ECONNREFUSED,
+	"ETIMEDOUT":    syscall.ETIMEDOUT,
+	"EHOSTUNREACH": syscall.EHOSTUNREACH,
+}
+
+// AuditRule is the go representation of the kernel `audit_rule_data` struct
+type AuditRule struct {
+	Flags  uint32
+	Action uint32
+	Mask   [AUDIT_BITMASK_SIZE]uint32
+	Fields []AuditRuleField
+}
+
+// AuditRuleField is a single `-F` comparison of a rule, string fields use Str instead of Value
+type AuditRuleField struct {
+	Field uint32
+	Op    uint32
+	Value uint32
+	Str   string
+}
+
+// ruleCommand is a single line of the `rules` config, parsed from the auditctl syntax
+type ruleCommand struct {
+	kind   int
+	rule   *AuditRule
+	status *AuditStatusPayload
+}
+
+// RuleClient manages the audit rules of the kernel
+type RuleClient interface {
+	AddRule(r *AuditRule) error
+	DeleteRule(r *AuditRule) error
+	DeleteAllRules() error
+	SetStatus(s *AuditStatusPayload) error
+}
+
+// apply sends the command to the kernel
+func (rc *ruleCommand) apply(c RuleClient) error {
+	switch rc.kind {
+	case ruleAdd:
+		return c.AddRule(rc.rule)
+	case ruleDelete:
+		return c.DeleteRule(rc.rule)
+	case ruleDeleteAll:
+		return c.DeleteAllRules()
+	default:
+		return c.SetStatus(rc.status)
+	}
+}
+
+// parseRule parses a rule written in the auditctl syntax, only the options that manage rules and the kernel status are supported
+func parseRule(line string) (*ruleCommand, error) {
+	args := strings.Fields(line)
+	rc := &ruleCommand{kind: -1}
+	rule := &AuditRule{}
+
+	var (
+		syscalls []string
+		fields   []string
+		keys     []string
+		watch    string
+		perm     string
+		hasList  bool
+	)
+
+	setKind := func(kind int) error {
+		if rc.kind != -1 && rc.kind != kind {
+			return errors.New("rule mixes options that can not be combined")
+		}
+		rc.kind = kind
+		return nil
+	}
+
+	for i := 0; i < len(args); i++ {
+		opt := args[i]
+
+		// Options without a value
+		if opt == "-D" {
+			if err := setKind(ruleDeleteAll); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		if i+1 >= len(args) {
+			return nil, fmt.Errorf("option %s requires a value", opt)
+		}
+		i++
+		val := args[i]
+
+		switch opt {
+		case "-e", "-f", "-b", "-r", "--backlog_wait_time":
+			if err := setKind(ruleStatus); err != nil {
+				return nil, err
+			}
+			if rc.status == nil {
+				rc.status = &AuditStatusPayload{}
+			}
+			if err := setStatusOption(rc.status, opt, val); err != nil {
+				return nil, err
+			}
+
+		case "-a", "-A", "-d":
+			kind := ruleAdd
+			if opt == "-d" {
+				kind = ruleDelete
+			}
+			if err := setKind(kind); err != nil {
+				return nil, err
+			}
+			if err := setListAction(rule, val); err != nil {
+				return nil, err
+			}
+			if opt == "-A" {
+				rule.Flags |= AUDIT_FILTER_PREPEND
+			}
+			hasList = true
+
+		case "-w", "-W":
+			kind := ruleAdd
+			if opt == "-W" {
+				kind = ruleDelete
+			}
+			if err := setKind(kind); err != nil {
+				return nil, err
+			}
+			watch = val
+
+		case "-p":
+			perm = val
+
+		case "-S":
+			syscalls = append(syscalls, strings.Split(val, ",")...)
+
+		case "-F":
+			fields = append(fields, val)
+
+		case "-k":
+			keys = append(keys, val)
+
+		default:
+			return nil, fmt.Errorf("unsupported option %s", opt)
+		}
+	}
+
+	switch rc.kind {
+	case -1:
+		return nil, errors.New("rule does not contain an action")
+	case ruleDeleteAll, ruleStatus:
+		return rc, nil
+	}
+
+	if watch != "" {
+		if hasList || len(syscalls) > 0 {
+			return nil, errors.New("watches can not be combined with -a, -A, -d or -S")
+		}
+		rule.Flags = AUDIT_FILTER_EXIT
+		rule.Action = AUDIT_ALWAYS
+
+		field := AUDIT_WATCH
+		if fi, err := os.Stat(watch); err == nil && fi.IsDir() {
+			field = AUDIT_DIR
+		}
+		rule.Fields = append(rule.Fields, AuditRuleField{Field: uint32(field), Op: AUDIT_EQUAL, Str: watch})
+
+		if perm == "" {
+			perm = "rwxa"
+		}
+	} else if !hasList {
+		return nil, errors.New("rule requires -a, -A, -d, -w or -W")
+	}
+
+	arch := uint32(0)
+	for _, f := range fields {
+		field, err := parseRuleField(f, &arch)
+		if err != nil {
+			return nil, err
+		}
+		rule.Fields = append(rule.Fields, field)
+	}
+
+	if perm != "" {
+		v, err := parsePerm(perm)
+		if err != nil {
+			return nil, err
+		}
+		rule.Fields = append(rule.Fields, AuditRuleField{Field: AUDIT_PERM, Op: AUDIT_EQUAL, Value: v})
+	}
+
+	if len(keys) > 0 {
+		// The kernel keeps multiple keys in a single field separated by \x01, the same way auditctl does
+		key := strings.Join(keys, "\x01")
+		if len(key) > AUDIT_MAX_KEY_LEN {
+			return nil, fmt.Errorf("key is longer than %d characters", AUDIT_MAX_KEY_LEN)
+		}
+		rule.Fields = append(rule.Fields, AuditRuleField{Field: AUDIT_FILTERKEY, Op: AUDIT_EQUAL, Str: key})
+	}
+
+	if len(rule.Fields) > AUDIT_MAX_FIELDS {
+		return nil, fmt.Errorf("rule has more than %d fields", AUDIT_MAX_FIELDS)
+	}
+
+	if err := setSyscalls(rule, syscalls, arch); err != nil {
+		return nil, err
+	}
+
+	rc.rule = rule
+	return rc, nil
+}
+
+func setStatusOption(s *AuditStatusPayload, opt, val string) error {
+	v, err := strconv.ParseUint(val, 10, 32)
+	if err != nil {
+		return fmt.Errorf("option %s requires a number, %s provided", opt, val)
+	}
+
+	switch opt {
+	case "-e":
+		if v > 2 {
+			return fmt.Errorf("option -e must be 0, 1 or 2, %d provided", v)
+		}
+		s.Mask |= AUDIT_STATUS_ENABLED
+		s.Enabled = uint32(v)
+	case "-f":
+		if v > 2 {
+			return fmt.Errorf("option -f must be 0, 1 or 2, %d provided", v)
+		}
+		s.Mask |= AUDIT_STATUS_FAILURE
+		s.Failure = uint32(v)
+	case "-b":
+		s.Mask |= AUDIT_STATUS_BACKLOG_LIMIT
+		s.BacklogLimit = uint32(v)
+	case "-r":
+		s.Mask |= AUDIT_STATUS_RATE_LIMIT
+		s.RateLimit = uint32(v)
+	case "--backlog_wait_time":
+		s.Mask |= AUDIT_STATUS_BACKLOG_WAIT_TIME
+		s.BacklogWaitTime = uint32(v)
+	}
+
+	return nil
+}
+
+// setListAction parses `list,action`, auditctl accepts both orders
+func setListAction(rule *AuditRule, val string) error {
+	parts := strings.Split(val, ",")
+	if len(parts) != 2 {
+		return fmt.Errorf("list and action must be provided as `list,action`, %s provided", val)
+	}
+
+	list, ok := ruleLists[parts[0]]
+	action, aok := ruleActions[parts[1]]
+	if !ok || !aok {
+		list, ok = ruleLists[parts[1]]
+		action, aok = ruleActions[parts[0]]
+	}
+
+	if !ok || !aok {
+		return fmt.Errorf("unknown list or action in %s", val)
+	}
+
+	rule.Flags |= list
+	rule.Action = action
+	return nil
+}
+
+// parseRuleField parses a `-F` expression, arch is set when an arch field is found
+func parseRuleField(expr string, arch *uint32) (AuditRuleField, error) {
+	var f AuditRuleField
+
+	pos := strings.IndexAny(expr, "=!<>&")
+	if pos < 1 {
+		return f, fmt.Errorf("field %s has no operator", expr)
+	}
+
+	name := expr[:pos]
+	rest := expr[pos:]
+	var val string
+	found := false
+	for _, o := range ruleOperators {
+		if strings.HasPrefix(rest, o.op) {
+			f.Op = o.val
+			val = rest[len(o.op):]
+			found = true
+			break
+		}
+	}
+
+	if !found {
+		return f, fmt.Errorf("field %s has an unknown operator", expr)
+	}
+
+	field, ok := ruleFields[name]
+	if !ok {
+		return f, fmt.Errorf("unknown field %s", name)
+	}
+	f.Field = field
+
+	if val == "" {
+		return f, fmt.Errorf("field %s has no value", name)
+	}
+
+	var err error
+	switch field {
+	case AUDIT_SUBJ_USER, AUDIT_SUBJ_ROLE, AUDIT_SUBJ_TYPE, AUDIT_SUBJ_SEN, AUDIT_SUBJ_CLR,
+		AUDIT_OBJ_USER, AUDIT_OBJ_ROLE, AUDIT_OBJ_TYPE, AUDIT_OBJ_LEV_LOW, AUDIT_OBJ_LEV_HIGH,
+		AUDIT_WATCH, AUDIT_DIR, AUDIT_EXE, AUDIT_FILTERKEY:
+		f.Str = val
+
+	case AUDIT_UID, AUDIT_EUID, AUDIT_SUID, AUDIT_FSUID, AUDIT_LOGINUID, AUDIT_OBJ_UID:
+		f.Value, err = parseRuleUid(val)
+
+	case AUDIT_GID, AUDIT_EGID, AUDIT_SGID, AUDIT_FSGID, AUDIT_OBJ_GID:
+		f.Value, err = parseRuleGid(val)
+
+	case AUDIT_ARCH:
+		if f.Op != AUDIT_EQUAL && f.Op != AUDIT_NOT_EQUAL {
+			return f, errors.New("arch only supports the = and != operators")
+		}
+		f.Value, err = parseRuleArch(val)
+		*arch = f.Value
+
+	case AUDIT_PERM:
+		f.Value, err = parsePerm(val)
+
+	case AUDIT_FILETYPE:
+		v, ok := ruleFileTypes[val]
+		if !ok {
+			err = fmt.Errorf("unknown file type %s", val)
+		}
+		f.Value = v
+
+	case AUDIT_SUCCESS:
+		switch val {
+		case "1", "yes":
+			f.Value = AUDITSC_SUCCESS
+		case "0", "no":
+			f.Value = AUDITSC_FAILURE
+		default:
+			err = fmt.Errorf("success must be 0 or 1, %s provided", val)
+		}
+
+	case AUDIT_EXIT:
+		name := strings.TrimPrefix(val, "-")
+		if errno, ok := ruleErrnos[name]; ok {
+			f.Value = uint32(-int32(errno))
+		} else {
+			f.Value, err = parseRuleNumber(val)
+		}
+
+	default:
+		f.Value, err = parseRuleNumber(val)
+	}
+
+	if err != nil {
+		return f, fmt.Errorf("field %s: %v", name, err)
+	}
+
+	return f, nil
+}
+
+// Parses decimal, hex or octal numbers, negative values are stored the way the kernel expects them
+func parseRuleNumber(val string) (uint32, error) {
+	v, err := strconv.ParseInt(val, 0, 64)
+	if err != nil || v < -2147483648 || v > 4294967295 {
+		return 0, fmt.Errorf("invalid number %s", val)
+	}
+	return uint32(v), nil
+}
+
+func parseRuleUid(val string) (uint32, error) {
+	if val == "unset" || val == "-1" {
+		return AUDIT_UNSET_ID, nil
+	}
+
+	if v, err := strconv.ParseUint(val, 10, 32); err == nil {
+		return uint32(v), nil
+	}
+
+	u, err := user.Lookup(val)
+	if err != nil {
+		return 0, err
+	}
+
+	v, err := strconv.ParseUint(u.Uid, 10, 32)
+	return uint32(v), err
+}
+
+func parseRuleGid(val string) (uint32, error) {
+	if val == "unset" || val == "-1" {
+		return AUDIT_UNSET_ID, nil
+	}
+
+	if v, err := strconv.ParseUint(val, 10, 32); err == nil {
+		return uint32(v), nil
+	}
+
+	g, err := user.LookupGroup(val)
+	if err != nil {
+		return 0, err
+	}
+
+	v, err := strconv.ParseUint(g.Gid, 10, 32)
+	return uint32(v), err
+}
+
+func parseRuleArch(val string) (uint32, error) {
+	if val == "b64" || val == "b32" {
+		native := nativeArches[runtime.GOARCH]
+		arch := native[0]
+		if val == "b32" {
+			arch = native[1]
+		}
+		if arch == 0 {
+			return 0, fmt.Errorf("%s is not supported on %s", val, runtime.GOARCH)
+		}
+		return arch, nil
+	}
+
+	if arch, ok := ruleArches[val]; ok {
+		return arch, nil
+	}
+
+	return parseRuleNumber(val)
+}
+
+func parsePerm(val string) (uint32, error) {
+	var perm uint32
+	for _, c := range val {
+		switch c {
+		case 'r':
+			perm |= AUDIT_PERM_READ
+		case 'w':
+			perm |= AUDIT_PERM_WRITE
+		case 'x':
+			perm |= AUDIT_PERM_EXEC
+		case 'a':
+			perm |= AUDIT_PERM_ATTR
+		default:
+			return 0, fmt.Errorf("permission %c is not one of r, w, x or a", c)
+		}
+	}
+	return perm, nil
+}
+
+// setSyscalls fills the syscall mask, no syscalls means all of them
+func setSyscalls(rule *AuditRule, syscalls []string, arch uint32) error {
+	if len(syscalls) == 0 {
+		syscalls = []string{"all"}
+	}
+
+	if arch == 0 {
+		arch = nativeArches[runtime.GOARCH][0]
+		if arch == 0 {
+			arch = nativeArches[runtime.GOARCH][1]
+		}
+	}
+
+	for _, name := range syscalls {
+		if name == "all" {
+			for i := range rule.Mask {
+				rule.Mask[i] = 0xffffffff
+			}
+			continue
+		}
+
+		nr, err := strconv.Atoi(name)
+		if err != nil {
+			table, ok := syscallTables[arch]
+			if !ok {
+				return fmt.Errorf("no syscall table for arch %#x, use syscall numbers instead", arch)
+			}
+
+			if nr, ok = table[name]; !ok {
+				return fmt.Errorf("unknown syscall %s", name)
+			}
+		}
+
+		if nr < 0 || nr >= AUDIT_BITMASK_SIZE*32 {
+			return fmt.Errorf("syscall %s is out of range", name)
+		}
+
+		rule.Mask[nr/32] |= 1 << uint(nr%32)
+	}
+
+	return nil
+}
+
+// toWireFormat encodes the rule as a kernel `audit_rule_data` struct
+func (r *AuditRule) toWireFormat() []byte {
+	var (
+		fields     [AUDIT_MAX_FIELDS]uint32
+		values     [AUDIT_MAX_FIELDS]uint32
+		fieldflags [AUDIT_MAX_FIELDS]uint32
+		strBuf     bytes.Buffer
+	)
+
+	for i, f := range r.Fields {
+		fields[i] = f.Field
+		fieldflags[i] = f.Op
+		if f.Str != "" {
+			values[i] = uint32(len(f.Str))
+			strBuf.WriteString(f.Str)
+		} else {
+			values[i] = f.Value
+		}
+	}
+
+	buf := bytes.NewBuffer(make([]byte, 0, AUDIT_RULE_DATA_LEN+strBuf.Len()+4))
+	binary.Write(buf, Endianness, r.Flags)
+	binary.Write(buf, Endianness, r.Action)
+	binary.Write(buf, Endianness, uint32(len(r.Fields)))
+	binary.Write(buf, Endianness, r.Mask)
+	binary.Write(buf, Endianness, fields)
+	binary.Write(buf, Endianness, values)
+	binary.Write(buf, Endianness, fieldflags)
+	binary.Write(buf, Endianness, uint32(strBuf.Len()))
+	buf.Write(strBuf.Bytes())
+
+	// Netlink messages are 4 byte aligned
+	for buf.Len()%4 != 0 {
+		buf.WriteByte(0)
+	}
+
+	return buf.Bytes()
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/binary"
+	"os"
+	"runtime"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseRule(t *testing.T) {
+	if runtime.GOARCH != "amd64" {
+		t.Skip("syscall numbers below are for x86_64")
+	}
+
+	// syscall rule
+	rc, err := parseRule("-a exit,always -F arch=b64 -S execve,connect -F auid>=1000 -F auid!=unset -k exec")
+	assert.Nil(t, err)
+	assert.Equal(t, ruleAdd, rc.kind)
+	r := rc.rule
+	assert.Equal(t, uint32(AUDIT_FILTER_EXIT), r.Flags)
+	assert.Equal(t, uint32(AUDIT_ALWAYS), r.Action)
+	assert.Equal(t, uint32(1<<(59-32)|1<<(42-32)), r.Mask[1], "execve is 59, connect is 42")
+	assert.Equal(t, []AuditRuleField{
+		{Field: AUDIT_ARCH, Op: AUDIT_EQUAL, Value: AUDIT_ARCH_X86_64},
+		{Field: AUDIT_LOGINUID, Op: AUDIT_GREATER_THAN_OR_EQUAL, Value: 1000},
+		{Field: AUDIT_LOGINUID, Op: AUDIT_NOT_EQUAL, Value: AUDIT_UNSET_ID},
+		{Field: AUDIT_FILTERKEY, Op: AUDIT_EQUAL, Str: "exec"},
+	}, r.Fields)
+
+	// 32 bit syscall numbers follow the arch field, in both orders of list and action
+	rc, err = parseRule("-A always,exit -S execve -F arch=b32")
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(AUDIT_FILTER_EXIT|AUDIT_FILTER_PREPEND), rc.rule.Flags)
+	assert.Equal(t, uint32(1<<11), rc.rule.Mask[0], "32 bit execve is 11")
+
+	// no syscalls means all of them
+	rc, err = parseRule("-a never,exit -F exit=-EACCES -F success=0 -F uid=0")
+	assert.Nil(t, err)
+	for _, m := range rc.rule.Mask {
+		assert.Equal(t, uint32(0xffffffff), m)
+	}
+	eacces := -int32(syscall.EACCES)
+	assert.Equal(t, []AuditRuleField{
+		{Field: AUDIT_EXIT, Op: AUDIT_EQUAL, Value: uint32(eacces)},
+		{Field: AUDIT_SUCCESS, Op: AUDIT_EQUAL, Value: AUDITSC_FAILURE},
+		{Field: AUDIT_UID, Op: AUDIT_EQUAL, Value: 0},
+	}, rc.rule.Fields)
+
+	// watches
+	rc, err = parseRule("-w /etc/passwd -p wa -k identity")
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(AUDIT_FILTER_EXIT), rc.rule.Flags)
+	assert.Equal(t, []AuditRuleField{
+		{Field: AUDIT_WATCH, Op: AUDIT_EQUAL, Str: "/etc/passwd"},
+		{Field: AUDIT_PERM, Op: AUDIT_EQUAL, Value: AUDIT_PERM_WRITE | AUDIT_PERM_ATTR},
+		{Field: AUDIT_FILTERKEY, Op: AUDIT_EQUAL, Str: "identity"},
+	}, rc.rule.Fields)
+
+	rc, err = parseRule("-W " + os.TempDir())
+	assert.Nil(t, err)
+	assert.Equal(t, ruleDelete, rc.kind)
+	assert.Equal(t, uint32(AUDIT_DIR), rc.rule.Fields[0].Field)
+	assert.Equal(t, uint32(AUDIT_PERM_ALL), rc.rule.Fields[1].Value)
+
+	// status and flush
+	rc, err = parseRule("-b 8192 -f 1 -r 100")
+	assert.Nil(t, err)
+	assert.Equal(t, ruleStatus, rc.kind)
+	assert.Equal(t, &AuditStatusPayload{
+		Mask:         AUDIT_STATUS_BACKLOG_LIMIT | AUDIT_STATUS_FAILURE | AUDIT_STATUS_RATE_LIMIT,
+		BacklogLimit: 8192,
+		Failure:      1,
+		RateLimit:    100,
+	}, rc.status)
+
+	rc, err = parseRule("-D")
+	assert.Nil(t, err)
+	assert.Equal(t, ruleDeleteAll, rc.kind)
+
+	// errors
+	for rule, expected := range map[string]string{
+		"-a exit,always -S nope":           "unknown syscall nope",
+		"-a exit,always -F nope=1":         "unknown field nope",
+		"-a exit,always -F uid":            "field uid has no operator",
+		"-a exit,always -F arch>b64":       "arch only supports the = and != operators",
+		"-a exit,always -F perm=rz":        "field perm: permission z is not one of r, w, x or a",
+		"-a exit,always -k":                "option -k requires a value",
+		"-a exit,always -C auid!=uid":      "unsupported option -C",
+		"-a exit,always -e 1":              "rule mixes options that can not be combined",
+		"-e 3":                             "option -e must be 0, 1 or 2, 3 provided",
+		"-b lots":                          "option -b requires a number, lots provided",
+		"-S execve":                        "rule does not contain an action",
+		"-w /etc/passwd -S execve -k test": "watches can not be combined with -a, -A, -d or -S",
+	} {
+		_, err = parseRule(rule)
+		assert.EqualError(t, err, expected, rule)
+	}
+}
+
+func TestAuditRuleToWireFormat(t *testing.T) {
+	r := &AuditRule{
+		Flags:  AUDIT_FILTER_EXIT,
+		Action: AUDIT_ALWAYS,
+		Fields: []AuditRuleField{
+			{Field: AUDIT_ARCH, Op: AUDIT_EQUAL, Value: AUDIT_ARCH_X86_64},
+			{Field: AUDIT_FILTERKEY, Op: AUDIT_EQUAL, Str: "exec"},
+			{Field: AUDIT_EXE, Op: AUDIT_NOT_EQUAL, Str: "/bin/ls"},
+		},
+	}
+	r.Mask[1] = 1 << 27
+
+	b := r.toWireFormat()
+	le := binary.LittleEndian
+	assert.Equal(t, AUDIT_RULE_DATA_LEN+12, len(b), "Rule data should be padded to 4 bytes")
+	assert.Equal(t, uint32(AUDIT_FILTER_EXIT), le.Uint32(b[0:]))
+	assert.Equal(t, uint32(AUDIT_ALWAYS), le.Uint32(b[4:]))
+	assert.Equal(t, uint32(3), le.Uint32(b[8:]), "field_count")
+	assert.Equal(t, uint32(1<<27), le.Uint32(b[12+4:]), "mask[1]")
+
+	fields := 12 + 4*AUDIT_BITMASK_SIZE
+	values := fields + 4*AUDIT_MAX_FIELDS
+	flags := values + 4*AUDIT_MAX_FIELDS
+	assert.Equal(t, uint32(AUDIT_FILTERKEY), le.Uint32(b[fields+4:]))
+	assert.Equal(t, uint32(AUDIT_ARCH_X86_64), le.Uint32(b[values:]))
+	assert.Equal(t, uint32(4), le.Uint32(b[values+4:]), "string values hold their length")
+	assert.Equal(t, uint32(7), le.Uint32(b[values+8:]), "string values hold their length")
+	assert.Equal(t, uint32(AUDIT_NOT_EQUAL), le.Uint32(b[flags+8:]))
+	assert.Equal(t, uint32(11), le.Uint32(b[AUDIT_RULE_DATA_LEN-4:]), "buflen")
+	assert.Equal(t, "exec/bin/ls\x00", string(b[AUDIT_RULE_DATA_LEN:]))
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"math"
+	"strings"
+	"time"
+)
+
+const (
+	SAMPLING_MAX_KEYS = 10000 // Maximum amount of token buckets per rule
+)
+
+// sampler keeps a share of the events matching its expression, either 1 in every `rate` events or up to `limit`
+// events per second for every value of the `key` field, with bursts of up to `burst` events
+type sampler struct {
+	name    string
+	expr    *filterExpr // nil matches every event
+	rate    uint64
+	count   uint64
+	key     string
+	limit   float64
+	burst   float64
+	buckets map[string]*tokenBucket
+	maxKeys int
+	now     func() time.Time
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newRateSampler(name string, expr *filterExpr, rate int) *sampler {
+	return &sampler{name: name, expr: expr, rate: uint64(rate)}
+}
+
+func newLimitSampler(name string, expr *filterExpr, key string, limit float64, burst int) *sampler {
+	if burst < 1 {
+		burst = int(math.Max(1, math.Ceil(limit)))
+	}
+
+	return &sampler{
+		name:    name,
+		expr:    expr,
+		key:     key,
+		limit:   limit,
+		burst:   float64(burst),
+		buckets: make(map[string]*tokenBucket),
+		maxKeys: SAMPLING_MAX_KEYS,
+		now:     time.Now,
+	}
+}
+
+func (s *sampler) matches(c *exprContext) bool {
+	return s.expr == nil || s.expr.Match(c)
+}
+
+// Reports if the event is kept, the first one of every `rate` events is
+func (s *sampler) keep(c *exprContext) bool {
+	if s.rate > 0 {
+		s.count++
+		return (s.count-1)%s.rate == 0
+	}
+
+	key := ""
+	if s.key != "" {
+		key = strings.Join(c.values(s.key), ",")
+	}
+
+	now := s.now()
+	b, ok := s.buckets[key]
+	if !ok {
+		if len(s.buckets) >= s.maxKeys {
+			s.prune(now)
+		}
+		b = &tokenBucket{tokens: s.burst, last: now}
+		s.buckets[key] = b
+	}
+
+	b.tokens = math.Min(s.burst, b.tokens+now.Sub(b.last).Seconds()*s.limit)
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// Removes the buckets that refilled, a new bucket would be just the same. If all of them are in use they are all
+// removed, keys are probably spread too wide to limit them one by one anyway
+func (s *sampler) prune(now time.Time) {
+	for key, b := range s.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*s.limit >= s.burst {
+			delete(s.buckets, key)
+		}
+	}
+
+	if len(s.buckets) >= s.maxKeys {
+		s.buckets = make(map[string]*tokenBucket)
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRateSampler(t *testing.T) {
+	s := newRateSampler("builds", nil, 3)
+	c := newExprContext(&AuditMessageGroup{})
+
+	var kept []bool
+	for i := 0; i < 7; i++ {
+		kept = append(kept, s.keep(c))
+	}
+	assert.Equal(t, []bool{true, false, false, true, false, false, true}, kept)
+
+	s = newRateSampler("all", nil, 1)
+	assert.True(t, s.keep(c))
+	assert.True(t, s.keep(c))
+}
+
+func TestLimitSampler(t *testing.T) {
+	s := newLimitSampler("execs", nil, "exe", 2, 3)
+	now := time.Unix(1000, 0)
+	s.now = func() time.Time { return now }
+
+	group := func(exe string) *exprContext {
+		amg := &AuditMessageGroup{UidMap: map[string]string{}, GidMap: map[string]string{}}
+		amg.AddMessage(&AuditMessage{Type: 1300, Data: `syscall=59 exe="` + exe + `"`})
+		return newExprContext(amg)
+	}
+
+	// The burst is used up first, every key has its own bucket
+	for i := 0; i < 3; i++ {
+		assert.True(t, s.keep(group("/usr/bin/cc")), "burst %d", i)
+	}
+	assert.False(t, s.keep(group("/usr/bin/cc")))
+	assert.True(t, s.keep(group("/usr/bin/ld")))
+
+	// 2 events per second refill
+	now = now.Add(500 * time.Millisecond)
+	assert.True(t, s.keep(group("/usr/bin/cc")))
+	assert.False(t, s.keep(group("/usr/bin/cc")))
+
+	now = now.Add(10 * time.Second)
+	for i := 0; i < 3; i++ {
+		assert.True(t, s.keep(group("/usr/bin/cc")), "refilled burst %d", i)
+	}
+	assert.False(t, s.keep(group("/usr/bin/cc")))
+
+	// The burst defaults to the limit
+	assert.Equal(t, float64(5), newLimitSampler("", nil, "", 4.5, 0).burst)
+	assert.Equal(t, float64(1), newLimitSampler("", nil, "", 0.1, 0).burst)
+}
+
+func TestLimitSamplerMaxKeys(t *testing.T) {
+	s := newLimitSampler("execs", nil, "exe", 1, 1)
+	s.maxKeys = 3
+	now := time.Unix(1000, 0)
+	s.now = func() time.Time { return now }
+
+	keep := func(exe string) bool {
+		amg := &AuditMessageGroup{Msgs: []*AuditMessage{{Type: 1300, Data: "exe=" + exe}}}
+		return s.keep(newExprContext(amg))
+	}
+
+	keep("a")
+	keep("b")
+	now = now.Add(time.Second)
+	keep("c")
+
+	// a and b refilled and are pruned
+	keep("d")
+	assert.Len(t, s.buckets, 2)
+
+	// All of them are in use, they are all reset
+	keep("e")
+	keep("f")
+	assert.Len(t, s.buckets, 1)
+}
+
+func TestAuditMarshallerSampling(t *testing.T) {
+	w := &bytes.Buffer{}
+	filters, err := createFilters(&Config{Filters: []Filter{{Expression: `comm == "sh"`}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	samplers, err := createSamplers(&Config{Sampling: []SamplingRule{
+		{Name: "cc", Expression: `comm == "cc"`, Rate: 2},
+		{Expression: `syscall == "execve"`, Limit: 1, Burst: 1},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := NewAuditMarshaller([]*AuditWriter{NewAuditWriter(w, 1)}, uint16(1300), uint16(1399), false, false, 0, FieldsModeOff, COMPLETE_AFTER, filters)
+	m.SetSamplers(samplers)
+
+	for seq, comm := range []string{"sh", "cc", "cc", "cc", "ls", "cat"} {
+		m.Consume(&syscall.NetlinkMessage{
+			Header: syscall.NlMsghdr{Type: 1300},
+			Data:   []byte(fmt.Sprintf(`audit(10000001:%d): arch=c000003e syscall=59 success=yes comm="%s"`, seq+1, comm)),
+		})
+	}
+	assert.Equal(t, 6, m.Flush())
+
+	// Filtered events don't count against the sampling rules
+	assert.NotContains(t, w.String(), `"sequence":1,`)
+	assert.Contains(t, w.String(), `"sequence":2,`)
+	assert.NotContains(t, w.String(), `"sequence":3,`)
+	assert.Contains(t, w.String(), `"sequence":4,`)
+	assert.Contains(t, w.String(), `"sequence":5,`)
+	assert.NotContains(t, w.String(), `"sequence":6,`)
+}
+
+func TestCreateSamplers(t *testing.T) {
+	samplers, err := createSamplers(&Config{})
+	assert.Nil(t, err)
+	assert.Len(t, samplers, 0)
+
+	samplers, err = createSamplers(&Config{Sampling: []SamplingRule{
+		{Name: "builds", Expression: `exe =~ "^/usr/bin/(cc|ld)$"`, Rate: 100},
+		{Expression: `syscall == "execve"`, Key: "auid", Limit: 50},
+	}})
+	assert.Nil(t, err)
+	if assert.Len(t, samplers, 2) {
+		assert.Equal(t, "builds", samplers[0].name)
+		assert.Equal(t, uint64(100), samplers[0].rate)
+		assert.Equal(t, "sampling-2", samplers[1].name)
+		assert.Equal(t, "auid", samplers[1].key)
+		assert.Equal(t, float64(50), samplers[1].burst)
+	}
+
+	for rule, msg := range map[*SamplingRule]string{
+		{Rate: 2, Expression: "syscall =="}: "`expression` in sampling rule 1 could not be parsed: expected a string or a number after == at 10, got end of expression",
+		{Rate: 2, Limit: 2}:                 "Sampling rule 1 can only have one of the `rate` or `limit` entries",
+		{Rate: -1}:                          "Sampling rule 1 rate must be at least 1, -1 provided",
+		{Rate: 2, Key: "exe"}:               "Sampling rule 1 can only have a `key` or `burst` with a `limit`",
+		{Limit: -1}:                         "Sampling rule 1 limit must be greater than 0, -1 provided",
+		{Limit: 1, Burst: -1}:               "Sampling rule 1 burst must be at least 1, -1 provided",
+		{Expression: `syscall == "execve"`}: "Sampling rule 1 is missing the `rate` or `limit` entry",
+	} {
+		_, err := createSamplers(&Config{Sampling: []SamplingRule{*rule}})
+		assert.EqualError(t, err, msg)
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	SESSIONS_MAX  = 4096
+	SESSION_UNSET = "4294967295" // The ses of processes that are not part of a login session
+)
+
+// Session is the login session an event is part of
+type Session struct {
+	ID       string `json:"id"`
+	Start    string `json:"start,omitempty"`
+	User     string `json:"user,omitempty"`
+	Addr     string `json:"addr,omitempty"`
+	Terminal string `json:"terminal,omitempty"`
+	start    time.Time
+}
+
+// sessionTracker follows login sessions through their USER_START, USER_LOGIN and USER_END records and adds the
+// session to every event with its `ses`. The records are seen even if they are outside of the events range
+type sessionTracker struct {
+	mu       sync.Mutex
+	max      int
+	sessions map[string]*Session
+}
+
+func newSessionTracker(max int) *sessionTracker {
+	return &sessionTracker{
+		max:      max,
+		sessions: make(map[string]*Session),
+	}
+}
+
+func (s *sessionTracker) ObserveRecord(am *AuditMessage) {
+	switch am.Type {
+	case 1105, 1106, 1112: // USER_START, USER_END, USER_LOGIN
+	default:
+		return
+	}
+
+	fields := parseFields(am.Type, am.Data)
+	ses := fields["ses"]
+	if ses == "" || ses == SESSION_UNSET || fields["res"] != "success" {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if am.Type == 1106 {
+		delete(s.sessions, ses)
+		return
+	}
+
+	start, err := parseAuditTime(am.AuditTime)
+	if err != nil {
+		start = time.Now()
+	}
+
+	// sshd sends USER_START before USER_LOGIN, either one starts the session and the other one adds to it
+	sess, ok := s.sessions[ses]
+	if !ok {
+		s.evict()
+		sess = &Session{ID: ses, start: start}
+		s.sessions[ses] = sess
+	}
+	if start.Before(sess.start) {
+		sess.start = start
+	}
+	sess.Start = sess.start.In(timezone).Format(time.RFC3339Nano)
+
+	// USER_START has the account name, USER_LOGIN the uid in `id` and older versions not even that
+	if sess.User == "" {
+		sess.User = known(fields["acct"])
+	}
+	for _, key := range []string{"id", "auid"} {
+		if uid := known(fields[key]); sess.User == "" && uid != "" && uid != SESSION_UNSET {
+			sess.User = identities.username(uid)
+		}
+	}
+
+	if addr := known(fields["addr"]); addr != "" {
+		sess.Addr = addr
+	}
+
+	// USER_LOGIN has the actual tty, USER_START the pam service
+	if terminal := known(fields["terminal"]); terminal != "" && (sess.Terminal == "" || am.Type == 1112) {
+		sess.Terminal = terminal
+	}
+}
+
+func (s *sessionTracker) Enrich(msg *AuditMessageGroup) {
+	if msg.Ses == "" || msg.Ses == SESSION_UNSET {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if sess, ok := s.sessions[msg.Ses]; ok {
+		// Later records may still add to the session
+		c := *sess
+		msg.Session = &c
+	}
+}
+
+// Makes room for a new session by dropping the oldest one, sessions that end without a USER_END record would
+// pile up otherwise
+func (s *sessionTracker) evict() {
+	if len(s.sessions) < s.max {
+		return
+	}
+
+	var oldest *Session
+	for _, sess := range s.sessions {
+		if oldest == nil || sess.start.Before(oldest.start) {
+			oldest = sess
+		}
+	}
+	delete(s.sessions, oldest.ID)
+}
+
+// Audit uses ? for values it does not know
+func known(value string) string {
+	if value == "?" {
+		return ""
+	}
+	return value
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSessionTracker(t *testing.T) {
+	defer func() {
+		timezone = time.Local
+		identities = newIdentityResolver(IDENTITY_CACHE_SIZE, IDENTITY_CACHE_TTL)
+	}()
+	timezone = time.UTC
+	identities = testIdentities(map[string]string{"1000": "alice", "1001": "bob"}, nil)
+
+	s := newSessionTracker(2)
+
+	// sshd opens the pam session before the login
+	s.ObserveRecord(&AuditMessage{Type: 1105, AuditTime: "1500000000.100", Data: `pid=800 uid=0 auid=1000 ses=3 msg='op=PAM:session_open grantors=pam_unix acct="alice" exe="/usr/sbin/sshd" hostname=10.0.0.1 addr=10.0.0.1 terminal=ssh res=success'`})
+	s.ObserveRecord(&AuditMessage{Type: 1112, AuditTime: "1500000000.200", Data: `pid=800 uid=0 auid=1000 ses=3 msg='op=login id=1000 exe="/usr/sbin/sshd" hostname=? addr=10.0.0.1 terminal=/dev/pts/0 res=success'`})
+
+	amg := &AuditMessageGroup{Ses: "3"}
+	s.Enrich(amg)
+	assert.Equal(t, &Session{
+		ID:       "3",
+		Start:    "2017-07-14T02:40:00.1Z",
+		User:     "alice",
+		Addr:     "10.0.0.1",
+		Terminal: "/dev/pts/0",
+		start:    time.Unix(1500000000, 100000000),
+	}, amg.Session)
+
+	// Older versions only have the uid
+	s.ObserveRecord(&AuditMessage{Type: 1112, AuditTime: "1500000001", Data: `pid=900 uid=0 auid=1001 ses=4 msg='op=login id=1001 exe="/usr/sbin/sshd" hostname=? addr=? terminal=/dev/pts/1 res=success'`})
+	amg = &AuditMessageGroup{Ses: "4"}
+	s.Enrich(amg)
+	assert.Equal(t, "bob", amg.Session.User)
+	assert.Equal(t, "", amg.Session.Addr)
+
+	// Failed logins, processes outside of a session and other records are ignored
+	s.ObserveRecord(&AuditMessage{Type: 1112, AuditTime: "1500000002", Data: `pid=901 uid=0 auid=1001 ses=5 msg='op=login acct="bob" exe="/usr/sbin/sshd" hostname=? addr=10.0.0.2 terminal=ssh res=failed'`})
+	s.ObserveRecord(&AuditMessage{Type: 1112, AuditTime: "1500000002", Data: `pid=901 uid=0 auid=4294967295 ses=4294967295 msg='op=login acct="bob" exe="/usr/sbin/sshd" hostname=? addr=10.0.0.2 terminal=ssh res=success'`})
+	s.ObserveRecord(&AuditMessage{Type: 1300, AuditTime: "1500000002", Data: `arch=c000003e syscall=59 success=yes pid=902 auid=1001 ses=6`})
+	assert.Len(t, s.sessions, 2)
+
+	amg = &AuditMessageGroup{Ses: "4294967295"}
+	s.Enrich(amg)
+	assert.Nil(t, amg.Session)
+
+	// Sessions end with USER_END
+	s.ObserveRecord(&AuditMessage{Type: 1106, AuditTime: "1500000100", Data: `pid=800 uid=0 auid=1000 ses=3 msg='op=PAM:session_close grantors=pam_unix acct="alice" exe="/usr/sbin/sshd" hostname=10.0.0.1 addr=10.0.0.1 terminal=ssh res=success'`})
+	amg = &AuditMessageGroup{Ses: "3"}
+	s.Enrich(amg)
+	assert.Nil(t, amg.Session)
+	assert.Len(t, s.sessions, 1)
+
+	// The oldest session makes room for new ones
+	s.ObserveRecord(&AuditMessage{Type: 1105, AuditTime: "1500000200", Data: `pid=1000 uid=0 auid=0 ses=7 msg='op=PAM:session_open acct="root" exe="/usr/sbin/cron" hostname=? addr=? terminal=cron res=success'`})
+	s.ObserveRecord(&AuditMessage{Type: 1105, AuditTime: "1500000300", Data: `pid=1001 uid=0 auid=0 ses=8 msg='op=PAM:session_open acct="root" exe="/usr/sbin/cron" hostname=? addr=? terminal=cron res=success'`})
+	assert.Len(t, s.sessions, 2)
+	assert.NotContains(t, s.sessions, "4")
+	assert.Equal(t, "cron", s.sessions["8"].Terminal)
+}
+
+func TestAuditMarshallerRecordObserver(t *testing.T) {
+	w := &noopWriter{}
+	m := NewAuditMarshaller([]*AuditWriter{NewAuditWriter(w, 1)}, uint16(1300), uint16(1399), false, false, 0, FieldsModeOff, COMPLETE_AFTER, []AuditFilter{})
+	s := newSessionTracker(SESSIONS_MAX)
+	m.SetEnrichers([]enricher{s})
+
+	// USER_LOGIN is outside of the events range but still starts the session
+	m.Consume(&syscall.NetlinkMessage{
+		Header: syscall.NlMsghdr{Type: 1112},
+		Data:   []byte(`audit(10000001.000:1): pid=800 uid=0 auid=1000 ses=3 msg='op=login acct="alice" exe="/usr/sbin/sshd" hostname=? addr=10.0.0.1 terminal=/dev/pts/0 res=success'`),
+	})
+	m.Consume(&syscall.NetlinkMessage{
+		Header: syscall.NlMsghdr{Type: 1300},
+		Data:   []byte(`audit(10000002.000:2): arch=c000003e syscall=59 success=yes ppid=800 pid=900 auid=1000 ses=3 comm="bash"`),
+	})
+
+	amg := m.msgs[2]
+	assert.Equal(t, "3", amg.Ses)
+	assert.Equal(t, 1, m.Flush())
+	if assert.NotNil(t, amg.Session) {
+		assert.Equal(t, "alice", amg.Session.User)
+		assert.Equal(t, "10.0.0.1", amg.Session.Addr)
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"net"
+	"strconv"
+	"syscall"
+)
+
+// Sockaddr is the decoded `saddr` of a SOCKADDR record
+type Sockaddr struct {
+	Family string `json:"family"`
+	Addr   string `json:"addr,omitempty"`
+	Port   int    `json:"port,omitempty"` // The port id of the socket for netlink
+	Path   string `json:"path,omitempty"` // Abstract unix sockets start with @
+}
+
+// Decodes the saddr of a SOCKADDR record into the group
+func (amg *AuditMessageGroup) parseSockaddr(am *AuditMessage) {
+	if sa := parseSockaddr(recordValue(am.Data, "saddr=")); sa != nil {
+		amg.Sockaddr = sa
+	}
+}
+
+// Decodes a hex encoded sockaddr struct, the family is in host byte order and ports are in network byte order.
+// Returns nil if the value is not a sockaddr
+func parseSockaddr(value string) *Sockaddr {
+	b, err := hex.DecodeString(value)
+	if err != nil || len(b) < 2 {
+		return nil
+	}
+
+	family := binary.LittleEndian.Uint16(b[0:2])
+	switch family {
+	case syscall.AF_INET:
+		if len(b) < 8 {
+			return nil
+		}
+		return &Sockaddr{
+			Family: "inet",
+			Port:   int(binary.BigEndian.Uint16(b[2:4])),
+			Addr:   net.IP(b[4:8]).String(),
+		}
+
+	case syscall.AF_INET6:
+		if len(b) < 24 {
+			return nil
+		}
+		return &Sockaddr{
+			Family: "inet6",
+			Port:   int(binary.BigEndian.Uint16(b[2:4])),
+			Addr:   net.IP(b[8:24]).String(),
+		}
+
+	case syscall.AF_UNIX:
+		path := b[2:]
+		if len(path) > 0 && path[0] == 0 {
+			// Abstract sockets are not terminated, but the kernel may pad them
+			return &Sockaddr{Family: "unix", Path: "@" + string(bytes.TrimRight(path[1:], "\x00"))}
+		}
+		if i := bytes.IndexByte(path, 0); i >= 0 {
+			path = path[:i]
+		}
+		return &Sockaddr{Family: "unix", Path: string(path)}
+
+	case syscall.AF_NETLINK:
+		if len(b) < 8 {
+			return nil
+		}
+		return &Sockaddr{
+			Family: "netlink",
+			Port:   int(binary.LittleEndian.Uint32(b[4:8])),
+		}
+	}
+
+	return &Sockaddr{Family: strconv.Itoa(int(family))}
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseSockaddr(t *testing.T) {
+	assert.Equal(t, &Sockaddr{Family: "inet", Addr: "127.0.0.1", Port: 22}, parseSockaddr("020000167F0000010000000000000000"))
+	assert.Equal(t, &Sockaddr{Family: "inet6", Addr: "2001:db8::1", Port: 443}, parseSockaddr("0A0001BB0000000020010DB800000000000000000000000100000000"))
+	assert.Equal(t, &Sockaddr{Family: "unix", Path: "/run/systemd/journal/socket"}, parseSockaddr("01002F72756E2F73797374656D642F6A6F75726E616C2F736F636B657400"))
+	assert.Equal(t, &Sockaddr{Family: "unix", Path: "@/tmp/.X11-unix/X0"}, parseSockaddr("0100002F746D702F2E5831312D756E69782F5830"))
+	assert.Equal(t, &Sockaddr{Family: "netlink", Port: 1234}, parseSockaddr("10000000D204000000000000"))
+	assert.Equal(t, &Sockaddr{Family: "17"}, parseSockaddr("11000300"))
+
+	// Truncated or not hex
+	assert.Nil(t, parseSockaddr("0200"))
+	assert.Nil(t, parseSockaddr("0A0001BB00000000"))
+	assert.Nil(t, parseSockaddr("zz"))
+	assert.Nil(t, parseSockaddr(""))
+}
+
+func TestAuditMessageGroupSockaddr(t *testing.T) {
+	amg := &AuditMessageGroup{}
+	amg.AddMessage(&AuditMessage{Type: 1306, Data: "saddr=020000357F000035000000000000000 SADDR={ fam=inet laddr=127.0.0.53 lport=53 }"})
+	assert.Nil(t, amg.Sockaddr)
+
+	amg.AddMessage(&AuditMessage{Type: 1306, Data: "saddr=020000357F0000350000000000000000 SADDR={ fam=inet laddr=127.0.0.53 lport=53 }"})
+	assert.Equal(t, &Sockaddr{Family: "inet", Addr: "127.0.0.53", Port: 53}, amg.Sockaddr)
+}
@@ -0,0 +1,471 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// Every spooled record starts with the length of its payload and the crc32 checksum of the payload
+	SPOOL_RECORD_HEADER = 8
+
+	// Protects from allocating huge buffers when the length of a record is corrupted
+	SPOOL_MAX_RECORD = 64 << 20
+)
+
+var errSpoolFull = errors.New("spool is full")
+
+var (
+	// Open spools by directory, a reloaded output keeps using the spool of the output it replaces
+	openSpools   = make(map[string]*Spool)
+	openSpoolsMu sync.Mutex
+)
+
+type spoolSegment struct {
+	id      uint64
+	records int   // records that were not replayed yet
+	size    int64 // size of the segment file
+}
+
+// Spool is an on disk queue of encoded messages for a single output.
+// Messages are appended to segment files that are removed once all their messages were replayed.
+// The replay position is kept in a cursor file so a restart does not replay messages twice
+type Spool struct {
+	mu          sync.Mutex
+	dir         string
+	name        string
+	maxSize     int64
+	segmentSize int64
+
+	segments []*spoolSegment
+	nextId   uint64
+	w        *os.File // the last segment, nil until something is appended after opening the spool
+	r        *os.File // the first segment
+	rOffset  int64
+	peekSize int64
+	cursor   *os.File
+
+	depth int
+	size  int64
+
+	// Signals the replay loop that messages were appended
+	wake chan struct{}
+
+	// Only one output replays at a time, the old and the new output overlap during a reload
+	replayMu sync.Mutex
+}
+
+// OpenSpool opens or creates the spool in dir, messages spooled by a previous run are kept.
+// Corrupted or truncated records at the end of a segment are removed.
+// A spool that is already open is returned with the new size limits
+func OpenSpool(dir, name string, maxSize, segmentSize int64) (*Spool, error) {
+	if segmentSize < 1 || maxSize < segmentSize {
+		return nil, fmt.Errorf("spool segment_size must be at least 1 and not bigger than max_size, %d and %d provided", segmentSize, maxSize)
+	}
+
+	dir = filepath.Clean(dir)
+	openSpoolsMu.Lock()
+	defer openSpoolsMu.Unlock()
+
+	if s, ok := openSpools[dir]; ok {
+		s.mu.Lock()
+		s.maxSize = maxSize
+		s.segmentSize = segmentSize
+		s.mu.Unlock()
+		return s, nil
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create spool directory %s: %v", dir, err)
+	}
+
+	s := &Spool{
+		dir:         dir,
+		name:        name,
+		maxSize:     maxSize,
+		segmentSize: segmentSize,
+		wake:        make(chan struct{}, 1),
+	}
+
+	var err error
+	if s.cursor, err = os.OpenFile(filepath.Join(dir, "cursor"), os.O_RDWR|os.O_CREATE, 0600); err != nil {
+		return nil, fmt.Errorf("failed to open spool cursor: %v", err)
+	}
+
+	cursorId, cursorOffset := s.readCursor()
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read spool directory %s: %v", dir, err)
+	}
+
+	for _, f := range files {
+		if !strings.HasSuffix(f.Name(), ".seg") {
+			continue
+		}
+
+		id, err := strconv.ParseUint(strings.TrimSuffix(f.Name(), ".seg"), 10, 64)
+		if err != nil {
+			continue
+		}
+
+		s.segments = append(s.segments, &spoolSegment{id: id, size: f.Size()})
+	}
+
+	sort.Slice(s.segments, func(i, j int) bool { return s.segments[i].id < s.segments[j].id })
+
+	for i := 0; i < len(s.segments); i++ {
+		seg := s.segments[i]
+
+		// Segments before the cursor were replayed completely but not removed yet
+		if seg.id < cursorId {
+			os.Remove(s.segmentPath(seg.id))
+			s.segments = append(s.segments[:i], s.segments[i+1:]...)
+			i--
+			continue
+		}
+
+		start := int64(0)
+		if seg.id == cursorId {
+			start = cursorOffset
+		}
+
+		if err := s.scanSegment(seg, start); err != nil {
+			return nil, err
+		}
+
+		s.depth += seg.records
+		s.size += seg.size
+	}
+
+	s.nextId = cursorId
+	if len(s.segments) > 0 {
+		if s.segments[0].id == cursorId {
+			s.rOffset = cursorOffset
+		}
+		s.nextId = s.segments[len(s.segments)-1].id + 1
+	}
+	if s.nextId == 0 {
+		s.nextId = 1
+	}
+
+	s.updateMetrics()
+	openSpools[dir] = s
+	return s, nil
+}
+
+// openLeftoverSpool opens the spool in dir for an output that does not spool on failure anymore.
+// Nil is returned if there is nothing to replay, the spool is neither in use nor holds messages
+func openLeftoverSpool(dir, name string, maxSize, segmentSize int64) (*Spool, error) {
+	openSpoolsMu.Lock()
+	_, open := openSpools[filepath.Clean(dir)]
+	openSpoolsMu.Unlock()
+
+	if !open {
+		if _, err := os.Stat(dir); os.IsNotExist(err) {
+			return nil, nil
+		}
+	}
+
+	s, err := OpenSpool(dir, name, maxSize, segmentSize)
+	if err != nil {
+		return nil, err
+	}
+
+	// A spool that is in use may still get messages from the output that is being replaced
+	if !open && s.Len() == 0 {
+		s.Close()
+		return nil, nil
+	}
+	return s, nil
+}
+
+// Counts the records of a segment starting at offset and truncates anything after the last valid record
+func (s *Spool) scanSegment(seg *spoolSegment, offset int64) error {
+	f, err := os.OpenFile(s.segmentPath(seg.id), os.O_RDWR, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open spool segment: %v", err)
+	}
+	defer f.Close()
+
+	for offset < seg.size {
+		n, err := readRecord(f, offset, nil)
+		if err != nil {
+			// The torn record is lost at least, how many records followed it is unknown
+			logrus.WithError(err).WithField("output", s.name).Errorf("spool segment %d is corrupted at offset %d, truncating it and dropping %d bytes", seg.id, offset, seg.size-offset)
+			spoolCorruptedTotal.WithLabelValues(hostname, s.name).Inc()
+			if err := f.Truncate(offset); err != nil {
+				return fmt.Errorf("failed to truncate spool segment: %v", err)
+			}
+			seg.size = offset
+			break
+		}
+
+		offset += n
+		seg.records++
+	}
+
+	return nil
+}
+
+// Append adds a message to the end of the spool
+func (s *Spool) Append(b []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(b) > SPOOL_MAX_RECORD {
+		return fmt.Errorf("message of %d bytes is too big for the spool", len(b))
+	}
+
+	recordSize := int64(SPOOL_RECORD_HEADER + len(b))
+	if s.size+recordSize > s.maxSize {
+		return errSpoolFull
+	}
+
+	last := len(s.segments) - 1
+	if s.w == nil || s.segments[last].size+recordSize > s.segmentSize {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+		last = len(s.segments) - 1
+	}
+
+	record := make([]byte, recordSize)
+	binary.BigEndian.PutUint32(record[0:4], uint32(len(b)))
+	binary.BigEndian.PutUint32(record[4:8], crc32.ChecksumIEEE(b))
+	copy(record[SPOOL_RECORD_HEADER:], b)
+
+	seg := s.segments[last]
+	if _, err := s.w.WriteAt(record, seg.size); err != nil {
+		return fmt.Errorf("failed to write to spool: %v", err)
+	}
+
+	seg.size += recordSize
+	seg.records++
+	s.size += recordSize
+	s.depth++
+	s.updateMetrics()
+	s.notify()
+
+	return nil
+}
+
+// Wakes up the replay loop without waiting for it
+func (s *Spool) notify() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Starts a new segment for appending
+func (s *Spool) rotate() error {
+	id := s.nextId
+	f, err := os.OpenFile(s.segmentPath(id), os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to create spool segment: %v", err)
+	}
+
+	if s.w != nil {
+		s.w.Sync()
+		if s.w != s.r {
+			s.w.Close()
+		}
+	}
+
+	s.nextId++
+	s.w = f
+	s.segments = append(s.segments, &spoolSegment{id: id})
+	return nil
+}
+
+// Peek returns the oldest message in the spool without removing it, io.EOF means the spool is empty
+func (s *Spool) Peek() ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for s.depth > 0 {
+		seg := s.segments[0]
+		if seg.records == 0 {
+			s.removeFirst()
+			continue
+		}
+
+		if s.r == nil {
+			if s.w != nil && len(s.segments) == 1 {
+				s.r = s.w
+			} else {
+				f, err := os.Open(s.segmentPath(seg.id))
+				if err != nil {
+					return nil, fmt.Errorf("failed to open spool segment: %v", err)
+				}
+				s.r = f
+			}
+		}
+
+		var b []byte
+		n, err := readRecord(s.r, s.rOffset, &b)
+		if err != nil {
+			// There is no way to find the next record, skip the rest of the segment
+			logrus.WithError(err).WithField("output", s.name).Errorf("spool segment %d is corrupted at offset %d, dropping %d messages", seg.id, s.rOffset, seg.records)
+			spoolCorruptedTotal.WithLabelValues(hostname, s.name).Add(float64(seg.records))
+			s.depth -= seg.records
+			seg.records = 0
+			s.removeFirst()
+			continue
+		}
+
+		s.peekSize = n
+		return b, nil
+	}
+
+	return nil, io.EOF
+}
+
+// Commit removes the message returned by the last Peek
+func (s *Spool) Commit() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.peekSize == 0 {
+		return
+	}
+
+	seg := s.segments[0]
+	s.rOffset += s.peekSize
+	s.peekSize = 0
+	seg.records--
+	s.depth--
+
+	if seg.records == 0 {
+		s.removeFirst()
+	} else {
+		s.writeCursor(seg.id, s.rOffset)
+	}
+
+	s.updateMetrics()
+}
+
+// Removes the first segment, the caller must hold the lock
+func (s *Spool) removeFirst() {
+	seg := s.segments[0]
+
+	if s.r != nil {
+		s.r.Close()
+		if s.r == s.w {
+			s.w = nil
+		}
+		s.r = nil
+	}
+
+	if len(s.segments) == 1 && s.w != nil {
+		s.w.Close()
+		s.w = nil
+	}
+
+	os.Remove(s.segmentPath(seg.id))
+	s.segments = s.segments[1:]
+	s.size -= seg.size
+	s.rOffset = 0
+
+	if len(s.segments) > 0 {
+		s.writeCursor(s.segments[0].id, 0)
+	} else {
+		s.writeCursor(s.nextId, 0)
+	}
+
+	s.updateMetrics()
+}
+
+// Len returns how many messages are waiting in the spool
+func (s *Spool) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.depth
+}
+
+// Close closes all open files, spooled messages are kept on disk
+func (s *Spool) Close() error {
+	openSpoolsMu.Lock()
+	delete(openSpools, s.dir)
+	openSpoolsMu.Unlock()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.r != nil && s.r != s.w {
+		s.r.Close()
+	}
+	if s.w != nil {
+		s.w.Sync()
+		s.w.Close()
+	}
+	s.r, s.w = nil, nil
+	return s.cursor.Close()
+}
+
+func (s *Spool) segmentPath(id uint64) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%020d.seg", id))
+}
+
+func (s *Spool) readCursor() (uint64, int64) {
+	buf := make([]byte, 16)
+	if _, err := s.cursor.ReadAt(buf, 0); err != nil {
+		return 0, 0
+	}
+	return binary.BigEndian.Uint64(buf[0:8]), int64(binary.BigEndian.Uint64(buf[8:16]))
+}
+
+func (s *Spool) writeCursor(id uint64, offset int64) {
+	buf := make([]byte, 16)
+	binary.BigEndian.PutUint64(buf[0:8], id)
+	binary.BigEndian.PutUint64(buf[8:16], uint64(offset))
+	if _, err := s.cursor.WriteAt(buf, 0); err != nil {
+		logrus.WithError(err).WithField("output", s.name).Error("failed to write spool cursor")
+	}
+}
+
+func (s *Spool) updateMetrics() {
+	spoolDepth.WithLabelValues(hostname, s.name).Set(float64(s.depth))
+	spoolBytes.WithLabelValues(hostname, s.name).Set(float64(s.size))
+}
+
+// Reads the record at offset and verifies its checksum, the payload is only returned if b is not nil.
+// Returns the size of the record including its header
+func readRecord(r io.ReaderAt, offset int64, b *[]byte) (int64, error) {
+	header := make([]byte, SPOOL_RECORD_HEADER)
+	if _, err := r.ReadAt(header, offset); err != nil {
+		return 0, fmt.Errorf("failed to read record header: %v", err)
+	}
+
+	length := binary.BigEndian.Uint32(header[0:4])
+	if length > SPOOL_MAX_RECORD {
+		return 0, fmt.Errorf("record length %d is too big", length)
+	}
+
+	payload := make([]byte, length)
+	if _, err := r.ReadAt(payload, offset+SPOOL_RECORD_HEADER); err != nil {
+		return 0, fmt.Errorf("failed to read record: %v", err)
+	}
+
+	if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(header[4:8]) {
+		return 0, errors.New("record checksum mismatch")
+	}
+
+	if b != nil {
+		*b = payload
+	}
+	return int64(len(payload) + SPOOL_RECORD_HEADER), nil
+}
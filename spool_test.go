@@ -0,0 +1,298 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSpool(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	s, err := OpenSpool(dir, "test", 1024, 32)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = s.Peek()
+	assert.Equal(t, io.EOF, err)
+
+	// Every record is 8 bytes of header plus the payload, 2 records fit into a segment
+	for _, m := range []string{"one", "two", "three", "four", "five"} {
+		assert.NoError(t, s.Append([]byte(m)))
+	}
+	assert.Equal(t, 5, s.Len())
+	assert.Equal(t, int64(5*8+19), s.size)
+	assert.Len(t, segmentFiles(t, dir), 3)
+
+	assertPeek(t, s, "one")
+	assertPeek(t, s, "one", "Peek should not remove the message")
+	s.Commit()
+	assertPeek(t, s, "two")
+	s.Commit()
+	assert.Len(t, segmentFiles(t, dir), 2, "Replayed segments should be removed")
+	assertPeek(t, s, "three")
+	assert.NoError(t, s.Close())
+
+	// Messages that were not replayed survive a restart, the committed ones are not replayed again
+	s, err = OpenSpool(dir, "test", 1024, 32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 3, s.Len())
+	assertPeek(t, s, "three")
+	s.Commit()
+	assert.Equal(t, 2, s.Len())
+	assert.NoError(t, s.Close())
+
+	s, err = OpenSpool(dir, "test", 1024, 32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 2, s.Len())
+	assertPeek(t, s, "four")
+	s.Commit()
+
+	// Appending while replaying keeps the order
+	assert.NoError(t, s.Append([]byte("six")))
+	assertPeek(t, s, "five")
+	s.Commit()
+	assertPeek(t, s, "six")
+	s.Commit()
+
+	_, err = s.Peek()
+	assert.Equal(t, io.EOF, err)
+	assert.Equal(t, 0, s.Len())
+	assert.Equal(t, int64(0), s.size)
+	assert.Len(t, segmentFiles(t, dir), 0, "An empty spool should not keep segments")
+
+	// New segments must not be mistaken for replayed ones after a restart
+	assert.NoError(t, s.Append([]byte("seven")))
+	assert.NoError(t, s.Close())
+	s, err = OpenSpool(dir, "test", 1024, 32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertPeek(t, s, "seven")
+	assert.NoError(t, s.Close())
+}
+
+func TestSpoolMaxSize(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	s, err := OpenSpool(dir, "test", 30, 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	assert.NoError(t, s.Append([]byte("0123456789")))
+	assert.Equal(t, errSpoolFull, s.Append([]byte("0123456789")))
+	assert.Equal(t, 1, s.Len())
+
+	_, err = OpenSpool(dir, "test", 10, 20)
+	assert.EqualError(t, err, "spool segment_size must be at least 1 and not bigger than max_size, 20 and 10 provided")
+}
+
+func TestSpoolCorruption(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	s, err := OpenSpool(dir, "test", 1024, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.NoError(t, s.Append([]byte("one")))
+	assert.NoError(t, s.Append([]byte("two")))
+	assert.NoError(t, s.Close())
+
+	// A torn write at the end of a segment is cut off when opening the spool
+	files := segmentFiles(t, dir)
+	f, err := os.OpenFile(files[0], os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte{0, 0, 0, 9, 1})
+	f.Close()
+
+	lb := hookLogger()
+	defer resetLogger()
+
+	s, err = OpenSpool(dir, "test", 1024, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 2, s.Len())
+	assert.Contains(t, lb.String(), "spool segment 1 is corrupted at offset 22, truncating it and dropping 5 bytes")
+
+	// A checksum mismatch drops the rest of the segment
+	f, err = os.OpenFile(files[0], os.O_WRONLY, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteAt([]byte("x"), 8)
+	f.Close()
+
+	_, err = s.Peek()
+	assert.Equal(t, io.EOF, err)
+	assert.Equal(t, 0, s.Len())
+	assert.Contains(t, lb.String(), "spool segment 1 is corrupted at offset 0, dropping 2 messages")
+	assert.NoError(t, s.Close())
+}
+
+func TestAuditWriterSpool(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	s, err := OpenSpool(dir, "test", 1024*1024, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	ow := &outageWriter{failing: true}
+	w := NewAuditWriter(ow, 1)
+	w.onFailure = FailurePolicySpool
+	w.spool = s
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go w.replay(ctx)
+
+	// Messages are spooled during the outage
+	assert.NoError(t, w.Write(&AuditMessageGroup{Seq: 1}))
+	assert.NoError(t, w.Write(&AuditMessageGroup{Seq: 2}))
+	assert.Equal(t, 2, s.Len())
+
+	// Once the output recovers they are replayed in order, new messages wait for the spool to drain
+	ow.recover()
+	assert.NoError(t, w.Write(&AuditMessageGroup{Seq: 3}))
+
+	deadline := time.Now().Add(5 * time.Second)
+	for s.Len() > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, 0, s.Len())
+
+	assert.NoError(t, w.Write(&AuditMessageGroup{Seq: 4}))
+
+	lines := bytes.Split(bytes.TrimSpace(ow.bytes()), []byte("\n"))
+	if assert.Len(t, lines, 4) {
+		for i, l := range lines {
+			assert.Contains(t, string(l), `"sequence":`+string('1'+byte(i))+`,`)
+		}
+	}
+}
+
+func TestAddOutputLeftoverSpool(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	config := defaultConfig()
+	config.Spool.Directory = dir
+
+	// Outputs that never spooled do not get a spool
+	w := NewAuditWriter(&outageWriter{}, 1)
+	_, err := addOutput(context.Background(), config, nil, w, "test", OutputConfig{OnFailure: FailurePolicyDrop})
+	assert.NoError(t, err)
+	assert.Nil(t, w.spool)
+
+	// Neither do outputs with an empty spool
+	s, err := OpenSpool(filepath.Join(dir, "test"), "test", 1024, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NoError(t, s.Close())
+
+	_, err = addOutput(context.Background(), config, nil, w, "test", OutputConfig{OnFailure: FailurePolicyDrop})
+	assert.NoError(t, err)
+	assert.Nil(t, w.spool)
+
+	// Messages spooled before the output stopped spooling are replayed
+	s, err = OpenSpool(filepath.Join(dir, "test"), "test", 1024, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NoError(t, s.Append([]byte("one\n")))
+	assert.NoError(t, s.Close())
+
+	ow := &outageWriter{}
+	w = NewAuditWriter(ow, 1)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	_, err = addOutput(ctx, config, nil, w, "test", OutputConfig{OnFailure: FailurePolicyDrop})
+	assert.NoError(t, err)
+	if assert.NotNil(t, w.spool) {
+		defer w.spool.Close()
+
+		deadline := time.Now().Add(5 * time.Second)
+		for w.spool.Len() > 0 && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+		assert.Equal(t, 0, w.spool.Len())
+		assert.Equal(t, "one\n", string(ow.bytes()))
+	}
+}
+
+// outageWriter fails until it recovers
+type outageWriter struct {
+	mu      sync.Mutex
+	failing bool
+	buf     bytes.Buffer
+}
+
+func (o *outageWriter) Write(p []byte) (int, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.failing {
+		return 0, errors.New("output is down")
+	}
+	return o.buf.Write(p)
+}
+
+func (o *outageWriter) recover() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.failing = false
+}
+
+func (o *outageWriter) bytes() []byte {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.buf.Bytes()
+}
+
+func assertPeek(t *testing.T, s *Spool, expected string, msgAndArgs ...interface{}) {
+	b, err := s.Peek()
+	assert.NoError(t, err)
+	assert.Equal(t, expected, string(b), msgAndArgs...)
+}
+
+func segmentFiles(t *testing.T, dir string) []string {
+	files, err := filepath.Glob(filepath.Join(dir, "*.seg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "go-audit-spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
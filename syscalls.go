@@ -0,0 +1,45 @@
+package main
+
+import (
+	"strconv"
+)
+
+// syscallNames maps an audit arch and a syscall number to the syscall name
+var syscallNames = buildSyscallNames()
+
+func buildSyscallNames() map[uint32]map[int]string {
+	names := make(map[uint32]map[int]string, len(syscallTables))
+	for arch, table := range syscallTables {
+		names[arch] = make(map[int]string, len(table))
+		for name, nr := range table {
+			names[arch][nr] = name
+		}
+	}
+	return names
+}
+
+// syscallName translates the `arch` and `syscall` values of a SYSCALL record, arch is the hex value the kernel sends.
+// Returns an empty string for unknown architectures and syscalls
+func syscallName(arch, nr string) string {
+	a, err := strconv.ParseUint(arch, 16, 32)
+	if err != nil {
+		return ""
+	}
+
+	n, err := strconv.Atoi(nr)
+	if err != nil {
+		return ""
+	}
+
+	return syscallNames[uint32(a)][n]
+}
+
+// isSyscallName checks if the name is a syscall on any of the known architectures
+func isSyscallName(name string) bool {
+	for _, table := range syscallTables {
+		if _, ok := table[name]; ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSyscallName(t *testing.T) {
+	assert.Equal(t, "bind", syscallName("c000003e", "49"))
+	assert.Equal(t, "execve", syscallName("c000003e", "59"))
+	assert.Equal(t, "execve", syscallName("40000003", "11"))
+	assert.Equal(t, "execve", syscallName("c00000b7", "221"))
+	assert.Equal(t, "execve", syscallName("40000028", "11"))
+
+	assert.Equal(t, "", syscallName("c000003e", "9999"), "Unknown syscall")
+	assert.Equal(t, "", syscallName("deadbeef", "59"), "Unknown arch")
+	assert.Equal(t, "", syscallName("", "59"))
+	assert.Equal(t, "", syscallName("c000003e", ""))
+
+	assert.True(t, isSyscallName("bind"))
+	assert.True(t, isSyscallName("socketcall"), "i386 only syscalls are known as well")
+	assert.False(t, isSyscallName("bindx"))
+}
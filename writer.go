@@ -1,46 +1,289 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
+	"os"
+	"sync"
 	"time"
 
 	"github.com/sirupsen/logrus"
 )
 
+// Defines possible failure policies of an output.
+const (
+	FailurePolicyExit  = "exit"
+	FailurePolicyDrop  = "drop"
+	FailurePolicySpool = "spool"
+	FailurePolicyBlock = "block"
+)
+
+// Defaults for the exponential backoff between write attempts
+const (
+	BACKOFF_INITIAL = time.Second
+	BACKOFF_MAX     = 30 * time.Second
+)
+
+// errOutputStopped is returned by a blocked write when its output was stopped before it recovered
+var errOutputStopped = errors.New("output was stopped before it recovered")
+
+// flusher is implemented by outputs that queue messages before delivering them
+type flusher interface {
+	// Flush waits until the queue is empty or the timeout expired and returns how many messages are left
+	Flush(timeout time.Duration) int
+}
+
+// groupWriter is implemented by outputs that write a message group from its struct. They are only handed the json
+// of spooled messages
+type groupWriter interface {
+	WriteGroup(msg *AuditMessageGroup) error
+}
+
 type AuditWriter struct {
-	e        *json.Encoder
-	w        io.Writer
-	attempts int
+	w              io.Writer
+	name           string
+	attempts       int
+	onFailure      string
+	spool          *Spool
+	backoffInitial time.Duration
+	backoffMax     time.Duration
+	stop           chan struct{}
+	stopOnce       sync.Once
 }
 
 func NewAuditWriter(w io.Writer, attempts int) *AuditWriter {
 	return &AuditWriter{
-		e:        json.NewEncoder(w),
-		w:        w,
-		attempts: attempts,
+		w:              w,
+		attempts:       attempts,
+		onFailure:      FailurePolicyExit,
+		backoffInitial: BACKOFF_INITIAL,
+		backoffMax:     BACKOFF_MAX,
+		stop:           make(chan struct{}),
 	}
 }
 
 func (a *AuditWriter) Write(msg *AuditMessageGroup) (err error) {
-	sentLogsTotal.WithLabelValues(hostname).Inc()
+	sentLogsTotal.WithLabelValues(hostname, a.name).Inc()
+
+	// Outputs that write the struct only need the json if the message may end up in the spool
+	var b []byte
+	if _, ok := a.w.(groupWriter); !ok || a.spool != nil {
+		if b, err = json.Marshal(msg); err != nil {
+			sentErrorsTotal.WithLabelValues(hostname, a.name).Inc()
+			return err
+		}
+		b = append(b, '\n')
+	}
+
+	// Messages must not overtake the ones that are still waiting in the spool
+	if a.spool != nil && a.spool.Len() > 0 {
+		a.spoolMessage(b)
+		return nil
+	}
+
+	if err = a.write(msg, b); err == nil {
+		return nil
+	}
+
+	sentErrorsTotal.WithLabelValues(hostname, a.name).Inc()
+
+	switch a.onFailure {
+	case FailurePolicySpool:
+		logrus.WithError(err).WithField("output", a.name).Warn("failed to write message, spooling it until the output recovers")
+		a.spoolMessage(b)
+		return nil
+
+	case FailurePolicyBlock:
+		// Holding on to the message stops the marshaller, the kernel queues events until the output recovers
+		logrus.WithError(err).WithField("output", a.name).Error("failed to write message, blocking until the output recovers")
+		for failures := a.attempts; ; failures++ {
+			select {
+			case <-a.stop:
+				return errOutputStopped
+			case <-time.After(a.backoff(failures)):
+			}
+
+			if err = a.writeOnce(msg, b); err == nil {
+				logrus.WithField("output", a.name).Warnf("output recovered after %d attempts", failures+1)
+				return nil
+			}
+		}
+	}
+
+	return err
+}
+
+// Stop makes a write that blocks until the output recovers give up, the message it holds is lost
+func (a *AuditWriter) Stop() {
+	a.stopOnce.Do(func() { close(a.stop) })
+}
+
+// Adds a message to the spool. A full or broken spool drops the message, exiting would lose the kernel queue as well
+func (a *AuditWriter) spoolMessage(b []byte) {
+	if err := a.spool.Append(b); err != nil {
+		logrus.WithError(err).WithField("output", a.name).Warn("failed to spool message, dropping it")
+		droppedLogsTotal.WithLabelValues(hostname, a.name).Inc()
+	}
+}
+
+// Writes a message, failed attempts are retried with an exponential backoff
+func (a *AuditWriter) write(msg *AuditMessageGroup, b []byte) (err error) {
 	for i := 0; i < a.attempts; i++ {
-		err = a.e.Encode(msg)
+		err = a.writeOnce(msg, b)
 		if err == nil {
-			break
+			return nil
 		}
 
-		if i != a.attempts {
-			// We have to reset the encoder because write errors are kept internally and can not be retried
-			a.e = json.NewEncoder(a.w)
-			logrus.WithError(err).Error("failed to write message, retrying in 1 second")
-			time.Sleep(time.Second * 1)
+		if i != a.attempts-1 {
+			wait := a.backoff(i + 1)
+			logrus.WithError(err).WithField("output", a.name).Errorf("failed to write message, retrying in %v", wait)
+			time.Sleep(wait)
 		}
 	}
 
-	if err != nil {
-		sentErrorsTotal.WithLabelValues(hostname).Inc()
-		return err
+	return err
+}
+
+// Writes a message once, as a struct to outputs that take one and as json to the others
+func (a *AuditWriter) writeOnce(msg *AuditMessageGroup, b []byte) error {
+	if gw, ok := a.w.(groupWriter); ok {
+		return gw.WriteGroup(msg)
+	}
+
+	_, err := a.w.Write(b)
+	return err
+}
+
+// backoff returns how long to wait after the given amount of failed attempts, the wait doubles up to backoffMax
+func (a *AuditWriter) backoff(failures int) time.Duration {
+	wait := a.backoffInitial
+	for i := 1; i < failures && wait < a.backoffMax; i++ {
+		wait *= 2
+	}
+
+	if wait > a.backoffMax {
+		wait = a.backoffMax
+	}
+	return wait
+}
+
+// replay writes spooled messages to the output in the order they were spooled until the context is done.
+// A failed message is retried with an exponential backoff until the output recovers
+func (a *AuditWriter) replay(ctx context.Context) {
+	failures := 0
+	for {
+		a.spool.replayMu.Lock()
+		if ctx.Err() != nil {
+			a.spool.replayMu.Unlock()
+			// Hand a wake up we may have taken over to the output that replaced us
+			a.spool.notify()
+			return
+		}
+
+		b, err := a.spool.Peek()
+		if err == nil {
+			if _, err = a.w.Write(b); err == nil {
+				a.spool.Commit()
+				a.spool.replayMu.Unlock()
+				failures = 0
+				continue
+			}
+		}
+		a.spool.replayMu.Unlock()
+
+		// An empty spool waits for new messages, a failing output is retried after a while
+		var retry <-chan time.Time
+		if err != io.EOF {
+			failures++
+			logrus.WithError(err).WithField("output", a.name).Debug("failed to replay spooled message")
+			retry = time.After(a.backoff(failures))
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-a.spool.wake:
+		case <-retry:
+		}
+	}
+}
+
+// validateFailurePolicy returns an error if the policy is not known, an empty policy means exit.
+func validateFailurePolicy(name, policy string) (string, error) {
+	switch policy {
+	case "":
+		return FailurePolicyExit, nil
+	case FailurePolicyExit, FailurePolicyDrop, FailurePolicySpool, FailurePolicyBlock:
+		return policy, nil
+	}
+	return "", fmt.Errorf("output on_failure for %s must be one of `exit`, `drop`, `block` or `spool`, %s provided", name, policy)
+}
+
+// flushOutputs flushes every output that queues messages, the outputs share the timeout.
+// It returns how many messages could not be delivered in time
+func flushOutputs(writers []*AuditWriter, timeout time.Duration) int {
+	deadline := time.Now().Add(timeout)
+	left := 0
+
+	for _, w := range writers {
+		f, ok := w.w.(flusher)
+		if !ok {
+			continue
+		}
+
+		remaining := deadline.Sub(time.Now())
+		if remaining < 0 {
+			remaining = 0
+		}
+
+		if n := f.Flush(remaining); n > 0 {
+			logrus.WithField("output", w.name).Errorf("%d messages were not delivered before the shutdown timeout", n)
+			left += n
+		}
+	}
+
+	return left
+}
+
+// stopOutputsAfter stops the outputs once the timeout expired unless the returned timer is stopped before.
+// Outputs that block on failure hold the marshaller, this bounds how long shutdowns and reloads wait for them
+func stopOutputsAfter(writers []*AuditWriter, timeout time.Duration) *time.Timer {
+	return time.AfterFunc(timeout, func() {
+		for _, w := range writers {
+			w.Stop()
+		}
+	})
+}
+
+// closeSpools closes the spools of the outputs once they were stopped, the spooled messages stay on disk
+func closeSpools(writers []*AuditWriter) {
+	for _, w := range writers {
+		if w.spool == nil {
+			continue
+		}
+
+		// Waits for the replay of a message in progress
+		w.spool.replayMu.Lock()
+		if err := w.spool.Close(); err != nil {
+			logrus.WithError(err).WithField("output", w.name).Error("failed to close spool")
+		}
+		w.spool.replayMu.Unlock()
+	}
+}
+
+// closeOutputs closes outputs that were replaced by a reload, stdout stays open
+func closeOutputs(writers []*AuditWriter) {
+	for _, w := range writers {
+		c, ok := w.w.(io.Closer)
+		if !ok || w.w == io.Writer(os.Stdout) {
+			continue
+		}
+
+		if err := c.Close(); err != nil {
+			logrus.WithError(err).WithField("output", w.name).Error("failed to close output")
+		}
 	}
-	return nil
 }
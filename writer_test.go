@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAuditWriterBackoff(t *testing.T) {
+	w := NewAuditWriter(&bytes.Buffer{}, 1)
+	assert.Equal(t, time.Second, w.backoff(1))
+	assert.Equal(t, 2*time.Second, w.backoff(2))
+	assert.Equal(t, 4*time.Second, w.backoff(3))
+	assert.Equal(t, 16*time.Second, w.backoff(5))
+	assert.Equal(t, 30*time.Second, w.backoff(6))
+	assert.Equal(t, 30*time.Second, w.backoff(1000))
+
+	w.backoffInitial = 10 * time.Millisecond
+	w.backoffMax = 15 * time.Millisecond
+	assert.Equal(t, 10*time.Millisecond, w.backoff(1))
+	assert.Equal(t, 15*time.Millisecond, w.backoff(2))
+}
+
+func TestAuditWriterWrite(t *testing.T) {
+	// Attempts are retried
+	fw := &flakyWriter{failures: 2}
+	w := NewAuditWriter(fw, 3)
+	w.backoffInitial = time.Millisecond
+	assert.NoError(t, w.Write(&AuditMessageGroup{Seq: 1}))
+	assert.Equal(t, 3, fw.attempts)
+	assert.Contains(t, fw.buf.String(), `"sequence":1,`)
+
+	// Until they are exhausted
+	fw = &flakyWriter{failures: 3}
+	w = NewAuditWriter(fw, 3)
+	w.backoffInitial = time.Millisecond
+	assert.EqualError(t, w.Write(&AuditMessageGroup{Seq: 1}), "not yet")
+	assert.Equal(t, 3, fw.attempts)
+
+	// Blocking outputs keep trying beyond their attempts
+	fw = &flakyWriter{failures: 5}
+	w = NewAuditWriter(fw, 1)
+	w.onFailure = FailurePolicyBlock
+	w.backoffInitial = time.Millisecond
+	w.backoffMax = 2 * time.Millisecond
+	assert.NoError(t, w.Write(&AuditMessageGroup{Seq: 1}))
+	assert.Equal(t, 6, fw.attempts)
+	assert.Contains(t, fw.buf.String(), `"sequence":1,`)
+
+	// Until they are stopped
+	fw = &flakyWriter{failures: 1 << 30}
+	w = NewAuditWriter(fw, 1)
+	w.onFailure = FailurePolicyBlock
+	w.backoffInitial = time.Millisecond
+	w.backoffMax = 2 * time.Millisecond
+	stopOutputsAfter([]*AuditWriter{w}, 20*time.Millisecond)
+	assert.Equal(t, errOutputStopped, w.Write(&AuditMessageGroup{Seq: 1}))
+}
+
+func TestAuditWriterGroupWriter(t *testing.T) {
+	// Outputs that write the struct get the message group itself
+	gw := &groupBuffer{}
+	w := NewAuditWriter(gw, 1)
+	assert.NoError(t, w.Write(&AuditMessageGroup{Seq: 1}))
+	assert.Len(t, gw.groups, 1)
+	assert.Equal(t, 1, gw.groups[0].Seq)
+	assert.Equal(t, 0, gw.Len())
+}
+
+func TestAuditWriterSpoolFull(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	s, err := OpenSpool(dir, "test", 1024, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	fw := &flakyWriter{failures: 10}
+	w := NewAuditWriter(fw, 1)
+	w.onFailure = FailurePolicySpool
+	w.spool = s
+
+	// The first message fills the spool, the ones that don't fit are dropped instead of stopping go-audit
+	assert.NoError(t, w.Write(&AuditMessageGroup{Seq: 1, Hostname: strings.Repeat("a", 600)}))
+	assert.Equal(t, 1, s.Len())
+	assert.NoError(t, w.Write(&AuditMessageGroup{Seq: 2, Hostname: strings.Repeat("a", 600)}))
+	assert.Equal(t, 1, s.Len())
+}
+
+func TestValidateFailurePolicy(t *testing.T) {
+	for _, p := range []string{FailurePolicyExit, FailurePolicyDrop, FailurePolicyBlock, FailurePolicySpool} {
+		policy, err := validateFailurePolicy("stdout", p)
+		assert.NoError(t, err)
+		assert.Equal(t, p, policy)
+	}
+
+	policy, err := validateFailurePolicy("stdout", "")
+	assert.NoError(t, err)
+	assert.Equal(t, FailurePolicyExit, policy, "exit should be the default")
+
+	_, err = validateFailurePolicy("stdout", "ignore")
+	assert.EqualError(t, err, "output on_failure for stdout must be one of `exit`, `drop`, `block` or `spool`, ignore provided")
+}
+
+// flakyWriter fails the first writes
+type flakyWriter struct {
+	failures int
+	attempts int
+	buf      bytes.Buffer
+}
+
+func (f *flakyWriter) Write(p []byte) (int, error) {
+	f.attempts++
+	if f.attempts <= f.failures {
+		return 0, errors.New("not yet")
+	}
+	return f.buf.Write(p)
+}
+
+// groupBuffer writes message groups as they are
+type groupBuffer struct {
+	bytes.Buffer
+	groups []*AuditMessageGroup
+}
+
+func (g *groupBuffer) WriteGroup(msg *AuditMessageGroup) error {
+	g.groups = append(g.groups, msg)
+	return nil
+}